@@ -34,10 +34,30 @@ type Message struct {
 }
 
 // WorkflowInstruction for chaining tasks.
+// Next (with Delay, Payload, Queue, Priority and Options) chains a single
+// task; Fanout chains any number of tasks in parallel. Both may be set. Every
+// chained task is enqueued atomically with the ACK of the task that returned
+// the instruction: if the enqueue fails, the task is not acknowledged and
+// will be retried.
 type WorkflowInstruction struct {
-	Next    string      `json:"next"`
+	Next    string      `json:"next,omitempty"`
 	Delay   int64       `json:"delay,omitempty"` // milliseconds
 	Payload interface{} `json:"payload,omitempty"`
+	// Queue and Priority route the Next task; they override the same
+	// fields of Options when set.
+	Queue    string         `json:"queue,omitempty"`
+	Priority Priority       `json:"priority,omitempty"`
+	Options  EnqueueOptions `json:"options,omitempty"` // Options of the Next task
+	Fanout   []NextTask     `json:"fanout,omitempty"`
+	// Compensate registers the task that undoes this step if its saga
+	// fails (see StartSaga). Ignored outside of a saga.
+	Compensate *Compensation `json:"compensate,omitempty"`
+	// Wait suspends the workflow until a signal arrives; Next then runs
+	// once it does (see WaitForSignal).
+	Wait *SignalWait `json:"wait,omitempty"`
+	// Map runs a task for each item of a collection, then an optional
+	// reduce task with their results (see MapStep).
+	Map *MapStep `json:"map,omitempty"`
 }
 
 // Config for the Backstage client.
@@ -58,7 +78,44 @@ type Config struct {
 	// bounded instead of growing forever. Safe in the default pattern where a
 	// single consumer group drains each work queue; leave false if another
 	// consumer group replays the same streams. Does not affect broadcast.
+	// See Retention for a cheaper alternative that is safe with any number
+	// of groups.
 	DeleteOnAck   bool
+	// Retention maps stream names (without the prefix, e.g. "default",
+	// "billing", "default:dead-letter", "broadcast") to the history they
+	// keep. Entries still needed by a consumer group are never trimmed.
+	Retention     map[string]RetentionPolicy
+	// RetentionInterval is how often a running consumer applies Retention
+	// (default: 1 minute).
+	RetentionInterval time.Duration
+	// Limits maps queue names (e.g. "default", "billing") to the maximum
+	// depth producers may fill them to. See QueueLimit. An invalid limit,
+	// such as OverflowDivert without an OverflowQueue, is logged by New and
+	// fails every enqueue to its queue.
+	Limits        map[string]QueueLimit
+	// UnknownTasks controls what happens to messages whose task name has no
+	// registered handler on this worker. Defaults to UnknownTaskQuarantine.
+	UnknownTasks  UnknownTaskPolicy
+	// ExpiredTasks controls what happens to tasks found past their expiry
+	// (EnqueueOptions.ExpiresAt). Defaults to ExpiredKeep.
+	ExpiredTasks  ExpiredTaskPolicy
+	// ProgressInterval is the minimum time between stored progress updates
+	// of a task (see ReportProgress). Defaults to 500ms.
+	ProgressInterval time.Duration
+	// TrackTasks makes the consumer record the latest state of every task
+	// it handles (see GetTaskState), which GetLineage then reports.
+	TrackTasks bool
+	// TaskDependencies makes the consumer record whether each task it
+	// finishes succeeded, kept for 7 days, which releases the tasks that
+	// depend on it (see EnqueueOptions.DependsOn). It costs a script call and
+	// a key per task, so it is off by default; DependsOn is refused without
+	// it. Producers with it send delayed tasks that expire to a consumer
+	// rather than the expired stream, so their failure is recorded too.
+	TaskDependencies bool
+	// SignalBuffer is how long a signal sent before any workflow waits for
+	// it is kept for the next wait (see Signal). Defaults to
+	// DefaultSignalBuffer.
+	SignalBuffer time.Duration
 }
 
 // DefaultConfig returns sensible defaults.
@@ -81,19 +138,28 @@ type Client struct {
 	running       bool
 	
 	// Batched ACK support
-	pendingAcks   map[string][]string // streamKey -> messageIDs
-	ackChan       chan ackRequest
-	ackWg         sync.WaitGroup
-	ackMu         sync.Mutex
+	pendingAcks    map[string][]string // streamKey -> messageIDs
+	pendingCleanup map[string][]string // streamKey -> keys to delete after ACK
+	ackChan        chan ackRequest
+	ackWg          sync.WaitGroup
+	ackMu          sync.Mutex
 
 	// Custom queues
 	customQueues  []string
 	queuesMu      sync.RWMutex
+
+	// Set from ConsumerConfig by Start; used to report TaskInfo.MaxAttempts
+	maxDeliveries int
+
+	// Cancel functions of the running tasks, by root task ID
+	runningTasks map[string]map[*TaskInfo]context.CancelCauseFunc
+	runningMu    sync.Mutex
 }
 
 type ackRequest struct {
-	stream string
-	id     string
+	stream  string
+	id      string
+	cleanup []string
 }
 
 // Handler is a task handler function.
@@ -111,14 +177,24 @@ func New(cfg Config) *Client {
 		DB:       cfg.DB,
 	})
 
-	return &Client{
-		redis:       rdb,
-		config:      cfg,
-		handlers:    make(map[string]Handler),
-		logger:      NewLogger("Backstage"),
-		pendingAcks: make(map[string][]string),
-		ackChan:     make(chan ackRequest, 1000), // Buffer for high throughput
+	c := &Client{
+		redis:          rdb,
+		config:         cfg,
+		handlers:       make(map[string]Handler),
+		logger:         NewLogger("Backstage"),
+		pendingAcks:    make(map[string][]string),
+		pendingCleanup: make(map[string][]string),
+		ackChan:        make(chan ackRequest, 1000), // Buffer for high throughput
+		runningTasks:   make(map[string]map[*TaskInfo]context.CancelCauseFunc),
 	}
+
+	// Tasks for a misconfigured queue are refused when enqueued
+	for name, limit := range cfg.Limits {
+		if err := limit.validate(name); err != nil {
+			c.logger.Error("Invalid queue limit", "queue", name, "error", err)
+		}
+	}
+	return c
 }
 
 // RegisterQueue adds a custom queue for the consumer to monitor.
@@ -162,12 +238,16 @@ func (c *Client) LogQueues(ctx context.Context, interval time.Duration) {
 					"queue", q.Name, 
 					"pending", q.Pending, 
 					"scheduled", q.Scheduled, 
-					"dead_letter", q.DeadLetter)
+					"dead_letter", q.DeadLetter,
+					"quarantined", q.Quarantined,
+					"expired", q.Expired)
 			}
 			c.logger.Info("Total status", 
 				"pending", info.TotalPending, 
 				"scheduled", info.TotalScheduled, 
-				"dead_letter", info.TotalDL)
+				"dead_letter", info.TotalDL,
+				"quarantined", info.TotalQuarantined,
+				"expired", info.TotalExpired)
 
 		case <-ctx.Done():
 			return
@@ -217,6 +297,12 @@ func (c *Client) scheduledKey() string {
 	return fmt.Sprintf("%s:scheduled", c.config.Prefix)
 }
 
+// scheduledIndexKey returns the hash mapping scheduled task IDs to their
+// member in the scheduled set.
+func (c *Client) scheduledIndexKey() string {
+	return fmt.Sprintf("%s:scheduled-index", c.config.Prefix)
+}
+
 // deadLetterKey returns the dead-letter stream key.
 func (c *Client) deadLetterKey(priority Priority) string {
 	return fmt.Sprintf("%s:%s:dead-letter", c.config.Prefix, priority)
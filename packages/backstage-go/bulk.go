@@ -0,0 +1,633 @@
+// Package backstage bulk enqueueing.
+// Writes many tasks per round trip by pipelining the underlying commands.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// enqueueManyChunk is the number of tasks written per pipeline round trip.
+const enqueueManyChunk = 500
+
+// TaskSpec describes one task to enqueue, with its own options.
+type TaskSpec struct {
+	TaskName string
+	Payload  interface{}
+	Options  EnqueueOptions
+}
+
+// EnqueueResult is the outcome of one task of an EnqueueMany call.
+type EnqueueResult struct {
+	// ID is the task ID, as returned by Enqueue; empty if it was
+	// deduplicated or failed.
+	ID string
+	// Deduplicated is true if the task was skipped because its dedupe key
+	// was already held, or dropped by its throttle.
+	Deduplicated bool
+	// Err is the error that prevented the task from being enqueued.
+	Err error
+}
+
+// EnqueueMany enqueues a batch of tasks, pipelining them in chunks instead of
+// paying one round trip per task.
+// Each task behaves as if passed to Enqueue with its own options, except that
+// a full queue with OverflowBlock is reported as ErrQueueFull instead of
+// waited on.
+//
+// The returned slice has one result per task, in order. Tasks are not
+// enqueued atomically: a failure of one task does not affect the others (see
+// EnqueueAtomic for all-or-nothing semantics). The
+// error is non-nil only if ctx ends before every chunk was written; the
+// unwritten tasks report it too.
+func (c *Client) EnqueueMany(ctx context.Context, tasks []TaskSpec) ([]EnqueueResult, error) {
+	results := make([]EnqueueResult, len(tasks))
+	if err := c.refuseCancelled(ctx); err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results, nil
+	}
+
+	for start := 0; start < len(tasks); start += enqueueManyChunk {
+		if err := ctx.Err(); err != nil {
+			for i := start; i < len(tasks); i++ {
+				results[i].Err = err
+			}
+			return results, err
+		}
+
+		end := start + enqueueManyChunk
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		c.enqueueChunk(ctx, tasks[start:end], results[start:end])
+	}
+
+	return results, nil
+}
+
+// enqueueChunk writes one chunk of tasks in a single round trip. Tasks with
+// a dedupe key take their lock and are written by one script each, so a
+// task is never locked without being written.
+func (c *Client) enqueueChunk(ctx context.Context, tasks []TaskSpec, results []EnqueueResult) {
+	writes := make(map[int]redis.Cmder)
+	plans := make(map[int]*planCmd)
+	limited := make(map[int]*redis.Cmd)
+	parked := make(map[int]*redis.Cmd)
+	prepared := make([]*preparedTask, len(tasks))
+	pipe := c.redis.Pipeline()
+	for i, spec := range tasks {
+		task, err := c.prepareIn(ctx, spec.TaskName, spec.Payload, spec.Options)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		prepared[i] = task
+
+		if task.dependsOn != nil {
+			parked[i] = c.park(ctx, pipe, task)
+		} else if task.debounce != nil || task.throttle != nil {
+			limited[i] = c.writeLimited(ctx, pipe, task)
+		} else if task.dedupeKey != "" || c.limited(task) {
+			plan := newAtomicPlan()
+			plan.add(c, task)
+			plans[i] = plan.run(ctx, pipe)
+		} else {
+			writes[i] = c.write(ctx, pipe, task)
+		}
+	}
+	if len(writes) == 0 && len(plans) == 0 && len(limited) == 0 && len(parked) == 0 {
+		return
+	}
+	pipe.Exec(ctx)
+
+	for i, cmd := range writes {
+		if err := cmd.Err(); err != nil {
+			results[i].Err = fmt.Errorf("enqueue: %w", err)
+			continue
+		}
+		results[i].ID = prepared[i].taskID(cmd)
+	}
+	for i, plan := range plans {
+		ids, conflict, err := plan.result()
+		switch {
+		case err != nil:
+			results[i].Err = fmt.Errorf("enqueue: %w", err)
+		case conflict >= 0:
+			results[i].Deduplicated = true
+		default:
+			results[i].ID = ids[0]
+		}
+	}
+	for i, cmd := range parked {
+		if err := cmd.Err(); err != nil {
+			results[i].Err = fmt.Errorf("park: %w", err)
+		} else {
+			results[i].ID = prepared[i].id
+		}
+	}
+	for i, cmd := range limited {
+		id, err := cmd.Text()
+		if err != nil {
+			results[i].Err = fmt.Errorf("enqueue: %w", err)
+		} else if id == "" {
+			results[i].Deduplicated = true
+		} else {
+			results[i].ID = id
+		}
+	}
+}
+
+// AtomicResult reports the outcome of EnqueueAtomic.
+type AtomicResult struct {
+	// Committed is true if every task was written; false means none was.
+	Committed bool
+	// IDs holds the ID of each task, in order, when Committed is true.
+	IDs []string
+	// Conflict is the index of the task whose dedupe key was already held
+	// when nothing was committed because of it, or -1.
+	Conflict int
+}
+
+// Lua script that writes a set of tasks all-or-nothing.
+// KEYS: every stream, scheduled set, index and dedupe key referenced by the plan
+// ARGV[1]: JSON array of tasks, each either
+//
+//	{"key": <stream KEYS index>, "fields": [f1, v1, ...], "id": "<task ID>"?} or
+//	{"key": <zset KEYS index>, "score": <ms>, "member": "<json>",
+//	 "index": <scheduled index KEYS index>, "id": "<task ID>"},
+//
+// optionally with "dedupe": <KEYS index>, "ttl": <ms> and "token": "<lock
+// value>". With "replace": true (plus "zset" and "index"), a held dedupe key
+// does not conflict if its holder is still scheduled: the holder is removed
+// and the new task takes the lock. Stream tasks may carry "limit": <max
+// depth>, and "overflow": <stream KEYS index> to divert to once it is reached.
+// Tasks with a parent carry "lineage": <lineage index KEYS index>, "parent":
+// "<parent ID>", "parentEntry", "entry" and "lineageTtl": <ms>, and are
+// recorded in the index once written. Stream tasks with an "id" report it
+// instead of their message ID.
+//
+// A step may also be a hash write, {"key": <hash KEYS index>, "hset": [field,
+// value], "pttl": <ms>}, which raises the hash's time to live to pttl (or
+// removes it if 0). With "nx": true, an existing field is kept. Its result
+// is empty. A hash write with "buffer": <list KEYS index> first pops the
+// list; if it held an entry, the hash is left alone and a task is added to
+// "stream": <KEYS index> instead, with "fields" plus a payload of "head",
+// the entry and "tail". The step at (1-based) index "cancels", if any, is
+// then skipped. Its result is the message ID, or empty. A list move,
+// {"key": <list KEYS index>, "rename": <KEYS index of a staged list>,
+// "pttl": <ms>}, renames the staged list, which must exist, to key and sets
+// its time to live; its result is empty too.
+//
+// ARGV[2], if given, is a JSON message to acknowledge once the tasks are
+// written: {"stream": <KEYS index>, "group": "<group>", "id": "<message ID>",
+// "delete": <XDEL after ACK>, "cleanup": [<KEYS index of a key to delete>...]}.
+// Tasks whose dedupe key is held are then skipped (their ID is empty) rather
+// than aborting the plan, and tasks whose queue is full are written anyway
+// unless they have an overflow stream: the acknowledged task already ran.
+// ARGV[2] may be empty to skip it.
+//
+// ARGV[3], if given, is the KEYS index of a workflow's cancellation marker:
+// while it exists, the plan is refused.
+//
+// Every check runs before the first write, so a rejected plan leaves Redis
+// untouched. Returns {1, id1, id2, ...} (empty for skipped tasks) when
+// committed, {0, index} when the dedupe key of the task at (1-based)
+// index is held, {2, index} when its queue is full, or {3} when the
+// workflow was cancelled.
+const atomicEnqueueLua = `
+local plan = cjson.decode(ARGV[1])
+local ack = ARGV[2] and ARGV[2] ~= '' and cjson.decode(ARGV[2])
+if ARGV[3] and redis.call('EXISTS', KEYS[tonumber(ARGV[3])]) == 1 then
+    return {3}
+end
+
+-- Tasks not yet delivered plus delivered but unacknowledged, for the
+-- deepest consumer group. Counting stops at limit when the group's lag is
+-- unknown (e.g. after XDEL), since it then has to walk the stream.
+local function depth(key, limit)
+    local len = redis.call('XLEN', key)
+    local ok, groups = pcall(redis.call, 'XINFO', 'GROUPS', key)
+    if not ok or #groups == 0 then
+        return len
+    end
+    local deepest = 0
+    for _, g in ipairs(groups) do
+        local info = {}
+        for i = 1, #g, 2 do
+            info[g[i]] = g[i + 1]
+        end
+        local lag = tonumber(info['entries-read']) and tonumber(info['lag'])
+        if not lag then
+            lag = #redis.call('XRANGE', key, '(' .. info['last-delivered-id'], '+', 'COUNT', limit)
+        end
+        local d = lag + tonumber(info['pending'])
+        if d > deepest then
+            deepest = d
+        end
+    end
+    return math.min(deepest, len)
+end
+
+local seen = {}
+local replaced = {}
+local added = {}
+for i, t in ipairs(plan) do
+    if t.dedupe then
+        local conflict = seen[t.dedupe]
+        seen[t.dedupe] = true
+        local holder = not conflict and redis.call('GET', KEYS[t.dedupe])
+        if holder then
+            local member = t.replace and redis.call('HGET', KEYS[t.index], holder)
+            if member and redis.call('ZSCORE', KEYS[t.zset], member) then
+                replaced[i] = {holder, member}
+            else
+                conflict = true
+            end
+        end
+        if conflict then
+            if not ack then
+                return {0, i}
+            end
+            t.skip = true
+        end
+    end
+    if t.limit and not t.skip then
+        local key = KEYS[t.key]
+        added[key] = added[key] or depth(key, t.limit)
+        if added[key] >= t.limit then
+            if t.overflow then
+                t.key = t.overflow
+            elseif not ack then
+                return {2, i}
+            end
+        else
+            added[key] = added[key] + 1
+        end
+    end
+    if t.rename and redis.call('EXISTS', KEYS[t.rename]) == 0 then
+        return redis.error_reply('ERR staged list ' .. KEYS[t.rename] .. ' is missing')
+    end
+    local want = (t.hset and 'hash') or (t.rename and 'list') or (t.score and 'zset') or 'stream'
+    local kind = redis.call('TYPE', KEYS[t.key])
+    kind = type(kind) == 'table' and kind.ok or kind
+    if kind ~= 'none' and kind ~= want then
+        return redis.error_reply('WRONGTYPE ' .. KEYS[t.key] .. ' is not a ' .. want)
+    end
+end
+
+local result = {1}
+for i, t in ipairs(plan) do
+    local old = replaced[i]
+    if old then
+        redis.call('ZREM', KEYS[t.zset], old[2])
+        redis.call('HDEL', KEYS[t.index], old[1])
+    end
+    local popped = t.buffer and redis.call('LPOP', KEYS[t.buffer])
+    if popped then
+        local fields = t.fields
+        fields[#fields + 1] = 'payload'
+        fields[#fields + 1] = t.head .. popped .. t.tail
+        result[#result + 1] = redis.call('XADD', KEYS[t.stream], '*', unpack(fields))
+        if t.cancels then
+            plan[t.cancels].skip = true
+        end
+    elseif t.hset then
+        local key = KEYS[t.key]
+        local ttl = redis.call('PTTL', key)
+        redis.call(t.nx and 'HSETNX' or 'HSET', key, t.hset[1], t.hset[2])
+        if not t.pttl or t.pttl == 0 then
+            redis.call('PERSIST', key)
+        elseif ttl == -2 or (ttl >= 0 and ttl < t.pttl) then
+            redis.call('PEXPIRE', key, t.pttl)
+        end
+        result[#result + 1] = ''
+    elseif t.rename then
+        redis.call('RENAME', KEYS[t.rename], KEYS[t.key])
+        redis.call('PEXPIRE', KEYS[t.key], t.pttl)
+        result[#result + 1] = ''
+    elseif t.skip then
+        result[#result + 1] = ''
+    else
+        if t.dedupe then
+            redis.call('SET', KEYS[t.dedupe], t.token, 'PX', t.ttl)
+        end
+        if t.score then
+            redis.call('HSET', KEYS[t.index], t.id, t.member)
+            redis.call('ZADD', KEYS[t.key], t.score, t.member)
+            result[#result + 1] = t.id
+        else
+            local id = redis.call('XADD', KEYS[t.key], '*', unpack(t.fields))
+            result[#result + 1] = t.id or id
+        end
+        if t.lineage then
+            redis.call('HSETNX', KEYS[t.lineage], t.parent, t.parentEntry)
+            redis.call('HSET', KEYS[t.lineage], t.id, t.entry)
+            redis.call('PEXPIRE', KEYS[t.lineage], t.lineageTtl)
+        end
+    end
+end
+
+if ack then
+    redis.call('XACK', KEYS[ack.stream], ack.group, ack.id)
+    if ack.delete then
+        redis.call('XDEL', KEYS[ack.stream], ack.id)
+    end
+    for _, k in ipairs(ack.cleanup or {}) do
+        redis.call('DEL', KEYS[k])
+    end
+end
+return result
+`
+
+// atomicStep is one task of an atomicEnqueueLua plan.
+type atomicStep struct {
+	Key      int      `json:"key"`
+	Fields   []string `json:"fields,omitempty"`
+	Score    int64    `json:"score,omitempty"`
+	Member   string   `json:"member,omitempty"`
+	Index    int      `json:"index,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	Dedupe   int      `json:"dedupe,omitempty"`
+	TTL      int64    `json:"ttl,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Replace  bool     `json:"replace,omitempty"`
+	Zset     int      `json:"zset,omitempty"`
+	Limit    int64    `json:"limit,omitempty"`
+	Overflow int      `json:"overflow,omitempty"`
+
+	// Lineage entry of a task with a parent
+	Lineage     int    `json:"lineage,omitempty"`
+	Parent      string `json:"parent,omitempty"`
+	ParentEntry string `json:"parentEntry,omitempty"`
+	Entry       string `json:"entry,omitempty"`
+	LineageTTL  int64  `json:"lineageTtl,omitempty"`
+
+	// Hash write
+	HSet []string `json:"hset,omitempty"`
+	NX   bool     `json:"nx,omitempty"`
+	PTTL int64    `json:"pttl,omitempty"`
+
+	// List move
+	Rename int `json:"rename,omitempty"`
+
+	// Buffered entry that replaces a hash write
+	Buffer  int    `json:"buffer,omitempty"`
+	Stream  int    `json:"stream,omitempty"`
+	Head    string `json:"head,omitempty"`
+	Tail    string `json:"tail,omitempty"`
+	Cancels int    `json:"cancels,omitempty"`
+}
+
+// atomicAck is the message an atomicEnqueueLua plan acknowledges.
+type atomicAck struct {
+	Stream  int    `json:"stream"`
+	Group   string `json:"group"`
+	ID      string `json:"id"`
+	Delete  bool   `json:"delete,omitempty"`
+	Cleanup []int  `json:"cleanup,omitempty"`
+}
+
+// atomicPlan collects the keys and steps of an atomicEnqueueLua call.
+type atomicPlan struct {
+	keys      []string
+	index     map[string]int
+	steps     []atomicStep
+	ack       *atomicAck
+	cancelled int // KEYS index of the cancellation marker, 0 if none
+}
+
+func newAtomicPlan() *atomicPlan {
+	return &atomicPlan{index: make(map[string]int)}
+}
+
+// key returns the 1-based KEYS index of k, registering it if needed.
+func (p *atomicPlan) key(k string) int {
+	if i, ok := p.index[k]; ok {
+		return i
+	}
+	p.keys = append(p.keys, k)
+	p.index[k] = len(p.keys)
+	return len(p.keys)
+}
+
+// acknowledge makes the plan acknowledge a message of stream for group once
+// its tasks are written, then delete the cleanup keys.
+func (p *atomicPlan) acknowledge(stream, group, id string, del bool, cleanup []string) {
+	p.ack = &atomicAck{Stream: p.key(stream), Group: group, ID: id, Delete: del}
+	for _, k := range cleanup {
+		p.ack.Cleanup = append(p.ack.Cleanup, p.key(k))
+	}
+}
+
+// unlessCancelled makes the plan refuse to commit while the workflow of
+// the task info describes is cancelled.
+func (p *atomicPlan) unlessCancelled(c *Client, info *TaskInfo) {
+	p.cancelled = p.key(c.cancelledKey(info.RootID))
+}
+
+// hset appends a hash write to the plan, applied once its tasks are written.
+// With nx, an existing field is kept. The hash then lives at least ttl, or
+// forever if ttl is 0.
+func (p *atomicPlan) hset(key, field, value string, nx bool, ttl time.Duration) {
+	p.steps = append(p.steps, atomicStep{
+		Key:  p.key(key),
+		HSet: []string{field, value},
+		NX:   nx,
+		PTTL: ttl.Milliseconds(),
+	})
+}
+
+// rename appends a step moving the list staged under src to key, applied
+// once its tasks are written. The list then lives ttl.
+func (p *atomicPlan) rename(src, key string, ttl time.Duration) {
+	p.steps = append(p.steps, atomicStep{
+		Key:    p.key(key),
+		Rename: p.key(src),
+		PTTL:   ttl.Milliseconds(),
+	})
+}
+
+// record appends the lineage entry of a task enqueued later, by another
+// script, to the plan.
+func (p *atomicPlan) record(c *Client, task *preparedTask) {
+	l := task.lineage
+	p.hset(c.lineageKey(l.rootID), l.parentID, l.parent, true, lineageTTL)
+	p.hset(c.lineageKey(l.rootID), task.id, task.lineageEntry(), false, lineageTTL)
+}
+
+// hsetUnlessBuffered appends a hash write like hset, unless the buffer list
+// holds an entry: then the entry is popped and a task is added to stream
+// instead, with fields and a payload of head, the entry and tail, and the
+// step at (0-based) index cancels, if not negative, is skipped. That step
+// must come later in the plan.
+func (p *atomicPlan) hsetUnlessBuffered(key, field, value string, ttl time.Duration, buffer, stream string, fields []string, head, tail string, cancels int) {
+	p.steps = append(p.steps, atomicStep{
+		Key:     p.key(key),
+		HSet:    []string{field, value},
+		PTTL:    ttl.Milliseconds(),
+		Buffer:  p.key(buffer),
+		Stream:  p.key(stream),
+		Fields:  fields,
+		Head:    head,
+		Tail:    tail,
+		Cancels: cancels + 1,
+	})
+}
+
+// add appends a prepared task to the plan.
+func (p *atomicPlan) add(c *Client, task *preparedTask) {
+	var step atomicStep
+	if task.executeAt > 0 {
+		step.Key = p.key(c.scheduledKey())
+		step.Score = task.executeAt
+		step.Member = task.member
+		step.Index = p.key(c.scheduledIndexKey())
+		step.ID = task.id
+	} else {
+		step.Key = p.key(task.streamKey)
+		step.ID = task.id
+		for k, v := range task.values {
+			step.Fields = append(step.Fields, k, fmt.Sprint(v))
+		}
+		if limit, ok := c.limitFor(task.streamKey); ok {
+			step.Limit = limit.MaxDepth
+			if limit.Policy == OverflowDivert && limit.OverflowQueue != "" {
+				step.Overflow = p.key(fmt.Sprintf("%s:%s", c.config.Prefix, limit.OverflowQueue))
+			}
+		}
+	}
+	if l := task.lineage; l != nil {
+		step.Lineage = p.key(c.lineageKey(l.rootID))
+		step.Parent = l.parentID
+		step.ParentEntry = l.parent
+		step.Entry = task.lineageEntry()
+		step.LineageTTL = lineageTTL.Milliseconds()
+	}
+	if task.dedupeKey != "" {
+		step.Dedupe = p.key(task.dedupeKey)
+		step.TTL = task.dedupeTTL.Milliseconds()
+		step.Token = task.token
+		if task.replace {
+			step.Replace = true
+			step.Zset = p.key(c.scheduledKey())
+			step.Index = p.key(c.scheduledIndexKey())
+		}
+	}
+	p.steps = append(p.steps, step)
+}
+
+// planCmd is a queued atomicEnqueueLua call.
+type planCmd struct {
+	cmd *redis.Cmd
+	err error
+}
+
+// run queues the plan on r, which may be a pipeline.
+func (p *atomicPlan) run(ctx context.Context, r redis.Cmdable) *planCmd {
+	planJSON, err := json.Marshal(p.steps)
+	if err != nil {
+		return &planCmd{err: fmt.Errorf("encode plan: %w", err)}
+	}
+	args := []interface{}{string(planJSON)}
+	if p.ack != nil || p.cancelled > 0 {
+		var ackJSON []byte
+		if p.ack != nil {
+			if ackJSON, err = json.Marshal(p.ack); err != nil {
+				return &planCmd{err: fmt.Errorf("encode ack: %w", err)}
+			}
+		}
+		args = append(args, string(ackJSON))
+	}
+	if p.cancelled > 0 {
+		args = append(args, p.cancelled)
+	}
+	return &planCmd{cmd: r.Eval(ctx, atomicEnqueueLua, p.keys, args...)}
+}
+
+// result returns the task IDs of a committed plan, or the index of the task
+// that prevented the commit (-1 if none): its dedupe key conflicted, or its
+// queue was full and the error is ErrQueueFull. The error is
+// ErrWorkflowCancelled if the plan's workflow was cancelled.
+func (pc *planCmd) result() ([]string, int, error) {
+	if pc.err != nil {
+		return nil, -1, pc.err
+	}
+	res, err := pc.cmd.Slice()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	switch status, _ := res[0].(int64); status {
+	case 0:
+		idx, _ := res[1].(int64)
+		return nil, int(idx) - 1, nil
+	case 2:
+		idx, _ := res[1].(int64)
+		return nil, int(idx) - 1, ErrQueueFull
+	case 3:
+		return nil, -1, ErrWorkflowCancelled
+	}
+
+	ids := make([]string, len(res)-1)
+	for i := range ids {
+		ids[i], _ = res[i+1].(string)
+	}
+	return ids, -1, nil
+}
+
+// EnqueueAtomic enqueues a set of tasks all-or-nothing: either every task is
+// written (to its stream, or to the scheduled set if delayed) or none is.
+// The writes run as a single Lua script, so consumers never observe a partial
+// set.
+//
+// If any task's dedupe key is already held (or two tasks share one), nothing
+// is written and the result reports Committed == false with the index of the
+// conflicting task. An error means nothing was committed either; it wraps
+// ErrQueueFull if a task's queue is at its limit (see QueueLimit).
+func (c *Client) EnqueueAtomic(ctx context.Context, tasks []TaskSpec) (*AtomicResult, error) {
+	result := &AtomicResult{Conflict: -1}
+	if len(tasks) == 0 {
+		result.Committed = true
+		return result, nil
+	}
+
+	plan := newAtomicPlan()
+	for i, spec := range tasks {
+		if err := checkOptions("atomic tasks", spec.Options, ruleDebounce|ruleThrottle|ruleDependencies); err != nil {
+			return result, fmt.Errorf("task %d: %w", i, err)
+		}
+		task, err := c.prepareIn(ctx, spec.TaskName, spec.Payload, spec.Options)
+		if err != nil {
+			return result, fmt.Errorf("task %d: %w", i, err)
+		}
+		plan.add(c, task)
+	}
+	if info, ok := TaskInfoFromContext(ctx); ok {
+		plan.unlessCancelled(c, info)
+	}
+
+	ids, conflict, err := plan.run(ctx, c.redis).result()
+	if err == ErrQueueFull {
+		return result, fmt.Errorf("task %d: %w", conflict, err)
+	}
+	if err == ErrWorkflowCancelled {
+		return result, err
+	}
+	if err != nil {
+		return result, fmt.Errorf("atomic enqueue: %w", err)
+	}
+	if conflict >= 0 {
+		result.Conflict = conflict
+		return result, nil
+	}
+
+	result.Committed = true
+	result.IDs = ids
+	return result, nil
+}
@@ -0,0 +1,152 @@
+package backstage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEnqueueMany(t *testing.T) {
+	client := newIsolatedClient(t, "test-bulk")
+	ctx := context.Background()
+
+	tasks := make([]TaskSpec, 0, 1203)
+	for i := 0; i < 1200; i++ {
+		tasks = append(tasks, TaskSpec{TaskName: "bulk.item", Payload: map[string]int{"i": i}})
+	}
+	tasks = append(tasks,
+		TaskSpec{TaskName: "bulk.later", Options: EnqueueOptions{Delay: time.Minute}},
+		TaskSpec{TaskName: "bulk.unique", Options: EnqueueOptions{Queue: "reports", Dedupe: &DedupeConfig{Key: "u1"}}},
+		TaskSpec{TaskName: "bulk.unique", Options: EnqueueOptions{Queue: "reports", Dedupe: &DedupeConfig{Key: "u1"}}},
+	)
+
+	results, err := client.EnqueueMany(ctx, tasks)
+	if err != nil {
+		t.Fatalf("EnqueueMany failed: %v", err)
+	}
+	if len(results) != len(tasks) {
+		t.Fatalf("expected %d results, got %d", len(tasks), len(results))
+	}
+
+	for i, r := range results[:1200] {
+		if r.Err != nil || r.ID == "" {
+			t.Fatalf("item %d: unexpected result %+v", i, r)
+		}
+	}
+	if n := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); n != 1200 {
+		t.Errorf("expected 1200 stream entries, got %d", n)
+	}
+
+	if results[1200].ID == "" || client.redis.ZCard(ctx, client.scheduledKey()).Val() != 1 {
+		t.Errorf("expected delayed task to be scheduled, got %+v", results[1200])
+	}
+	if results[1201].ID == "" || results[1201].Deduplicated {
+		t.Errorf("expected first unique task to be enqueued, got %+v", results[1201])
+	}
+	if results[1202].ID != "" || !results[1202].Deduplicated {
+		t.Errorf("expected second unique task to be deduplicated, got %+v", results[1202])
+	}
+}
+
+func TestEnqueueManyPerItemErrors(t *testing.T) {
+	client := newIsolatedClient(t, "test-bulk-errors")
+	ctx := context.Background()
+
+	results, err := client.EnqueueMany(ctx, []TaskSpec{
+		{TaskName: "bulk.ok"},
+		{TaskName: "bulk.bad", Payload: make(chan int)}, // not JSON-encodable
+		{TaskName: "bulk.ok"},
+	})
+	if err != nil {
+		t.Fatalf("EnqueueMany failed: %v", err)
+	}
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("expected valid items to succeed, got %v / %v", results[0].Err, results[2].Err)
+	}
+	if results[1].Err == nil {
+		t.Error("expected unencodable payload to fail")
+	}
+}
+
+func TestEnqueueManyCancelled(t *testing.T) {
+	client := newIsolatedClient(t, "test-bulk-cancel")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := client.EnqueueMany(ctx, []TaskSpec{{TaskName: "bulk.never"}})
+	if err == nil || results[0].Err == nil {
+		t.Errorf("expected context error, got %v / %+v", err, results[0])
+	}
+}
+
+func TestEnqueueAtomic(t *testing.T) {
+	client := newIsolatedClient(t, "test-atomic")
+	ctx := context.Background()
+
+	res, err := client.EnqueueAtomic(ctx, []TaskSpec{
+		{TaskName: "order.reserve", Payload: map[string]string{"order": "o1"}},
+		{TaskName: "order.notify", Options: EnqueueOptions{Queue: "emails"}},
+		{TaskName: "order.expire", Options: EnqueueOptions{Delay: time.Hour, Dedupe: &DedupeConfig{Key: "expire-o1"}}},
+	})
+	if err != nil {
+		t.Fatalf("EnqueueAtomic failed: %v", err)
+	}
+	if !res.Committed || res.Conflict != -1 || len(res.IDs) != 3 {
+		t.Fatalf("expected committed result, got %+v", res)
+	}
+
+	msg := lastMessage(t, client.redis, client.streamKey(PriorityDefault))
+	if msg.ID != res.IDs[0] || msg.Values["taskName"] != "order.reserve" {
+		t.Errorf("unexpected default stream entry: %v", msg)
+	}
+	if client.redis.XLen(ctx, client.config.Prefix+":emails").Val() != 1 {
+		t.Error("expected task on the emails queue")
+	}
+	if client.redis.ZCard(ctx, client.scheduledKey()).Val() != 1 {
+		t.Error("expected delayed task in the scheduled set")
+	}
+}
+
+func TestEnqueueAtomicConflictWritesNothing(t *testing.T) {
+	client := newIsolatedClient(t, "test-atomic-conflict")
+	ctx := context.Background()
+
+	client.Enqueue(ctx, "order.expire", nil, EnqueueOptions{Dedupe: &DedupeConfig{Key: "held"}})
+	before := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val()
+
+	res, err := client.EnqueueAtomic(ctx, []TaskSpec{
+		{TaskName: "order.reserve"},
+		{TaskName: "order.later", Options: EnqueueOptions{Delay: time.Hour}},
+		{TaskName: "order.expire", Options: EnqueueOptions{Dedupe: &DedupeConfig{Key: "held"}}},
+	})
+	if err != nil {
+		t.Fatalf("EnqueueAtomic failed: %v", err)
+	}
+	if res.Committed || res.Conflict != 2 {
+		t.Fatalf("expected conflict on task 2, got %+v", res)
+	}
+	if after := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); after != before {
+		t.Errorf("expected no stream writes, length went %d -> %d", before, after)
+	}
+	if client.redis.ZCard(ctx, client.scheduledKey()).Val() != 0 {
+		t.Error("expected no scheduled writes")
+	}
+}
+
+func TestEnqueueAtomicWrongTypeWritesNothing(t *testing.T) {
+	client := newIsolatedClient(t, "test-atomic-wrongtype")
+	ctx := context.Background()
+
+	client.redis.Set(ctx, client.config.Prefix+":broken", "not a stream", 0)
+
+	res, err := client.EnqueueAtomic(ctx, []TaskSpec{
+		{TaskName: "ok.task"},
+		{TaskName: "bad.task", Options: EnqueueOptions{Queue: "broken"}},
+	})
+	if err == nil || res.Committed {
+		t.Fatalf("expected an error, got %+v", res)
+	}
+	if client.redis.Exists(ctx, client.streamKey(PriorityDefault)).Val() != 0 {
+		t.Error("expected the valid task not to be written")
+	}
+}
@@ -0,0 +1,231 @@
+// Package backstage workflow cancellation.
+// Cancels every task descending from a root task: scheduled, queued and
+// parked ones are removed, queued ones the search misses are dropped when
+// delivered and running ones have their context cancelled.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Lua script that cancels the tree of tasks descending from a root task.
+// KEYS[1]: cancellation marker, KEYS[2]: lineage index, KEYS[3]: scheduled
+// set, KEYS[4]: scheduled index, KEYS[5...]: the streams the tree's tasks
+// were enqueued to, then the parked hash of each descendant
+// ARGV[1]: root task ID, ARGV[2]: reason, ARGV[3]: marker TTL in ms,
+// ARGV[4]: consumer group, ARGV[5]: entries searched per stream, ARGV[6]:
+// number of streams in KEYS
+//
+// Marks the tree cancelled (keeping the first reason) and removes the root
+// and its descendants from the scheduled set. Descendants among the first
+// ARGV[5] entries of each stream not yet delivered to the group are deleted,
+// as are parked descendants. Returns {found, removed}: found is 1 if the
+// tree was not cancelled yet, or has descendants or a scheduled task.
+const cancelTreeLua = `
+local found = redis.call('EXISTS', KEYS[2])
+if redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3], 'NX') then
+    found = 1
+end
+local ids = redis.call('HKEYS', KEYS[2])
+ids[#ids + 1] = ARGV[1]
+local removed = 0
+for _, id in ipairs(ids) do
+    local member = redis.call('HGET', KEYS[4], id)
+    if member then
+        redis.call('HDEL', KEYS[4], id)
+        removed = removed + redis.call('ZREM', KEYS[3], member)
+    end
+end
+
+local streams = 4 + tonumber(ARGV[6])
+for k = 5, streams do
+    local ok, groups = pcall(redis.call, 'XINFO', 'GROUPS', KEYS[k])
+    if ok then
+        local start = '-'
+        for _, g in ipairs(groups) do
+            local info = {}
+            for i = 1, #g, 2 do
+                info[g[i]] = g[i + 1]
+            end
+            if info['name'] == ARGV[4] then
+                start = '(' .. info['last-delivered-id']
+            end
+        end
+        local entries = redis.call('XRANGE', KEYS[k], start, '+', 'COUNT', ARGV[5])
+        for _, e in ipairs(entries) do
+            local fields = e[2]
+            for i = 1, #fields, 2 do
+                if fields[i] == 'rootId' then
+                    if fields[i + 1] == ARGV[1] then
+                        removed = removed + redis.call('XDEL', KEYS[k], e[1])
+                    end
+                    break
+                end
+            end
+        end
+    end
+end
+for k = streams + 1, #KEYS do
+    removed = removed + redis.call('DEL', KEYS[k])
+end
+
+if removed > 0 then
+    found = 1
+end
+return {found, removed}
+`
+
+// cancelSearch is how many undelivered entries of each stream cancelTree
+// searches for queued tasks of the tree. Those beyond it are dropped when
+// delivered.
+const cancelSearch = 10000
+
+// cancelledKey returns the key marking the tree of a root task cancelled.
+func (c *Client) cancelledKey(rootID string) string {
+	return fmt.Sprintf("%s:cancelled:%s", c.config.Prefix, rootID)
+}
+
+// cancelChannel returns the channel cancellations are published on, for
+// consumers to cancel the tasks they run.
+func (c *Client) cancelChannel() string {
+	return c.config.Prefix + ":cancel"
+}
+
+// cancelTree cancels the tree of tasks descending from rootID, for reason
+// ("cancelled" or "deadline"), and cancels its tasks running on any
+// consumer. Reports whether the tree was not cancelled yet, or has
+// descendants or a scheduled task.
+func (c *Client) cancelTree(ctx context.Context, rootID, reason string) (bool, error) {
+	// The script searches the streams of the tasks indexed so far; tasks
+	// enqueued meanwhile are dropped when delivered
+	index, err := c.redis.HGetAll(ctx, c.lineageKey(rootID)).Result()
+	if err != nil {
+		return false, err
+	}
+	keys := []string{c.cancelledKey(rootID), c.lineageKey(rootID), c.scheduledKey(), c.scheduledIndexKey()}
+	seen := make(map[string]bool)
+	for _, raw := range index {
+		var entry lineageEntry
+		if json.Unmarshal([]byte(raw), &entry) == nil && entry.Stream != "" && !seen[entry.Stream] {
+			seen[entry.Stream] = true
+			keys = append(keys, entry.Stream)
+		}
+	}
+	streams := len(keys) - 4
+	for id := range index {
+		if id != rootID {
+			keys = append(keys, c.parkedKey(id))
+		}
+	}
+
+	res, err := c.redis.Eval(ctx, cancelTreeLua, keys,
+		rootID, reason, lineageTTL.Milliseconds(), c.config.ConsumerGroup, cancelSearch, streams,
+	).Int64Slice()
+	if err != nil {
+		return false, err
+	}
+	if res[1] > 0 {
+		c.logger.Info("Removed tasks of a cancelled workflow", "root", rootID, "reason", reason, "count", res[1])
+	}
+
+	c.cancelRunning(rootID)
+	if err := c.redis.Publish(ctx, c.cancelChannel(), rootID).Err(); err != nil {
+		c.logger.Warn("Failed to publish workflow cancellation", "root", rootID, "error", err)
+	}
+	return res[0] == 1, nil
+}
+
+// trackRunning registers the task info describes as running, so that
+// cancelling its workflow cancels the returned context with
+// ErrWorkflowCancelled as its cause. stop unregisters it.
+func (c *Client) trackRunning(ctx context.Context, info *TaskInfo) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	c.runningMu.Lock()
+	tasks := c.runningTasks[info.RootID]
+	if tasks == nil {
+		tasks = make(map[*TaskInfo]context.CancelCauseFunc)
+		c.runningTasks[info.RootID] = tasks
+	}
+	tasks[info] = cancel
+	c.runningMu.Unlock()
+
+	return ctx, func() {
+		c.runningMu.Lock()
+		delete(tasks, info)
+		if len(c.runningTasks[info.RootID]) == 0 {
+			delete(c.runningTasks, info.RootID)
+		}
+		c.runningMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelRunning cancels the tasks of the tree of rootID running here.
+func (c *Client) cancelRunning(rootID string) {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	for _, cancel := range c.runningTasks[rootID] {
+		cancel(ErrWorkflowCancelled)
+	}
+}
+
+// runCancelListener cancels the running tasks of the workflows cancelled by
+// any client until ctx ends.
+func (c *Client) runCancelListener(ctx context.Context) {
+	sub := c.redis.Subscribe(ctx, c.cancelChannel())
+	defer sub.Close()
+
+	msgs := sub.Channel()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			c.cancelRunning(msg.Payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// workflowCancelled reports whether the workflow of the task running in ctx,
+// which info describes, was cancelled or is past its deadline, as far as
+// this consumer knows.
+func workflowCancelled(ctx context.Context, info *TaskInfo) bool {
+	if errors.Is(context.Cause(ctx), ErrWorkflowCancelled) {
+		return true
+	}
+	return !info.WorkflowDeadline.IsZero() && !time.Now().Before(info.WorkflowDeadline)
+}
+
+// workflowStopped reports whether the workflow msg belongs to was cancelled
+// or is past its deadline. A root task is checked under its own ID, since it
+// may be cancelled while still queued. The first task found past the
+// deadline cancels the rest of its workflow.
+func (c *Client) workflowStopped(ctx context.Context, msg redis.XMessage) (bool, error) {
+	rootID, _ := msg.Values["rootId"].(string)
+	deadline, _ := asInt64(msg.Values["workflowDeadline"])
+	if rootID == "" {
+		rootID = messageTaskID(msg)
+	}
+
+	if deadline > 0 && time.Now().UnixMilli() >= deadline {
+		if _, err := c.cancelTree(ctx, rootID, "deadline"); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	n, err := c.redis.Exists(ctx, c.cancelledKey(rootID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,193 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCancelWorkflowCascade(t *testing.T) {
+	client := newIsolatedClient(t, "test-cancel")
+	client.config.TaskDependencies = true
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	ran := make(map[string]bool)
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		if _, err := client.Enqueue(ctx, "order.ship", nil, EnqueueOptions{DependsOn: []string{"payment"}}); err != nil {
+			return nil, err
+		}
+		return &WorkflowInstruction{Fanout: []NextTask{
+			{TaskName: "order.email"},
+			{TaskName: "order.remind", Delay: time.Hour},
+		}}, nil
+	})
+	for _, name := range []string{"order.email", "order.remind"} {
+		name := name
+		client.On(name, func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+			ran[name] = true
+			return nil, nil
+		})
+	}
+
+	rootID, _ := client.Enqueue(ctx, "order.place", nil)
+	runMembers(t, client, 1)
+
+	if err := client.CancelWorkflow(ctx, rootID); err != nil {
+		t.Fatalf("CancelWorkflow failed: %v", err)
+	}
+	if n, _ := client.redis.ZCard(ctx, client.scheduledKey()).Result(); n != 0 {
+		t.Errorf("expected the scheduled descendant removed, %d scheduled", n)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 1 || ran["order.email"] {
+		t.Errorf("expected the queued descendant removed, stream has %d entries", n)
+	}
+	if keys, _ := client.redis.Keys(ctx, "test-cancel:parked:*").Result(); len(keys) != 0 {
+		t.Errorf("expected the parked descendant removed, got %v", keys)
+	}
+
+	// Any ID may be a queued root, but only the first cancellation finds it
+	if err := client.CancelWorkflow(ctx, "missing"); err != nil {
+		t.Errorf("expected the first cancellation to succeed, got %v", err)
+	}
+	if err := client.CancelWorkflow(ctx, "missing"); !errors.Is(err, ErrWorkflowNotFound) {
+		t.Errorf("expected ErrWorkflowNotFound, got %v", err)
+	}
+}
+
+func TestCancelWorkflowRunningTask(t *testing.T) {
+	client := newIsolatedClient(t, "test-cancel-running")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	started := make(chan struct{})
+	var cause, enqueueErr error
+	client.On("report.build", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		close(started)
+		<-ctx.Done()
+		cause = context.Cause(ctx)
+		_, enqueueErr = client.Enqueue(ctx, "report.send", nil)
+		return nil, ctx.Err()
+	})
+
+	rootID, _ := client.Enqueue(ctx, "report.build", nil)
+	msg := readOne(t, client, stream)
+	done := make(chan struct{})
+	go func() {
+		client.handleMessage(ctx, stream, msg)
+		close(done)
+	}()
+	<-started
+	if err := client.CancelWorkflow(ctx, rootID); err != nil {
+		t.Errorf("CancelWorkflow failed: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the running task cancelled")
+	}
+	if !errors.Is(cause, ErrWorkflowCancelled) || !errors.Is(enqueueErr, ErrWorkflowCancelled) {
+		t.Errorf("expected ErrWorkflowCancelled as cause and from Enqueue, got %v and %v", cause, enqueueErr)
+	}
+	if req := <-client.ackChan; req.id != msg.ID {
+		t.Errorf("expected the cancelled task acknowledged instead of retried, got %s", req.id)
+	}
+}
+
+func TestWorkflowTimeout(t *testing.T) {
+	client := newIsolatedClient(t, "test-cancel-deadline")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	var rootInfo *TaskInfo
+	ran := false
+	client.On("import.start", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		rootInfo, _ = TaskInfoFromContext(ctx)
+		return &WorkflowInstruction{Fanout: []NextTask{
+			{TaskName: "import.step", Options: EnqueueOptions{WorkflowTimeout: time.Hour}},
+			{TaskName: "import.step", Delay: time.Hour},
+		}}, nil
+	})
+	client.On("import.step", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		ran = true
+		return nil, nil
+	})
+
+	client.Enqueue(ctx, "import.start", nil, EnqueueOptions{WorkflowTimeout: 50 * time.Millisecond})
+	runMembers(t, client, 1)
+
+	if rootInfo.WorkflowDeadline.IsZero() || !rootInfo.Deadline.Equal(rootInfo.WorkflowDeadline) {
+		t.Errorf("expected the workflow deadline as the task deadline, got %v and %v", rootInfo.Deadline, rootInfo.WorkflowDeadline)
+	}
+	child := lastMessage(t, client.redis, stream)
+	if d, _ := asInt64(child.Values["workflowDeadline"]); d != rootInfo.WorkflowDeadline.UnixMilli() {
+		t.Errorf("expected the child to inherit the earlier deadline, got %v", child.Values["workflowDeadline"])
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	runMembers(t, client, 1)
+	if ran {
+		t.Error("expected the task past the workflow deadline dropped")
+	}
+	if n, _ := client.redis.ZCard(ctx, client.scheduledKey()).Result(); n != 0 {
+		t.Errorf("expected the deadline to cancel the scheduled task, %d scheduled", n)
+	}
+}
+
+func TestCancelledMarkerRefusesChildren(t *testing.T) {
+	client := newIsolatedClient(t, "test-cancel-marker")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	// Cancelled by another client whose notice has not arrived yet
+	var enqueueErr error
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		info, _ := TaskInfoFromContext(ctx)
+		client.redis.Set(ctx, client.cancelledKey(info.RootID), "cancelled", time.Minute)
+		_, enqueueErr = client.Enqueue(ctx, "order.email", nil)
+		return &WorkflowInstruction{Next: "order.ship"}, nil
+	})
+
+	client.Enqueue(ctx, "order.place", nil)
+	msg := readOne(t, client, stream)
+	client.handleMessage(ctx, stream, msg)
+
+	if !errors.Is(enqueueErr, ErrWorkflowCancelled) {
+		t.Errorf("expected Enqueue refused with ErrWorkflowCancelled, got %v", enqueueErr)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 1 {
+		t.Errorf("expected nothing chained, stream has %d entries", n)
+	}
+	if req := <-client.ackChan; req.id != msg.ID {
+		t.Errorf("expected the task acknowledged, got %s", req.id)
+	}
+}
+
+func TestCancelQueuedRoot(t *testing.T) {
+	client := newIsolatedClient(t, "test-cancel-root")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	ran := false
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		ran = true
+		return nil, nil
+	})
+	rootID, _ := client.Enqueue(ctx, "order.place", nil)
+	if err := client.CancelWorkflow(ctx, rootID); err != nil {
+		t.Fatalf("CancelWorkflow failed: %v", err)
+	}
+
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+	if ran {
+		t.Error("expected the queued root dropped")
+	}
+}
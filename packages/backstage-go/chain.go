@@ -0,0 +1,169 @@
+// Package backstage workflow chaining.
+// Enqueues the tasks a handler chains through its WorkflowInstruction in the
+// same atomic step as the handler's ACK.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// NextTask is one task chained by a WorkflowInstruction. Delay is encoded in
+// JSON as milliseconds, like WorkflowInstruction.Delay.
+type NextTask struct {
+	TaskName string         `json:"taskName"`
+	Payload  interface{}    `json:"payload,omitempty"`
+	Delay    time.Duration  `json:"-"` // Overrides Options.Delay if set
+	Options  EnqueueOptions `json:"options,omitempty"`
+}
+
+// nextTaskJSON is the wire form of NextTask.
+type nextTaskJSON struct {
+	TaskName string         `json:"taskName"`
+	Payload  interface{}    `json:"payload,omitempty"`
+	Delay    int64          `json:"delay,omitempty"` // milliseconds
+	Options  EnqueueOptions `json:"options,omitempty"`
+}
+
+// MarshalJSON encodes the task with its delay in milliseconds.
+func (t NextTask) MarshalJSON() ([]byte, error) {
+	return json.Marshal(nextTaskJSON{
+		TaskName: t.TaskName,
+		Payload:  t.Payload,
+		Delay:    t.Delay.Milliseconds(),
+		Options:  t.Options,
+	})
+}
+
+// UnmarshalJSON decodes a task whose delay is in milliseconds.
+func (t *NextTask) UnmarshalJSON(data []byte) error {
+	var w nextTaskJSON
+	if err := json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	*t = NextTask{
+		TaskName: w.TaskName,
+		Payload:  w.Payload,
+		Delay:    time.Duration(w.Delay) * time.Millisecond,
+		Options:  w.Options,
+	}
+	return nil
+}
+
+// nextTasks lists the tasks chained by result, in order. Each inherits the
+// parent's headers, which its own headers override.
+func nextTasks(result *WorkflowInstruction, headers map[string]string) []NextTask {
+	var next []NextTask
+	if result.Next != "" && result.Wait == nil {
+		opt := result.Options
+		if result.Queue != "" {
+			opt.Queue = result.Queue
+		}
+		if result.Priority != "" {
+			opt.Priority = result.Priority
+		}
+		next = append(next, NextTask{
+			TaskName: result.Next,
+			Payload:  result.Payload,
+			Delay:    time.Duration(result.Delay) * time.Millisecond,
+			Options:  opt,
+		})
+	}
+	next = append(next, result.Fanout...)
+
+	for i := range next {
+		opt := &next[i].Options
+		if next[i].Delay > 0 {
+			opt.Delay = next[i].Delay
+		}
+		opt.Headers = mergeHeaders(headers, opt.Headers)
+	}
+	return next
+}
+
+// mergeHeaders returns inherited overridden by own.
+func mergeHeaders(inherited, own map[string]string) map[string]string {
+	if len(inherited) == 0 {
+		return own
+	}
+	merged := make(map[string]string, len(inherited)+len(own))
+	for k, v := range inherited {
+		merged[k] = v
+	}
+	for k, v := range own {
+		merged[k] = v
+	}
+	return merged
+}
+
+// chainAndAck enqueues the tasks chained by result and acknowledges msg in a
+// single script, then deletes the cleanup keys. Chained tasks whose dedupe
+// key is held are skipped, and a full queue (see QueueLimit) only diverts
+// them: the handler of msg already ran. Chained tasks are children of the task of msg
+// (see GetLineage), and tasks chained from a saga step join the saga. A
+// signal wait of result is registered by the same script, as are the first
+// items of a map step. Returns ErrWorkflowCancelled, enqueueing nothing, if
+// the workflow of msg was cancelled. On error nothing was enqueued and msg
+// stays pending, so the reclaimer retries it.
+func (c *Client) chainAndAck(ctx context.Context, info *TaskInfo, msg redis.XMessage, result *WorkflowInstruction, next []NextTask, cleanup []string) error {
+	sagaID, _ := msg.Values["sagaId"].(string)
+
+	// Children of a cancelled workflow are refused, here and by the script
+	if workflowCancelled(ctx, info) {
+		return ErrWorkflowCancelled
+	}
+
+	plan := newAtomicPlan()
+	plan.unlessCancelled(c, info)
+	for i, task := range next {
+		prepared, err := c.prepareChild(info, sagaID, task)
+		if err != nil {
+			return fmt.Errorf("next task %d (%s): %w", i, task.TaskName, err)
+		}
+		plan.add(c, prepared)
+	}
+	if result != nil && result.Wait != nil {
+		if err := c.planWait(plan, info, sagaID, result); err != nil {
+			return err
+		}
+	}
+	if result != nil && result.Map != nil {
+		if err := c.planMap(ctx, plan, info, sagaID, result.Map); err != nil {
+			return err
+		}
+	}
+	plan.acknowledge(info.Stream, c.config.ConsumerGroup, msg.ID, c.config.DeleteOnAck, cleanup)
+
+	if _, _, err := plan.run(ctx, c.redis).result(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// prepareChild prepares a task chained by the task info describes, joining
+// saga sagaID if set.
+func (c *Client) prepareChild(info *TaskInfo, sagaID string, task NextTask) (*preparedTask, error) {
+	what, rules := "chained tasks", ruleDebounce|ruleThrottle|ruleDependencies
+	if sagaID != "" {
+		// A skipped step would never finish, so the saga never would
+		what, rules = "saga steps", rules|ruleDedupe
+	}
+	if err := checkOptions(what, task.Options, rules); err != nil {
+		return nil, err
+	}
+	prepared, err := c.prepareTask(task.TaskName, task.Payload, task.Options)
+	if err != nil {
+		return nil, err
+	}
+	if sagaID != "" {
+		prepared.setField("sagaId", sagaID)
+	}
+	if err := prepared.inherit(lineageOf(info)); err != nil {
+		return nil, err
+	}
+	return prepared, nil
+}
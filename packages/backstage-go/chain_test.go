@@ -0,0 +1,92 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestChainWithOptions(t *testing.T) {
+	client := newIsolatedClient(t, "test-chain-options")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{
+			Next:     "order.ship",
+			Priority: PriorityUrgent,
+			Options: EnqueueOptions{
+				Priority: PriorityLow, // Overridden by Priority
+				Attempts: 3,
+				Timeout:  time.Minute,
+				Backoff:  &BackoffConfig{Type: BackoffFixed, Delay: 500},
+			},
+		}, nil
+	})
+
+	client.Enqueue(ctx, "order.place", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	next := lastMessage(t, client.redis, client.streamKey(PriorityUrgent))
+	if next.Values["taskName"] != "order.ship" {
+		t.Fatalf("expected the next task on the urgent stream, got %v", next.Values)
+	}
+	if next.Values["attempts"] != "3" || next.Values["timeout"] != "60000" || next.Values["backoff"] == nil {
+		t.Errorf("expected the next task's options, got %v", next.Values)
+	}
+}
+
+func TestChainToQueue(t *testing.T) {
+	client := newIsolatedClient(t, "test-chain-queue")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{Next: "email.send", Queue: "emails"}, nil
+	})
+
+	client.Enqueue(ctx, "order.place", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if next := lastMessage(t, client.redis, "test-chain-queue:emails"); next.Values["taskName"] != "email.send" {
+		t.Errorf("expected the next task on the emails queue, got %v", next.Values)
+	}
+}
+
+func TestChainIntoFullQueue(t *testing.T) {
+	client := newIsolatedClient(t, "test-chain-full")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.config.Limits = map[string]QueueLimit{"low": {MaxDepth: 1}}
+
+	runs := 0
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		runs++
+		return &WorkflowInstruction{Next: "order.ship", Priority: PriorityLow}, nil
+	})
+
+	client.Enqueue(ctx, "filler", nil, EnqueueOptions{Priority: PriorityLow})
+	client.Enqueue(ctx, "order.place", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	// The handler already succeeded, so the full queue does not make it run again
+	if n, _ := client.redis.XLen(ctx, client.streamKey(PriorityLow)).Result(); n != 2 {
+		t.Errorf("expected the next task written past the limit, low stream has %d entries", n)
+	}
+	pending, _ := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Result()
+	if pending.Count != 0 || runs != 1 {
+		t.Errorf("expected the parent acknowledged after one run, %d pending after %d runs", pending.Count, runs)
+	}
+
+	// Diverted when the queue has an overflow queue
+	client.config.Limits = map[string]QueueLimit{"low": {MaxDepth: 1, Policy: OverflowDivert, OverflowQueue: "low-overflow"}}
+	client.Enqueue(ctx, "order.place", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+	if n, _ := client.redis.XLen(ctx, "test-chain-full:low-overflow").Result(); n != 1 {
+		t.Errorf("expected the next task diverted, overflow stream has %d entries", n)
+	}
+}
@@ -5,6 +5,7 @@ package backstage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -22,7 +23,7 @@ type ConsumerConfig struct {
 	BlockTimeout      time.Duration
 	ReclaimerInterval time.Duration
 	IdleTimeout       time.Duration
-	MaxDeliveries     int
+	MaxDeliveries     int // Redeliveries before dead-lettering, so MaxDeliveries+1 runs in all
 	GracePeriod       time.Duration
 	Prefetch          int64 // Max messages per XREADGROUP (backpressure)
 	Concurrency       int   // Max concurrent tasks (backpressure)
@@ -49,6 +50,7 @@ func (c *Client) On(taskName string, handler Handler) {
 // Start begins processing tasks.
 func (c *Client) Start(ctx context.Context, cfg ConsumerConfig) error {
 	c.running = true
+	c.maxDeliveries = cfg.MaxDeliveries
 
 	// Create consumer groups
 	if err := c.initConsumerGroups(ctx); err != nil {
@@ -74,6 +76,14 @@ func (c *Client) Start(ctx context.Context, cfg ConsumerConfig) error {
 	// Start scheduled task processor
 	go c.processScheduled(ctx)
 
+	// Cancel running tasks of cancelled workflows
+	go c.runCancelListener(ctx)
+
+	// Start stream trimmer
+	if len(c.config.Retention) > 0 {
+		go c.runRetention(ctx)
+	}
+
 	// Main loop
 	return c.processLoop(ctx, cfg)
 }
@@ -91,11 +101,13 @@ func (c *Client) runAckFlusher(ctx context.Context) {
 			}
 			c.ackMu.Lock()
 			c.pendingAcks[req.stream] = append(c.pendingAcks[req.stream], req.id)
+			c.pendingCleanup[req.stream] = append(c.pendingCleanup[req.stream], req.cleanup...)
 			if len(c.pendingAcks[req.stream]) >= 100 {
-				ids := c.pendingAcks[req.stream]
+				ids, cleanup := c.pendingAcks[req.stream], c.pendingCleanup[req.stream]
 				c.pendingAcks[req.stream] = nil
+				c.pendingCleanup[req.stream] = nil
 				c.ackMu.Unlock()
-				c.ackAndMaybeDelete(ctx, req.stream, ids)
+				c.ackAndMaybeDelete(ctx, req.stream, ids, cleanup)
 			} else {
 				c.ackMu.Unlock()
 			}
@@ -114,8 +126,9 @@ func (c *Client) flushAllAcks(ctx context.Context) {
 
 	for stream, ids := range c.pendingAcks {
 		if len(ids) > 0 {
-			c.ackAndMaybeDelete(ctx, stream, ids)
+			c.ackAndMaybeDelete(ctx, stream, ids, c.pendingCleanup[stream])
 			c.pendingAcks[stream] = nil
+			c.pendingCleanup[stream] = nil
 		}
 	}
 }
@@ -123,19 +136,27 @@ func (c *Client) flushAllAcks(ctx context.Context) {
 // ackAndMaybeDelete acknowledges the given message IDs and, when DeleteOnAck is
 // enabled, removes them from the stream so its length stays bounded. XDEL runs
 // only after a successful XACK, so it never touches unacked (in-flight) entries
-// that the reclaimer still needs.
-func (c *Client) ackAndMaybeDelete(ctx context.Context, stream string, ids []string) {
+// that the reclaimer still needs. Per-task state listed in cleanup is deleted
+// after the ACK for the same reason.
+func (c *Client) ackAndMaybeDelete(ctx context.Context, stream string, ids []string, cleanup []string) {
 	if len(ids) == 0 {
 		return
 	}
-	c.redis.XAck(ctx, stream, c.config.ConsumerGroup, ids...)
+	if err := c.redis.XAck(ctx, stream, c.config.ConsumerGroup, ids...).Err(); err != nil {
+		return
+	}
 	if c.config.DeleteOnAck {
 		c.redis.XDel(ctx, stream, ids...)
 	}
+	if len(cleanup) > 0 {
+		c.redis.Del(ctx, cleanup...)
+	}
 }
 
-func (c *Client) queueAck(stream, id string) {
-	c.ackChan <- ackRequest{stream: stream, id: id}
+// queueAck schedules an ACK for the next batch. Keys in cleanup are deleted
+// once the ACK has been applied.
+func (c *Client) queueAck(stream, id string, cleanup ...string) {
+	c.ackChan <- ackRequest{stream: stream, id: id, cleanup: cleanup}
 }
 
 // Stop stops the worker.
@@ -250,45 +271,171 @@ func (c *Client) processLoop(ctx context.Context, cfg ConsumerConfig) error {
 }
 
 func (c *Client) handleMessage(ctx context.Context, streamKey string, msg redis.XMessage) {
+	c.handleDelivery(ctx, streamKey, msg, 1)
+}
+
+// handleDelivery runs the handler for msg, which has now been delivered
+// deliveries times (1 for a fresh read, more when reclaimed).
+func (c *Client) handleDelivery(ctx context.Context, streamKey string, msg redis.XMessage, deliveries int) {
 	taskName, _ := msg.Values["taskName"].(string)
 	payloadStr, _ := msg.Values["payload"].(string)
 	timeoutMs, _ := asInt64(msg.Values["timeout"])
 
+	if isExpired(msg) {
+		c.expireTask(ctx, streamKey, msg)
+		return
+	}
+
 	handler, ok := c.handlers[taskName]
 	if !ok {
-		log.Printf("[Backstage] Unknown task: %s", taskName)
+		c.handleUnknownTask(ctx, streamKey, msg, taskName)
+		return
+	}
+
+	// Skip tasks that already completed on an earlier delivery
+	idemKey, idemTTL := messageIdempotency(msg)
+	if idemKey != "" && c.isCompleted(ctx, idemKey) {
+		log.Printf("[Backstage] Skipping completed task: %s (key: %s)", taskName, idemKey)
 		c.queueAck(streamKey, msg.ID)
+		c.releaseDedupe(ctx, msg, DedupeUntilCompleted)
 		return
 	}
 
+	// Tasks of a stopped workflow run or saga are dropped
+	if run, err := c.admit(ctx, msg); errors.Is(err, errNodeFinished) {
+		log.Printf("[Backstage] Skipping finished workflow node: %s (%s)", taskName, msg.ID)
+		c.queueAck(streamKey, msg.ID)
+		c.releaseDedupe(ctx, msg, DedupeUntilCompleted)
+		return
+	} else if err != nil {
+		log.Printf("[Backstage] Failed to check workflow state: %s - %v", taskName, err)
+		return // Don't ACK - let reclaimer handle
+	} else if !run {
+		c.skipTask(ctx, streamKey, msg, deliveries)
+		return
+	}
+
+	// An identical task may be queued again once this one has started
+	c.releaseDedupe(ctx, msg, DedupeUntilStarted)
+
 	// Create a context for the task
+	info := c.newTaskInfo(streamKey, msg, deliveries)
 	taskCtx := ctx
 	if timeoutMs > 0 {
 		var cancel context.CancelFunc
 		taskCtx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
 		defer cancel()
+		info.Deadline, _ = taskCtx.Deadline()
+	}
+	if d := info.WorkflowDeadline; !d.IsZero() && (info.Deadline.IsZero() || d.Before(info.Deadline)) {
+		var cancel context.CancelFunc
+		taskCtx, cancel = context.WithDeadlineCause(taskCtx, d, ErrWorkflowCancelled)
+		defer cancel()
+		info.Deadline = d
 	}
+	taskCtx = withTaskInfo(taskCtx, info)
+	taskCtx, stop := c.trackRunning(taskCtx, info)
+	defer stop()
 
+	c.trackTask(ctx, msg, TaskRunning, deliveries, nil)
 	result, err := handler(taskCtx, json.RawMessage(payloadStr))
+	c.flushProgress(info)
+	if err != nil && workflowCancelled(taskCtx, info) {
+		c.skipTask(ctx, streamKey, msg, deliveries)
+		return
+	}
 	if err != nil {
 		log.Printf("[Backstage] Task failed: %s - %v", taskName, err)
+		c.trackTask(ctx, msg, TaskRetrying, deliveries, err)
 		return // Don't ACK - let reclaimer handle
 	}
 
-	// Handle workflow chaining
+	// The next tasks inherit the headers
+	var next []NextTask
 	if result != nil {
-		if result.Delay > 0 {
-			c.Schedule(ctx, result.Next, result.Payload, time.Duration(result.Delay)*time.Millisecond)
-		} else {
-			c.Enqueue(ctx, result.Next, result.Payload)
+		next = nextTasks(result, info.Headers)
+	}
+
+	// Groups, workflows and sagas hear first: a crash before the ACK only
+	// repeats the report, which is counted once
+	if err := c.reportOutcome(ctx, msg, info.result, result, next, false); err != nil {
+		log.Printf("[Backstage] Failed to report task outcome: %s - %v", taskName, err)
+		return // Don't ACK - let reclaimer handle
+	}
+
+	var cleanup []string
+	if info.usedSteps.Load() {
+		cleanup = append(cleanup, c.stepsKey(info.TaskID))
+	}
+
+	// Chained tasks are enqueued together with the ACK
+	if len(next) > 0 || (result != nil && (result.Wait != nil || result.Map != nil)) {
+		if err := c.chainAndAck(ctx, info, msg, result, next, cleanup); errors.Is(err, ErrWorkflowCancelled) {
+			log.Printf("[Backstage] Not chaining tasks of a cancelled workflow: %s (%s)", taskName, msg.ID)
+			c.queueAck(streamKey, msg.ID, cleanup...)
+		} else if err != nil {
+			log.Printf("[Backstage] Failed to chain tasks: %s - %v", taskName, err)
+			return // Don't ACK - let reclaimer handle
 		}
+	} else {
+		c.queueAck(streamKey, msg.ID, cleanup...)
 	}
 
+	// Recorded only once the chain is committed: a redelivery after a failed
+	// chain must run again rather than be skipped as completed
+	if idemKey != "" {
+		if err := c.recordCompletion(ctx, idemKey, idemTTL, taskName, msg.ID, result); err != nil {
+			log.Printf("[Backstage] Failed to record completion: %s - %v", taskName, err)
+		}
+	}
+	c.trackTask(ctx, msg, TaskSucceeded, deliveries, nil)
+	c.recordOutcome(ctx, msg, true)
+	c.releaseDedupe(ctx, msg, DedupeUntilCompleted)
+}
+
+// skipTask acknowledges msg without running it, because its workflow
+// stopped.
+func (c *Client) skipTask(ctx context.Context, streamKey string, msg redis.XMessage, deliveries int) {
+	taskName, _ := msg.Values["taskName"].(string)
+	log.Printf("[Backstage] Skipping task of a stopped workflow: %s (%s)", taskName, msg.ID)
+	c.trackTask(ctx, msg, TaskSkipped, deliveries, nil)
+	c.recordOutcome(ctx, msg, false)
 	c.queueAck(streamKey, msg.ID)
+	c.releaseDedupe(ctx, msg, DedupeUntilCompleted)
 }
 
-func (c *Client) ack(ctx context.Context, stream, id string) {
-	c.queueAck(stream, id)
+// admit reports whether msg may run: tasks of a cancelled workflow or
+// workflow run, of a failed run, or of a saga that stopped running steps,
+// may not. Workflow nodes are marked running.
+func (c *Client) admit(ctx context.Context, msg redis.XMessage) (bool, error) {
+	if stopped, err := c.workflowStopped(ctx, msg); err != nil || stopped {
+		return false, err
+	}
+	if run, err := c.startWorkflowNode(ctx, msg); err != nil || !run {
+		return false, err
+	}
+	return c.sagaRunning(ctx, msg)
+}
+
+// reportOutcome tells the group, workflow run and saga msg belongs to, if
+// any, that it succeeded or failed for good. value is its SetResult value,
+// result its instruction and next the tasks it chains. Reports are
+// idempotent.
+func (c *Client) reportOutcome(ctx context.Context, msg redis.XMessage, value json.RawMessage, result *WorkflowInstruction, next []NextTask, failed bool) error {
+	if err := c.finishGroupMember(ctx, msg, value, failed); err != nil {
+		return fmt.Errorf("group: %w", err)
+	}
+	if err := c.finishWorkflowNode(ctx, msg, value, failed); err != nil {
+		return fmt.Errorf("workflow: %w", err)
+	}
+	if err := c.finishSagaTask(ctx, msg, result, next, failed); err != nil {
+		return fmt.Errorf("saga: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) ack(ctx context.Context, stream, id string, cleanup ...string) {
+	c.queueAck(stream, id, cleanup...)
 }
 
 func (c *Client) runReclaimer(ctx context.Context, cfg ConsumerConfig) {
@@ -354,7 +501,20 @@ func (c *Client) reclaimIdleMessages(ctx context.Context, cfg ConsumerConfig) {
 				continue
 			}
 
-			if msg.RetryCount > int64(cfg.MaxDeliveries) {
+			// An expired task is discarded rather than retried or dead-lettered
+			if isExpired(claimed[0]) {
+				c.expireTask(ctx, key, claimed[0])
+				continue
+			}
+
+			// Per-task attempts take precedence over the consumer-wide limit,
+			// whether lower or higher than MaxDeliveries
+			exhausted := msg.RetryCount > int64(cfg.MaxDeliveries)
+			if attempts, ok := asInt64(redisMsg.Values["attempts"]); ok && attempts > 0 {
+				exhausted = msg.RetryCount >= attempts
+			}
+
+			if exhausted {
 				// Determine priority for DLQ
 				priority := PriorityDefault
 				if key == c.streamKey(PriorityUrgent) {
@@ -364,7 +524,7 @@ func (c *Client) reclaimIdleMessages(ctx context.Context, cfg ConsumerConfig) {
 				}
 				c.moveToDeadLetter(ctx, priority, claimed[0])
 			} else {
-				c.handleMessage(ctx, key, claimed[0])
+				c.handleDelivery(ctx, key, claimed[0], int(msg.RetryCount)+1)
 			}
 		}
 	}
@@ -400,49 +560,32 @@ func (c *Client) moveToDeadLetter(ctx context.Context, priority Priority, msg re
 	dlKey := c.deadLetterKey(priority)
 	sKey := c.streamKey(priority)
 
+	values := map[string]interface{}{
+		"taskName":       msg.Values["taskName"],
+		"payload":        msg.Values["payload"],
+		"enqueuedAt":     msg.Values["enqueuedAt"],
+		"originalId":     msg.ID,
+		"deadLetteredAt": time.Now().UnixMilli(),
+	}
+	if headers, ok := msg.Values["headers"]; ok {
+		values["headers"] = headers
+	}
 	c.redis.XAdd(ctx, &redis.XAddArgs{
 		Stream: dlKey,
-		Values: map[string]interface{}{
-			"taskName":       msg.Values["taskName"],
-			"payload":        msg.Values["payload"],
-			"enqueuedAt":     msg.Values["enqueuedAt"],
-			"originalId":     msg.ID,
-			"deadLetteredAt": time.Now().UnixMilli(),
-		},
+		Values: values,
 	})
+	c.capLength(ctx, c.redis, dlKey)
 
-	c.ack(ctx, sKey, msg.ID)
-}
+	if err := c.reportOutcome(ctx, msg, nil, nil, nil, true); err != nil {
+		log.Printf("[Backstage] Failed to report task outcome: %s - %v", msg.Values["taskName"], err)
+	}
+	c.trackTask(ctx, msg, TaskDeadLettered, 0, nil)
+	c.recordOutcome(ctx, msg, false)
 
-// Lua script for atomic scheduled task processing
-const processScheduledLuaConsumer = `
-local zsetKey = KEYS[1]
-local cutoff = tonumber(ARGV[1])
-local prefix = ARGV[2]
-local defaultPriority = ARGV[3]
-
-local tasks = redis.call('ZRANGEBYSCORE', zsetKey, '-inf', cutoff)
-local processed = 0
-
-for _, taskData in ipairs(tasks) do
-    local ok, task = pcall(cjson.decode, taskData)
-    if ok and task then
-        local priority = task.priority or defaultPriority
-        local streamKey = prefix .. ':' .. priority
-        
-        redis.call('XADD', streamKey, '*',
-            'taskName', task.taskName or '',
-            'payload', task.payload or '{}',
-            'enqueuedAt', tostring(task.enqueuedAt or 0)
-        )
-        
-        redis.call('ZREM', zsetKey, taskData)
-        processed = processed + 1
-    end
-end
-
-return processed
-`
+	// Memoized steps are useless once the task is dead-lettered
+	c.ack(ctx, sKey, msg.ID, c.stepsKey(messageTaskID(msg)))
+	c.releaseDedupe(ctx, msg, DedupeUntilCompleted)
+}
 
 func (c *Client) processScheduled(ctx context.Context) {
 	ticker := time.NewTicker(time.Second)
@@ -454,10 +597,11 @@ func (c *Client) processScheduled(ctx context.Context) {
 			now := time.Now().UnixMilli()
 
 			// Use atomic Lua script to prevent race conditions
-			c.redis.Eval(ctx, processScheduledLuaConsumer, []string{c.scheduledKey()},
+			c.redis.Eval(ctx, processScheduledLua, []string{c.scheduledKey(), c.scheduledIndexKey()},
 				now,
 				c.config.Prefix,
 				string(PriorityDefault),
+				string(c.config.ExpiredTasks),
 			)
 
 		case <-ctx.Done():
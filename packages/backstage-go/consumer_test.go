@@ -65,6 +65,58 @@ func newTestClient() *Client {
 	})
 }
 
+// newIsolatedClient returns a client whose keys live under their own prefix
+// and are removed when the test ends.
+func newIsolatedClient(t *testing.T, prefix string) *Client {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Port = testPort()
+	cfg.Prefix = prefix
+	cfg.ConsumerGroup = "test-group"
+	cfg.WorkerID = "test-worker"
+	client := New(cfg)
+
+	if err := client.redis.Ping(testCtx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Skipping test, redis unavailble: %v", err)
+	}
+
+	t.Cleanup(func() {
+		keys, _ := client.redis.Keys(testCtx, prefix+":*").Result()
+		if len(keys) > 0 {
+			client.redis.Del(testCtx, keys...)
+		}
+		client.Close()
+	})
+	return client
+}
+
+// lastMessage returns the newest entry of stream.
+func lastMessage(t *testing.T, rdb *redis.Client, stream string) redis.XMessage {
+	t.Helper()
+	msgs, err := rdb.XRevRangeN(testCtx, stream, "+", "-", 1).Result()
+	if err != nil || len(msgs) == 0 {
+		t.Fatalf("no message in %s: %v", stream, err)
+	}
+	return msgs[0]
+}
+
+// readOne delivers the next message of stream to the test consumer.
+func readOne(t *testing.T, client *Client, stream string) redis.XMessage {
+	t.Helper()
+	res, err := client.redis.XReadGroup(testCtx, &redis.XReadGroupArgs{
+		Group:    client.config.ConsumerGroup,
+		Consumer: client.config.WorkerID,
+		Streams:  []string{stream, ">"},
+		Count:    1,
+		Block:    -1,
+	}).Result()
+	if err != nil || len(res) == 0 || len(res[0].Messages) == 0 {
+		t.Fatalf("no message delivered from %s: %v", stream, err)
+	}
+	return res[0].Messages[0]
+}
+
 func TestClientCreation(t *testing.T) {
 	client := newTestClient()
 	defer client.Close()
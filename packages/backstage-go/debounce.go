@@ -0,0 +1,219 @@
+// Package backstage debounce and throttle.
+// Coalesces bursts of tasks sharing a caller-supplied key, atomically so that
+// any number of producers cooperate.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DebounceConfig delays a task until its key has been quiet for Wait.
+// Every enqueue with the same key pushes the pending task back and replaces
+// its payload and options with the latest ones; the task keeps the ID it got
+// when the burst started.
+type DebounceConfig struct {
+	// Key groups the tasks to debounce.
+	Key string
+	// Wait is how long the key must be quiet before the task runs.
+	Wait time.Duration
+	// MaxWait bounds how long a continuous burst can postpone the task,
+	// counted from its first enqueue. Zero means no bound.
+	MaxWait time.Duration
+}
+
+// ThrottleMode controls what happens to a throttled task enqueued while its
+// key's window is closed.
+type ThrottleMode string
+
+const (
+	// ThrottleDrop discards the task. This is the default.
+	ThrottleDrop ThrottleMode = "drop"
+	// ThrottleMerge defers the task to the start of the next window. Tasks
+	// enqueued meanwhile are merged into it: the latest payload wins.
+	ThrottleMerge ThrottleMode = "merge"
+)
+
+// ThrottleConfig runs tasks with the same key at most once per Window.
+type ThrottleConfig struct {
+	// Key groups the tasks to throttle.
+	Key string
+	// Window is the minimum time between two runs.
+	Window time.Duration
+	// Mode controls what happens to tasks enqueued while the window is
+	// closed (default: ThrottleDrop).
+	Mode ThrottleMode
+}
+
+// Lua function shared by debounceLua and throttleLua that records a task
+// enqueued by another task in its root's lineage index, KEYS[k] if given,
+// with the parent ID, the parent's entry, the task's entry and the index TTL
+// in ms in ARGV[a...].
+const recordLineageLua = `
+local function record(k, a, id)
+    if not KEYS[k] then
+        return
+    end
+    redis.call('HSETNX', KEYS[k], ARGV[a], ARGV[a + 1])
+    redis.call('HSET', KEYS[k], id, ARGV[a + 2])
+    redis.call('PEXPIRE', KEYS[k], ARGV[a + 3])
+end
+`
+
+// Lua script that debounces a scheduled task.
+// KEYS[1]: debounce state hash, KEYS[2]: scheduled set, KEYS[3]: scheduled
+// index, KEYS[4]: lineage index, for a task with a parent
+// ARGV[1]: scheduled member, ARGV[2]: its task ID, ARGV[3]: due time in ms,
+// ARGV[4]: max wait in ms (0 for none), ARGV[5]: now in ms, ARGV[6...]:
+// lineage (see recordLineageLua)
+//
+// If the task of the current burst is still scheduled it is replaced by the
+// new member, which takes over the burst's task ID. Returns the task ID.
+const debounceLua = recordLineageLua + `
+local state = redis.call('HMGET', KEYS[1], 'id', 'first')
+local id, first = state[1], tonumber(state[2])
+local member = ARGV[1]
+local due = tonumber(ARGV[3])
+local maxWait = tonumber(ARGV[4])
+local now = tonumber(ARGV[5])
+
+local old = id and redis.call('HGET', KEYS[3], id)
+if old and redis.call('ZSCORE', KEYS[2], old) then
+    redis.call('ZREM', KEYS[2], old)
+    member = string.gsub(member, ARGV[2], id, 1)
+else
+    id = ARGV[2]
+    first = now
+end
+
+if maxWait > 0 and due > first + maxWait then
+    due = first + maxWait
+end
+
+redis.call('HSET', KEYS[3], id, member)
+redis.call('ZADD', KEYS[2], due, member)
+redis.call('HSET', KEYS[1], 'id', id, 'first', first)
+redis.call('PEXPIRE', KEYS[1], due - now + 60000)
+record(4, 6, id)
+return id
+`
+
+// Lua script that throttles a task.
+// KEYS[1]: throttle state hash, KEYS[2]: stream, KEYS[3]: scheduled set,
+// KEYS[4]: scheduled index, KEYS[5]: lineage index, for a task with a parent
+// ARGV[1]: now in ms, ARGV[2]: window in ms, ARGV[3]: mode, ARGV[4]: JSON
+// array of stream fields, ARGV[5]: scheduled member, ARGV[6]: its task ID,
+// ARGV[7...]: lineage (see recordLineageLua)
+//
+// Returns the task ID when the task runs now or is deferred to the next
+// window, the ID of the deferred task it was merged into, or "" when it is
+// dropped.
+const throttleLua = recordLineageLua + `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local nextRun = tonumber(redis.call('HGET', KEYS[1], 'until') or 0)
+
+if now >= nextRun then
+    redis.call('XADD', KEYS[2], '*', unpack(cjson.decode(ARGV[4])))
+    redis.call('HSET', KEYS[1], 'until', now + window)
+    redis.call('HDEL', KEYS[1], 'pending')
+    redis.call('PEXPIRE', KEYS[1], window)
+    record(5, 7, ARGV[6])
+    return ARGV[6]
+end
+if ARGV[3] ~= 'merge' then
+    return ''
+end
+
+-- Merge into the run already deferred to the next window, if any
+local pending = redis.call('HGET', KEYS[1], 'pending')
+local old = pending and redis.call('HGET', KEYS[4], pending)
+local score = old and redis.call('ZSCORE', KEYS[3], old)
+if score then
+    local member = string.gsub(ARGV[5], ARGV[6], pending, 1)
+    redis.call('ZREM', KEYS[3], old)
+    redis.call('HSET', KEYS[4], pending, member)
+    redis.call('ZADD', KEYS[3], score, member)
+    record(5, 7, pending)
+    return pending
+end
+
+redis.call('HSET', KEYS[4], ARGV[6], ARGV[5])
+redis.call('ZADD', KEYS[3], nextRun, ARGV[5])
+redis.call('HSET', KEYS[1], 'until', nextRun + window, 'pending', ARGV[6])
+redis.call('PEXPIRE', KEYS[1], nextRun + window - now)
+record(5, 7, ARGV[6])
+return ARGV[6]
+`
+
+// validateRateLimits checks the Debounce and Throttle options.
+func validateRateLimits(opt EnqueueOptions) error {
+	if opt.Debounce == nil && opt.Throttle == nil {
+		return nil
+	}
+	if opt.Debounce != nil && opt.Throttle != nil {
+		return errors.New("debounce and throttle cannot be combined")
+	}
+	if opt.Dedupe != nil {
+		return errors.New("debounce and throttle cannot be combined with dedupe")
+	}
+	if d := opt.Debounce; d != nil && (d.Key == "" || d.Wait <= 0) {
+		return errors.New("debounce needs a key and a positive wait")
+	}
+	if t := opt.Throttle; t != nil {
+		if opt.Delay > 0 || !opt.ProcessAt.IsZero() {
+			return errors.New("throttle cannot be combined with delay or process-at")
+		}
+		if t.Key == "" || t.Window <= 0 {
+			return errors.New("throttle needs a key and a positive window")
+		}
+		if t.Mode != "" && t.Mode != ThrottleDrop && t.Mode != ThrottleMerge {
+			return fmt.Errorf("unknown throttle mode %q", t.Mode)
+		}
+	}
+	return nil
+}
+
+// writeLimited queues the script writing a debounced or throttled task on r,
+// which may be a pipeline, together with its lineage entry. The command's
+// result is the task ID, or "" if the task was dropped.
+func (c *Client) writeLimited(ctx context.Context, r redis.Cmdable, task *preparedTask) *redis.Cmd {
+	now := time.Now().UnixMilli()
+
+	var script string
+	var keys []string
+	var args []interface{}
+	if d := task.debounce; d != nil {
+		script = debounceLua
+		keys = []string{
+			fmt.Sprintf("%s:debounce:%s", c.config.Prefix, d.Key),
+			c.scheduledKey(),
+			c.scheduledIndexKey(),
+		}
+		args = []interface{}{task.member, task.id, task.executeAt, d.MaxWait.Milliseconds(), now}
+	} else {
+		// A task run at once keeps the ID it would have had if deferred
+		th := task.throttle
+		fields := task.fields("taskId")
+		fields = append(fields, "taskId", task.id)
+		fieldsJSON, _ := json.Marshal(fields)
+		script = throttleLua
+		keys = []string{
+			fmt.Sprintf("%s:throttle:%s", c.config.Prefix, th.Key),
+			task.streamKey,
+			c.scheduledKey(),
+			c.scheduledIndexKey(),
+		}
+		args = []interface{}{now, th.Window.Milliseconds(), string(th.Mode), string(fieldsJSON), task.member, task.id}
+	}
+	if l := task.lineage; l != nil {
+		keys = append(keys, c.lineageKey(l.rootID))
+		args = append(args, l.parentID, l.parent, task.lineageEntry(), lineageTTL.Milliseconds())
+	}
+	return r.Eval(ctx, script, keys, args...)
+}
@@ -0,0 +1,159 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// scheduledPayloads returns the payloads of the scheduled tasks, by score.
+func scheduledPayloads(t *testing.T, client *Client) []string {
+	t.Helper()
+	members, err := client.redis.ZRange(context.Background(), client.scheduledKey(), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("ZRange failed: %v", err)
+	}
+	var payloads []string
+	for _, m := range members {
+		var task struct{ Payload string }
+		json.Unmarshal([]byte(m), &task)
+		payloads = append(payloads, task.Payload)
+	}
+	return payloads
+}
+
+func TestDebounceKeepsLatestPayload(t *testing.T) {
+	client := newIsolatedClient(t, "test-debounce")
+	ctx := context.Background()
+	opt := EnqueueOptions{Debounce: &DebounceConfig{Key: "user-1", Wait: time.Minute}}
+
+	first, _ := client.Enqueue(ctx, "user.reindex", 1, opt)
+	due := client.redis.ZRangeWithScores(ctx, client.scheduledKey(), 0, 0).Val()[0].Score
+
+	time.Sleep(5 * time.Millisecond)
+	second, err := client.Enqueue(ctx, "user.reindex", 2, opt)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	if first == "" || second != first {
+		t.Errorf("expected the burst to keep its task ID, got %q / %q", first, second)
+	}
+	if payloads := scheduledPayloads(t, client); len(payloads) != 1 || payloads[0] != "2" {
+		t.Errorf("expected only the latest payload scheduled, got %v", payloads)
+	}
+	if next := client.redis.ZRangeWithScores(ctx, client.scheduledKey(), 0, 0).Val()[0].Score; next <= due {
+		t.Errorf("expected execution pushed back, was %v now %v", due, next)
+	}
+
+	// A new burst starts once the previous task left the scheduled set
+	client.Reschedule(ctx, first, time.Now().Add(-time.Second))
+	moveDue(t, client)
+	if third, _ := client.Enqueue(ctx, "user.reindex", 3, opt); third == first {
+		t.Error("expected a new task for a new burst")
+	}
+}
+
+func TestDebounceMaxWait(t *testing.T) {
+	client := newIsolatedClient(t, "test-debounce-max")
+	ctx := context.Background()
+	opt := EnqueueOptions{Debounce: &DebounceConfig{Key: "k", Wait: time.Hour, MaxWait: time.Minute}}
+
+	start := time.Now()
+	client.Enqueue(ctx, "user.reindex", nil, opt)
+	client.Enqueue(ctx, "user.reindex", nil, opt)
+
+	due := int64(client.redis.ZRangeWithScores(ctx, client.scheduledKey(), 0, 0).Val()[0].Score)
+	if limit := start.Add(time.Minute + time.Second).UnixMilli(); due > limit {
+		t.Errorf("expected MaxWait to cap the delay, due %d > %d", due, limit)
+	}
+}
+
+func TestThrottleDrop(t *testing.T) {
+	client := newIsolatedClient(t, "test-throttle-drop")
+	ctx := context.Background()
+	opt := EnqueueOptions{Throttle: &ThrottleConfig{Key: "feed", Window: time.Minute}}
+
+	first, _ := client.Enqueue(ctx, "feed.refresh", nil, opt)
+	second, err := client.Enqueue(ctx, "feed.refresh", nil, opt)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	if first == "" || second != "" {
+		t.Errorf("expected the second task to be dropped, got %q / %q", first, second)
+	}
+	if n := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); n != 1 {
+		t.Errorf("expected 1 task in the stream, got %d", n)
+	}
+}
+
+func TestThrottleMerge(t *testing.T) {
+	client := newIsolatedClient(t, "test-throttle-merge")
+	ctx := context.Background()
+	opt := EnqueueOptions{Throttle: &ThrottleConfig{Key: "feed", Window: time.Minute, Mode: ThrottleMerge}}
+
+	client.Enqueue(ctx, "feed.refresh", 1, opt)
+	deferred, _ := client.Enqueue(ctx, "feed.refresh", 2, opt)
+	merged, _ := client.Enqueue(ctx, "feed.refresh", 3, opt)
+
+	if deferred == "" || merged != deferred {
+		t.Errorf("expected later tasks merged into one deferred run, got %q / %q", deferred, merged)
+	}
+	if n := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); n != 1 {
+		t.Errorf("expected 1 task run immediately, got %d", n)
+	}
+	if payloads := scheduledPayloads(t, client); len(payloads) != 1 || payloads[0] != "3" {
+		t.Errorf("expected one deferred run with the latest payload, got %v", payloads)
+	}
+}
+
+func TestRateLimitValidation(t *testing.T) {
+	client := newIsolatedClient(t, "test-rate-validate")
+	ctx := context.Background()
+
+	invalid := []EnqueueOptions{
+		{Debounce: &DebounceConfig{Key: "k"}},
+		{Throttle: &ThrottleConfig{Window: time.Second}},
+		{Throttle: &ThrottleConfig{Key: "k", Window: time.Second}, Delay: time.Second},
+		{Debounce: &DebounceConfig{Key: "k", Wait: time.Second}, Dedupe: &DedupeConfig{Key: "k"}},
+	}
+	for i, opt := range invalid {
+		if _, err := client.Enqueue(ctx, "x", nil, opt); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
+
+func TestRateLimitedChildrenInLineage(t *testing.T) {
+	client := newIsolatedClient(t, "test-rate-lineage")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	var throttled, debounced string
+	client.On("feed.update", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		throttled, _ = client.Enqueue(ctx, "feed.refresh", nil, EnqueueOptions{Throttle: &ThrottleConfig{Key: "feed", Window: time.Minute}})
+		debounced, _ = client.Enqueue(ctx, "user.reindex", nil, EnqueueOptions{Debounce: &DebounceConfig{Key: "k", Wait: time.Hour}})
+		return nil, nil
+	})
+	rootID, _ := client.Enqueue(ctx, "feed.update", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	// The throttled task ran at once, with the ID Enqueue returned
+	if got := lastMessage(t, client.redis, stream).Values["taskId"]; throttled == "" || got != throttled {
+		t.Errorf("expected the throttled task to run with ID %q, got %v", throttled, got)
+	}
+	tree, err := client.GetLineage(ctx, rootID)
+	if err != nil {
+		t.Fatalf("GetLineage failed: %v", err)
+	}
+	ids := map[string]bool{}
+	for _, child := range tree.Children {
+		ids[child.TaskID] = true
+	}
+	if len(ids) != 2 || !ids[throttled] || !ids[debounced] {
+		t.Errorf("expected both tasks in the lineage, got %v", ids)
+	}
+}
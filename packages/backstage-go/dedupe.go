@@ -0,0 +1,70 @@
+// Package backstage deduplication modes.
+// Controls how long a task's dedupe lock is held and how it is keyed.
+package backstage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DedupeMode controls when a task's dedupe lock is released.
+type DedupeMode string
+
+const (
+	// DedupeWindow holds the lock for its TTL, whatever happens to the task.
+	// This is the default.
+	DedupeWindow DedupeMode = "window"
+	// DedupeUntilStarted releases the lock when a worker starts the task, so
+	// an identical task can be queued while the first one runs.
+	DedupeUntilStarted DedupeMode = "started"
+	// DedupeUntilCompleted releases the lock once the task is acknowledged
+	// or dead-lettered.
+	DedupeUntilCompleted DedupeMode = "completed"
+)
+
+// Lua script that releases a dedupe lock if it is still held by the task.
+// KEYS[1]: dedupe key
+// ARGV[1]: token the task acquired the lock with
+const releaseDedupeLua = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// dedupeKeyFor returns the dedupe key of a task: cfg.Key if set, otherwise
+// a hash of the task name and encoded payload.
+func (c *Client) dedupeKeyFor(cfg *DedupeConfig, taskName string, payload []byte) string {
+	key := cfg.Key
+	if key == "" {
+		sum := sha256.Sum256(append([]byte(taskName+"\x00"), payload...))
+		key = taskName + ":" + hex.EncodeToString(sum[:])
+	}
+	return fmt.Sprintf("%s:dedupe:%s", c.config.Prefix, key)
+}
+
+// validDedupeMode reports whether mode is a known DedupeMode ("" included).
+func validDedupeMode(mode DedupeMode) bool {
+	switch mode {
+	case "", DedupeWindow, DedupeUntilStarted, DedupeUntilCompleted:
+		return true
+	}
+	return false
+}
+
+// releaseDedupe releases the dedupe lock of msg if it was enqueued with mode.
+func (c *Client) releaseDedupe(ctx context.Context, msg redis.XMessage, mode DedupeMode) {
+	if m, _ := msg.Values["dedupeMode"].(string); DedupeMode(m) != mode {
+		return
+	}
+	key, _ := msg.Values["dedupeKey"].(string)
+	token, _ := msg.Values["dedupeToken"].(string)
+	if key == "" || token == "" {
+		return
+	}
+	c.redis.Eval(ctx, releaseDedupeLua, []string{key}, token)
+}
@@ -0,0 +1,111 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDedupeUntilCompleted(t *testing.T) {
+	client := newIsolatedClient(t, "test-dedupe-completed")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("cache.rebuild", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, nil
+	})
+
+	opt := EnqueueOptions{Dedupe: &DedupeConfig{Key: "rebuild", Mode: DedupeUntilCompleted}}
+	if id, _ := client.Enqueue(ctx, "cache.rebuild", nil, opt); id == "" {
+		t.Fatal("expected first enqueue to succeed")
+	}
+	if id, _ := client.Enqueue(ctx, "cache.rebuild", nil, opt); id != "" {
+		t.Fatal("expected duplicate to be skipped while pending")
+	}
+
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if id, _ := client.Enqueue(ctx, "cache.rebuild", nil, opt); id == "" {
+		t.Error("expected enqueue to succeed once the task completed")
+	}
+}
+
+func TestDedupeUntilStarted(t *testing.T) {
+	client := newIsolatedClient(t, "test-dedupe-started")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	opt := EnqueueOptions{Dedupe: &DedupeConfig{Key: "sync", Mode: DedupeUntilStarted}}
+	var requeued string
+	client.On("user.sync", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		requeued, _ = client.Enqueue(ctx, "user.sync", nil, opt)
+		return nil, nil
+	})
+
+	client.Enqueue(ctx, "user.sync", nil, opt)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if requeued == "" {
+		t.Error("expected the lock to be released when the task started")
+	}
+}
+
+func TestDedupePayloadHash(t *testing.T) {
+	client := newIsolatedClient(t, "test-dedupe-hash")
+	ctx := context.Background()
+	opt := EnqueueOptions{Dedupe: &DedupeConfig{}}
+
+	first, _ := client.Enqueue(ctx, "email.send", map[string]string{"to": "a@example.com"}, opt)
+	same, _ := client.Enqueue(ctx, "email.send", map[string]string{"to": "a@example.com"}, opt)
+	other, _ := client.Enqueue(ctx, "email.send", map[string]string{"to": "b@example.com"}, opt)
+	otherTask, _ := client.Enqueue(ctx, "email.audit", map[string]string{"to": "a@example.com"}, opt)
+
+	if first == "" || same != "" {
+		t.Errorf("expected identical payload to be deduplicated, got %q / %q", first, same)
+	}
+	if other == "" || otherTask == "" {
+		t.Error("expected different payloads or task names not to collide")
+	}
+}
+
+func TestDedupeReplaceScheduled(t *testing.T) {
+	client := newIsolatedClient(t, "test-dedupe-replace")
+	ctx := context.Background()
+	client.initConsumerGroups(ctx)
+
+	opt := EnqueueOptions{
+		Delay:  time.Hour,
+		Dedupe: &DedupeConfig{Key: "digest", Replace: true},
+	}
+	first, _ := client.Enqueue(ctx, "digest.send", "v1", opt)
+	second, _ := client.Enqueue(ctx, "digest.send", "v2", opt)
+
+	if second == "" || second == first {
+		t.Fatalf("expected replacement to get a new ID, got %q / %q", first, second)
+	}
+	if n := client.redis.ZCard(ctx, client.scheduledKey()).Val(); n != 1 {
+		t.Errorf("expected the pending task to be replaced, %d scheduled", n)
+	}
+	if err := client.Reschedule(ctx, first, time.Now()); err != ErrTaskNotFound {
+		t.Errorf("expected the replaced task to be gone, got %v", err)
+	}
+
+	// Once the holder has reached its stream it can no longer be replaced
+	client.Reschedule(ctx, second, time.Now().Add(-time.Second))
+	moveDue(t, client)
+	if id, _ := client.Enqueue(ctx, "digest.send", "v3", opt); id != "" {
+		t.Errorf("expected enqueue to be skipped, got %q", id)
+	}
+}
+
+func TestDedupeUnknownMode(t *testing.T) {
+	client := newIsolatedClient(t, "test-dedupe-mode")
+	_, err := client.Enqueue(context.Background(), "x", nil, EnqueueOptions{
+		Dedupe: &DedupeConfig{Key: "x", Mode: "forever"},
+	})
+	if err == nil {
+		t.Error("expected an error for an unknown dedupe mode")
+	}
+}
@@ -0,0 +1,299 @@
+// Package backstage task dependencies.
+// Parks tasks enqueued with EnqueueOptions.DependsOn until the tasks they
+// depend on have succeeded, using the outcome consumers record for the tasks
+// they finish when Config.TaskDependencies is set.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// dependencyTTL is how long task outcomes and parked tasks are kept. A task
+// still parked after that is dropped without a trace.
+const dependencyTTL = 7 * 24 * time.Hour
+
+// DependencyFailurePolicy controls what happens to a task when one of its
+// dependencies fails: is dead-lettered, expires or is dropped with its
+// workflow.
+type DependencyFailurePolicy string
+
+const (
+	// DependencyDeadLetter moves the task to the dead-letter stream of its
+	// queue, with the failed dependency in its failedDependency field. This is
+	// the default.
+	DependencyDeadLetter DependencyFailurePolicy = "dead-letter"
+	// DependencyCancel drops the task.
+	DependencyCancel DependencyFailurePolicy = "cancel"
+)
+
+// Lua function shared by parkLua and settleLua that dead-letters or drops a
+// parked task whose dependency failed. task holds its stream, fields,
+// policy and dead-letter stream; now is the time in ms.
+//
+// A parked task is a hash <prefix>:parked:<id> (stream, deadLetter, fields,
+// policy, remaining) listed in the set <prefix>:dependents:<dependency ID>
+// of each dependency that has not finished. Outcomes are stored as
+// <prefix>:outcome:<id>, "succeeded" or "failed".
+const dependencyFailLua = `
+local function fail(key, task, id, dependency, now)
+    if task[3] == 'dead-letter' then
+        local fields = cjson.decode(task[2])
+        fields[#fields + 1] = 'originalId'
+        fields[#fields + 1] = id
+        fields[#fields + 1] = 'failedDependency'
+        fields[#fields + 1] = dependency
+        fields[#fields + 1] = 'deadLetteredAt'
+        fields[#fields + 1] = now
+        redis.call('XADD', task[4], '*', unpack(fields))
+    end
+    redis.call('DEL', key)
+end
+`
+
+// Lua script that parks a task until its dependencies have succeeded.
+// KEYS[1]: parked hash, KEYS[2]: the task's outcome, KEYS[3]: stream,
+// KEYS[4]: dead-letter stream, then for each dependency its outcome and
+// dependents set
+// ARGV[1]: now in ms, ARGV[2]: TTL in ms, ARGV[3]: task ID, ARGV[4]: JSON
+// field list without enqueuedAt, ARGV[5]: failure policy, ARGV[6...]:
+// dependency IDs
+//
+// Dependencies that already succeeded are satisfied; one that already
+// failed fails the task at once. Nothing can depend on the task yet, so a
+// failure only records its outcome. Returns "released", "failed" or
+// "parked".
+const parkLua = dependencyFailLua + `
+local id = ARGV[3]
+local ttl = tonumber(ARGV[2])
+local remaining = 0
+local failed
+for i = 6, #ARGV do
+    local k = 2 * (i - 6) + 5
+    local outcome = redis.call('GET', KEYS[k])
+    if outcome and outcome ~= 'succeeded' then
+        failed = ARGV[i]
+        break
+    elseif not outcome then
+        redis.call('SADD', KEYS[k + 1], id)
+        redis.call('PEXPIRE', KEYS[k + 1], ttl)
+        remaining = remaining + 1
+    end
+end
+
+local task = {KEYS[3], ARGV[4], ARGV[5], KEYS[4]}
+if failed then
+    for k = 6, #KEYS, 2 do
+        redis.call('SREM', KEYS[k], id)
+    end
+    fail(KEYS[1], task, id, failed, ARGV[1])
+    redis.call('SET', KEYS[2], 'failed', 'PX', ttl)
+    return 'failed'
+end
+if remaining == 0 then
+    local fields = cjson.decode(ARGV[4])
+    fields[#fields + 1] = 'enqueuedAt'
+    fields[#fields + 1] = ARGV[1]
+    redis.call('XADD', KEYS[3], '*', unpack(fields))
+    return 'released'
+end
+redis.call('HSET', KEYS[1], 'stream', KEYS[3], 'deadLetter', KEYS[4], 'fields', ARGV[4],
+    'policy', ARGV[5], 'remaining', remaining)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 'parked'
+`
+
+// Lua script that records the outcome of a finished task and settles the
+// tasks parked on it.
+// KEYS[1]: the task's outcome, KEYS[2]: its dependents set, then for each
+// dependent listed in ARGV its parked hash, stream and dead-letter stream
+// (the parked hash again for both if it had none)
+// ARGV[1]: now in ms, ARGV[2]: TTL in ms, ARGV[3]: task ID, ARGV[4]:
+// "succeeded" or "failed", ARGV[5...]: dependent task IDs
+//
+// Returns {"retry", id...} without writing anything if the dependents set
+// holds tasks that are not in KEYS, or whose streams are not, so the caller
+// can declare them. Otherwise returns {"settled", id...} with the dependents
+// that failed, whose own dependents fail in turn.
+const settleLua = dependencyFailLua + `
+local declared = {}
+for i = 5, #ARGV do
+    local k = 3 * (i - 5) + 3
+    declared[ARGV[i]] = {KEYS[k], KEYS[k + 1], KEYS[k + 2]}
+end
+local dependents = redis.call('SMEMBERS', KEYS[2])
+local tasks = {}
+for _, parked in ipairs(dependents) do
+    local d = declared[parked]
+    local task
+    if d then
+        task = redis.call('HMGET', d[1], 'stream', 'fields', 'policy', 'deadLetter')
+    end
+    if not d or (task[1] and (task[1] ~= d[2] or task[4] ~= d[3])) then
+        local result = {'retry'}
+        for _, id in ipairs(dependents) do
+            result[#result + 1] = id
+        end
+        return result
+    end
+    tasks[parked] = task
+end
+
+redis.call('SET', KEYS[1], ARGV[4], 'PX', ARGV[2])
+local failed = {'settled'}
+for _, parked in ipairs(dependents) do
+    local key = declared[parked][1]
+    local task = tasks[parked]
+    if task[1] then
+        if ARGV[4] ~= 'succeeded' then
+            fail(key, task, parked, ARGV[3], ARGV[1])
+            failed[#failed + 1] = parked
+        elseif redis.call('HINCRBY', key, 'remaining', -1) <= 0 then
+            local fields = cjson.decode(task[2])
+            fields[#fields + 1] = 'enqueuedAt'
+            fields[#fields + 1] = ARGV[1]
+            redis.call('XADD', task[1], '*', unpack(fields))
+            redis.call('DEL', key)
+        end
+    end
+end
+redis.call('DEL', KEYS[2])
+return failed
+`
+
+// parkedKey returns the hash holding a task parked on its dependencies.
+func (c *Client) parkedKey(id string) string {
+	return fmt.Sprintf("%s:parked:%s", c.config.Prefix, id)
+}
+
+// outcomeKey returns the key recording whether a task succeeded.
+func (c *Client) outcomeKey(id string) string {
+	return fmt.Sprintf("%s:outcome:%s", c.config.Prefix, id)
+}
+
+// dependentsKey returns the set of tasks parked on a task.
+func (c *Client) dependentsKey(id string) string {
+	return fmt.Sprintf("%s:dependents:%s", c.config.Prefix, id)
+}
+
+// validateDependencies checks the dependency options of opt.
+func (c *Client) validateDependencies(opt EnqueueOptions) error {
+	if len(opt.DependsOn) == 0 {
+		return nil
+	}
+	if !c.config.TaskDependencies {
+		return errors.New("DependsOn requires Config.TaskDependencies")
+	}
+	if err := checkOptions("tasks with dependencies", opt, ruleWrittenByScript&^ruleDependencies); err != nil {
+		return err
+	}
+	if p := opt.OnDependencyFailure; p != "" && p != DependencyDeadLetter && p != DependencyCancel {
+		return fmt.Errorf("unknown dependency failure policy %q", p)
+	}
+	for _, id := range opt.DependsOn {
+		if id == "" {
+			return errors.New("empty dependency task ID")
+		}
+	}
+	return nil
+}
+
+// park queues the script parking task until its dependencies have
+// succeeded on pipe, together with its lineage. The command's result is
+// "released", "failed" or "parked".
+func (c *Client) park(ctx context.Context, pipe redis.Pipeliner, task *preparedTask) *redis.Cmd {
+	if task.lineage != nil {
+		c.recordLineage(ctx, pipe, task)
+	}
+	fieldsJSON, _ := json.Marshal(task.fields("enqueuedAt"))
+	keys := []string{c.parkedKey(task.id), c.outcomeKey(task.id), task.streamKey, task.streamKey + ":dead-letter"}
+	args := []interface{}{
+		time.Now().UnixMilli(), dependencyTTL.Milliseconds(),
+		task.id, string(fieldsJSON), string(task.depPolicy),
+	}
+	seen := make(map[string]bool, len(task.dependsOn))
+	for _, id := range task.dependsOn {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, c.outcomeKey(id), c.dependentsKey(id))
+			args = append(args, id)
+		}
+	}
+	return pipe.Eval(ctx, parkLua, keys, args...)
+}
+
+// recordOutcome records whether the task of msg succeeded, releasing or
+// failing the tasks that depend on it, when Config.TaskDependencies is set.
+// A failure cascades to the dependents of the failed tasks, one script call
+// per task. Failures are logged, not returned.
+func (c *Client) recordOutcome(ctx context.Context, msg redis.XMessage, succeeded bool) {
+	if !c.config.TaskDependencies {
+		return
+	}
+	outcome := "failed"
+	if succeeded {
+		outcome = "succeeded"
+	}
+	queue := []string{messageTaskID(msg)}
+	for len(queue) > 0 {
+		id := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		settled, err := c.settle(ctx, id, outcome)
+		if err != nil {
+			c.logger.Warn("Failed to record task outcome", "task", id, "error", err)
+			return
+		}
+		// Only failures cascade
+		queue = append(queue, settled...)
+		outcome = "failed"
+	}
+}
+
+// settle runs settleLua for a task, declaring the parked hash and streams of
+// each of its dependents, and returns the dependents that failed with it.
+func (c *Client) settle(ctx context.Context, id, outcome string) ([]string, error) {
+	var declared []string
+	var dependents []string
+	for {
+		keys := append([]string{c.outcomeKey(id), c.dependentsKey(id)}, declared...)
+		args := []interface{}{time.Now().UnixMilli(), dependencyTTL.Milliseconds(), id, outcome}
+		for _, d := range dependents {
+			args = append(args, d)
+		}
+		res, err := c.redis.Eval(ctx, settleLua, keys, args...).StringSlice()
+		if err != nil {
+			return nil, err
+		}
+		if res[0] == "settled" {
+			return res[1:], nil
+		}
+
+		// Read where each dependent goes, then try again
+		dependents = res[1:]
+		pipe := c.redis.Pipeline()
+		cmds := make([]*redis.SliceCmd, len(dependents))
+		for i, d := range dependents {
+			cmds[i] = pipe.HMGet(ctx, c.parkedKey(d), "stream", "deadLetter")
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+		declared = declared[:0]
+		for i, d := range dependents {
+			key := c.parkedKey(d)
+			declared = append(declared, key)
+			for _, v := range cmds[i].Val() {
+				stream, _ := v.(string)
+				if stream == "" {
+					stream = key
+				}
+				declared = append(declared, stream)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newDependencyClient(t *testing.T, prefix string) (*Client, map[string]string) {
+	client := newIsolatedClient(t, prefix)
+	client.config.TaskDependencies = true
+	client.initConsumerGroups(context.Background())
+
+	ran := make(map[string]string) // Task name -> task ID
+	for _, name := range []string{"extract", "transform", "load", "report"} {
+		name := name
+		client.On(name, func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+			info, _ := TaskInfoFromContext(ctx)
+			ran[name] = info.TaskID
+			return nil, nil
+		})
+	}
+	return client, ran
+}
+
+func TestDependsOnReleasedWhenAllSucceed(t *testing.T) {
+	client, ran := newDependencyClient(t, "test-depends")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	extract, _ := client.Enqueue(ctx, "extract", nil)
+	transform, _ := client.Enqueue(ctx, "transform", nil)
+
+	// Another producer, knowing only the task IDs
+	producer := newIsolatedClient(t, "test-depends")
+	producer.config.TaskDependencies = true
+	id, err := producer.Enqueue(ctx, "load", nil, EnqueueOptions{DependsOn: []string{extract, transform}})
+	if err != nil || id == "" {
+		t.Fatalf("Enqueue failed: %q, %v", id, err)
+	}
+
+	runMembers(t, client, 1)
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 2 {
+		t.Fatalf("expected load parked until transform succeeds, stream has %d entries", n)
+	}
+	runMembers(t, client, 2)
+	if ran["load"] != id {
+		t.Errorf("expected load released with its task ID %s, got %q", id, ran["load"])
+	}
+
+	// Dependencies that already succeeded are satisfied at once
+	client.Enqueue(ctx, "report", nil, EnqueueOptions{DependsOn: []string{id, extract}})
+	runMembers(t, client, 1)
+	if ran["report"] == "" {
+		t.Error("expected report released at once")
+	}
+}
+
+func TestDependsOnFailure(t *testing.T) {
+	client, ran := newDependencyClient(t, "test-depends-fail")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	extract, _ := client.Enqueue(ctx, "extract", nil)
+	load, _ := client.Enqueue(ctx, "load", nil, EnqueueOptions{DependsOn: []string{extract}})
+	client.Enqueue(ctx, "report", nil, EnqueueOptions{
+		DependsOn:           []string{load},
+		OnDependencyFailure: DependencyCancel,
+	})
+
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+
+	dead := lastMessage(t, client.redis, client.deadLetterKey(PriorityDefault))
+	if dead.Values["taskName"] != "load" || dead.Values["failedDependency"] != extract || dead.Values["originalId"] != load {
+		t.Errorf("expected load dead-lettered with its failed dependency, got %v", dead.Values)
+	}
+	if n, _ := client.redis.XLen(ctx, client.deadLetterKey(PriorityDefault)).Result(); n != 2 {
+		t.Errorf("expected report cancelled, not dead-lettered, dead-letter stream has %d entries", n)
+	}
+
+	// A dependency that already failed fails the task at once
+	client.Enqueue(ctx, "transform", nil, EnqueueOptions{
+		DependsOn:           []string{extract},
+		OnDependencyFailure: DependencyCancel,
+	})
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 1 || len(ran) != 0 {
+		t.Errorf("expected no dependent enqueued, stream has %d entries", n)
+	}
+	if keys, _ := client.redis.Keys(ctx, "test-depends-fail:parked:*").Result(); len(keys) != 0 {
+		t.Errorf("expected no parked task left, got %v", keys)
+	}
+}
+
+func TestDependsOnValidation(t *testing.T) {
+	client := newIsolatedClient(t, "test-depends-invalid")
+	ctx := context.Background()
+
+	if _, err := client.Enqueue(ctx, "load", nil, EnqueueOptions{DependsOn: []string{"a"}}); err == nil {
+		t.Error("expected DependsOn refused without TaskDependencies")
+	}
+	client.config.TaskDependencies = true
+
+	if _, err := client.Enqueue(ctx, "load", nil, EnqueueOptions{DependsOn: []string{"a"}, Delay: time.Minute}); err == nil {
+		t.Error("expected delayed tasks with dependencies rejected")
+	}
+	if _, err := client.Enqueue(ctx, "load", nil, EnqueueOptions{DependsOn: []string{"a"}, OnDependencyFailure: "retry"}); err == nil {
+		t.Error("expected an unknown failure policy rejected")
+	}
+	deps := EnqueueOptions{DependsOn: []string{"a"}}
+	if _, err := client.StartWorkflow(ctx, Workflow{Nodes: []WorkflowNode{{Name: "load", Options: deps}}}); err == nil {
+		t.Error("expected workflow nodes with dependencies rejected")
+	}
+	if _, err := client.StartSaga(ctx, "load", nil, deps); err == nil {
+		t.Error("expected saga steps with dependencies rejected")
+	}
+	if _, err := client.prepareCompensation("saga", "step", nil, &Compensation{TaskName: "undo", Options: deps}); err == nil {
+		t.Error("expected compensations with dependencies rejected")
+	}
+}
+
+func TestCheckOptions(t *testing.T) {
+	err := checkOptions("saga steps", EnqueueOptions{Dedupe: &DedupeConfig{Key: "k"}}, ruleWrittenByScript&^ruleDelay)
+	if err == nil || err.Error() != "saga steps cannot be deduplicated, debounced, throttled or have dependencies" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = checkOptions("tasks with dependencies", EnqueueOptions{Delay: time.Second}, ruleWrittenByScript&^ruleDependencies)
+	if err == nil || err.Error() != "tasks with dependencies cannot be delayed, deduplicated, debounced or throttled" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := checkOptions("group members", EnqueueOptions{Delay: time.Second}, ruleWrittenByScript&^ruleDelay); err != nil {
+		t.Errorf("expected allowed options to pass, got %v", err)
+	}
+}
+
+func TestOutcomesRecordedOnlyWithTaskDependencies(t *testing.T) {
+	client := newIsolatedClient(t, "test-depends-off")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("extract", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, nil
+	})
+
+	id, _ := client.Enqueue(ctx, "extract", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+	if n, _ := client.redis.Exists(ctx, client.outcomeKey(id)).Result(); n != 0 {
+		t.Error("expected no outcome recorded without TaskDependencies")
+	}
+
+	client.config.TaskDependencies = true
+	id, _ = client.Enqueue(ctx, "extract", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+	if got, _ := client.redis.Get(ctx, client.outcomeKey(id)).Result(); got != "succeeded" {
+		t.Errorf("expected the outcome recorded, got %q", got)
+	}
+}
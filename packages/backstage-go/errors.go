@@ -5,13 +5,19 @@ package backstage
 import "errors"
 
 var (
-	ErrTaskNotFound     = errors.New("task not found")
-	ErrQueueNotFound    = errors.New("queue not found")
-	ErrSoftTimeout      = errors.New("soft timeout")
-	ErrHardTimeout      = errors.New("hard timeout")
-	ErrPreventExecution = errors.New("task execution prevented")
-	ErrInvalidCron      = errors.New("invalid cron schedule")
-	ErrRedisConnection  = errors.New("redis connection error")
+	ErrTaskNotFound      = errors.New("task not found")
+	ErrQueueNotFound     = errors.New("queue not found")
+	ErrSoftTimeout       = errors.New("soft timeout")
+	ErrHardTimeout       = errors.New("hard timeout")
+	ErrPreventExecution  = errors.New("task execution prevented")
+	ErrInvalidCron       = errors.New("invalid cron schedule")
+	ErrRedisConnection   = errors.New("redis connection error")
+	ErrNoTask            = errors.New("not running inside a task handler")
+	ErrQueueFull         = errors.New("queue full")
+	ErrGroupNotFound     = errors.New("group not found")
+	ErrWorkflowNotFound  = errors.New("workflow not found")
+	ErrSagaNotFound      = errors.New("saga not found")
+	ErrWorkflowCancelled = errors.New("workflow cancelled")
 )
 
 type BackstageError struct {
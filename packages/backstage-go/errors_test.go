@@ -16,6 +16,12 @@ func TestErrors(t *testing.T) {
 		{ErrPreventExecution, "task execution prevented"},
 		{ErrInvalidCron, "invalid cron schedule"},
 		{ErrRedisConnection, "redis connection error"},
+		{ErrNoTask, "not running inside a task handler"},
+		{ErrQueueFull, "queue full"},
+		{ErrGroupNotFound, "group not found"},
+		{ErrWorkflowNotFound, "workflow not found"},
+		{ErrSagaNotFound, "saga not found"},
+		{ErrWorkflowCancelled, "workflow cancelled"},
 	}
 
 	for _, tc := range tests {
@@ -0,0 +1,103 @@
+// Package backstage task expiry.
+// Tasks enqueued with a deadline are discarded instead of run once it has
+// passed, wherever they are found: in a stream, in the PEL or scheduled.
+package backstage
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ExpiredTaskPolicy controls what happens to a task found past its expiry.
+type ExpiredTaskPolicy string
+
+const (
+	// ExpiredKeep moves the task to its queue's expired stream
+	// (<prefix>:<queue>:expired) for inspection. This is the default.
+	ExpiredKeep ExpiredTaskPolicy = "keep"
+	// ExpiredDrop discards the task; only the expired count records it.
+	ExpiredDrop ExpiredTaskPolicy = "drop"
+)
+
+// Lua script that discards an expired task and acknowledges it atomically.
+// KEYS[1]: source stream, KEYS[2]: expired stream, KEYS[3]: expired counter
+// ARGV[1]: consumer group, ARGV[2]: message ID, ARGV[3]: "1" to XDEL after ACK,
+// ARGV[4]: "1" to keep the task, ARGV[5...]: field/value pairs for the expired
+// entry
+const expireLua = `
+if ARGV[4] == '1' then
+    local fields = {}
+    for i = 5, #ARGV do
+        fields[#fields + 1] = ARGV[i]
+    end
+    redis.call('XADD', KEYS[2], '*', unpack(fields))
+end
+redis.call('INCR', KEYS[3])
+redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+if ARGV[3] == '1' then
+    redis.call('XDEL', KEYS[1], ARGV[2])
+end
+return 1
+`
+
+// expiredKey returns the expired stream key for a work stream.
+func expiredKey(streamKey string) string {
+	return streamKey + ":expired"
+}
+
+// expiredCountKey returns the key counting the expired tasks of a work stream.
+func expiredCountKey(streamKey string) string {
+	return streamKey + ":expired:count"
+}
+
+// messageExpiresAt returns the expiry of msg in ms, or 0 if it has none.
+func messageExpiresAt(msg redis.XMessage) int64 {
+	expiresAt, _ := asInt64(msg.Values["expiresAt"])
+	return expiresAt
+}
+
+// isExpired reports whether msg is past its expiry.
+func isExpired(msg redis.XMessage) bool {
+	expiresAt := messageExpiresAt(msg)
+	return expiresAt > 0 && time.Now().UnixMilli() >= expiresAt
+}
+
+// expireTask applies the configured ExpiredTaskPolicy to an expired message.
+func (c *Client) expireTask(ctx context.Context, streamKey string, msg redis.XMessage) {
+	taskName, _ := msg.Values["taskName"].(string)
+
+	args := []interface{}{c.config.ConsumerGroup, msg.ID, "0", "1"}
+	if c.config.DeleteOnAck {
+		args[2] = "1"
+	}
+	if c.config.ExpiredTasks == ExpiredDrop {
+		args[3] = "0"
+	}
+	for k, v := range msg.Values {
+		args = append(args, k, v)
+	}
+	args = append(args,
+		"originalId", msg.ID,
+		"originalStream", streamKey,
+		"expiredAt", time.Now().UnixMilli(),
+	)
+
+	keys := []string{streamKey, expiredKey(streamKey), expiredCountKey(streamKey)}
+	if err := c.redis.Eval(ctx, expireLua, keys, args...).Err(); err != nil {
+		// Leave it pending; the reclaimer will find it expired again.
+		log.Printf("[Backstage] Failed to discard expired task %s: %v", taskName, err)
+		return
+	}
+	log.Printf("[Backstage] Expired task discarded: %s (%s)", taskName, msg.ID)
+
+	if err := c.reportOutcome(ctx, msg, nil, nil, nil, true); err != nil {
+		log.Printf("[Backstage] Failed to report task outcome: %s - %v", taskName, err)
+	}
+	c.trackTask(ctx, msg, TaskExpired, 0, nil)
+	c.recordOutcome(ctx, msg, false)
+
+	c.releaseDedupe(ctx, msg, DedupeUntilCompleted)
+}
@@ -0,0 +1,191 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestExpiredTaskIsDiscarded(t *testing.T) {
+	client := newIsolatedClient(t, "test-expiry")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	ran := false
+	client.On("otp.send", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		ran = true
+		return nil, nil
+	})
+
+	client.Enqueue(ctx, "otp.send", nil, EnqueueOptions{ExpiresAt: time.Now().Add(-time.Second)})
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if ran {
+		t.Error("expected the expired task not to run")
+	}
+	expired, _ := client.redis.XRange(ctx, expiredKey(stream), "-", "+").Result()
+	if len(expired) != 1 || expired[0].Values["taskName"] != "otp.send" {
+		t.Fatalf("expected the task in the expired stream, got %v", expired)
+	}
+
+	info, _ := Inspect(ctx, client.redis, []*Queue{NewQueue("default", WithPrefix(client.config.Prefix))})
+	if info.Queues[0].Expired != 1 || info.TotalExpired != 1 {
+		t.Errorf("expected 1 expired task in Inspect, got %+v", info.Queues[0])
+	}
+	if pending := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Val(); pending.Count != 0 {
+		t.Errorf("expected the task to be acknowledged, %d pending", pending.Count)
+	}
+}
+
+func TestExpiredTaskDropped(t *testing.T) {
+	client := newIsolatedClient(t, "test-expiry-drop")
+	client.config.ExpiredTasks = ExpiredDrop
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("otp.send", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, nil
+	})
+
+	client.Enqueue(ctx, "otp.send", nil, EnqueueOptions{TTL: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if n := client.redis.XLen(ctx, expiredKey(stream)).Val(); n != 0 {
+		t.Errorf("expected nothing kept, got %d", n)
+	}
+	if n, _ := client.redis.Get(ctx, expiredCountKey(stream)).Int(); n != 1 {
+		t.Errorf("expected the drop to be counted, got %d", n)
+	}
+}
+
+func TestExpiredTaskNotReclaimed(t *testing.T) {
+	client := newIsolatedClient(t, "test-expiry-reclaim")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("otp.send", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		t.Error("expected the expired task not to be retried")
+		return nil, nil
+	})
+
+	client.Enqueue(ctx, "otp.send", nil, EnqueueOptions{TTL: 20 * time.Millisecond})
+	readOne(t, client, stream) // Delivered, then the worker died
+	time.Sleep(30 * time.Millisecond)
+
+	client.reclaimIdleMessages(ctx, ConsumerConfig{IdleTimeout: time.Millisecond, MaxDeliveries: 5})
+
+	if n := client.redis.XLen(ctx, expiredKey(stream)).Val(); n != 1 {
+		t.Errorf("expected the reclaimed task to be expired, got %d", n)
+	}
+}
+
+func TestExpiredScheduledTask(t *testing.T) {
+	client := newIsolatedClient(t, "test-expiry-scheduled")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, _ := client.Enqueue(ctx, "otp.send", nil, EnqueueOptions{
+		Delay:     time.Hour,
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+	client.Reschedule(ctx, id, time.Now().Add(2*time.Minute))
+
+	// Pretend two minutes have passed
+	err := client.redis.Eval(ctx, processScheduledLua,
+		[]string{client.scheduledKey(), client.scheduledIndexKey()},
+		time.Now().Add(2*time.Minute).UnixMilli(), client.config.Prefix, string(PriorityDefault),
+	).Err()
+	if err != nil {
+		t.Fatalf("move scheduled tasks: %v", err)
+	}
+
+	if n := client.redis.XLen(ctx, stream).Val(); n != 0 {
+		t.Errorf("expected the expired task not to reach its stream, got %d", n)
+	}
+	if n := client.redis.XLen(ctx, expiredKey(stream)).Val(); n != 1 {
+		t.Errorf("expected the task in the expired stream, got %d", n)
+	}
+	if client.redis.ZCard(ctx, client.scheduledKey()).Val() != 0 {
+		t.Error("expected the task removed from the scheduled set")
+	}
+}
+
+func TestSchedulerDropsExpiredTasks(t *testing.T) {
+	client := newIsolatedClient(t, "test-expiry-scheduler")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	s := NewScheduler(SchedulerConfig{
+		Host:         "localhost",
+		Port:         testPort(),
+		Prefix:       client.config.Prefix,
+		ExpiredTasks: ExpiredDrop,
+	})
+	defer s.redis.Close()
+
+	past := time.Now().Add(-time.Second).UnixMilli()
+	client.redis.ZAdd(ctx, client.scheduledKey(), redis.Z{
+		Score:  float64(past),
+		Member: fmt.Sprintf(`{"taskName":"otp.send","payload":"{}","streamKey":%q,"expiresAt":%d}`, stream, past),
+	})
+	if n, err := s.ProcessScheduledTasks(ctx, ""); err != nil || n != 1 {
+		t.Fatalf("expected 1 task moved, got %d (%v)", n, err)
+	}
+
+	if n := client.redis.XLen(ctx, expiredKey(stream)).Val(); n != 0 {
+		t.Errorf("expected the expired task dropped, got %d kept", n)
+	}
+	if n, _ := client.redis.Get(ctx, expiredCountKey(stream)).Int(); n != 1 {
+		t.Errorf("expected the expired task counted, got %d", n)
+	}
+}
+
+func TestExpiredScheduledTaskSettlesDependents(t *testing.T) {
+	client, _ := newDependencyClient(t, "test-expiry-dependents")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	extract, _ := client.Enqueue(ctx, "extract", nil, EnqueueOptions{
+		Delay:     time.Minute,
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+	load, _ := client.Enqueue(ctx, "load", nil, EnqueueOptions{DependsOn: []string{extract}})
+
+	// Pretend two minutes have passed: the task reaches a consumer, which expires it
+	client.redis.Eval(ctx, processScheduledLua,
+		[]string{client.scheduledKey(), client.scheduledIndexKey()},
+		time.Now().Add(2*time.Minute).UnixMilli(), client.config.Prefix, string(PriorityDefault),
+	)
+	msg := readOne(t, client, stream)
+	msg.Values["expiresAt"] = fmt.Sprint(time.Now().Add(-time.Second).UnixMilli())
+	client.handleMessage(ctx, stream, msg)
+
+	dead := lastMessage(t, client.redis, client.deadLetterKey(PriorityDefault))
+	if dead.Values["originalId"] != load || dead.Values["failedDependency"] != extract {
+		t.Errorf("expected the dependent dead-lettered, got %v", dead.Values)
+	}
+}
+
+func TestExpiredScheduledTaskReleasesDedupe(t *testing.T) {
+	client := newIsolatedClient(t, "test-expiry-dedupe")
+	ctx := context.Background()
+	opt := EnqueueOptions{
+		Delay:     time.Minute,
+		ExpiresAt: time.Now().Add(time.Minute),
+		Dedupe:    &DedupeConfig{Key: "otp", Mode: DedupeUntilCompleted},
+	}
+	client.Enqueue(ctx, "otp.send", nil, opt)
+
+	client.redis.Eval(ctx, processScheduledLua,
+		[]string{client.scheduledKey(), client.scheduledIndexKey()},
+		time.Now().Add(2*time.Minute).UnixMilli(), client.config.Prefix, string(PriorityDefault),
+	)
+	if id, err := client.Enqueue(ctx, "otp.send", nil, opt); err != nil || id == "" {
+		t.Errorf("expected the dedupe lock released on expiry, got %q (%v)", id, err)
+	}
+}
@@ -0,0 +1,132 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFanoutEnqueuesAllWithAck(t *testing.T) {
+	client := newIsolatedClient(t, "test-fanout")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{
+			Next: "order.audit",
+			Fanout: []NextTask{
+				{TaskName: "order.email", Payload: "email"},
+				{TaskName: "order.invoice", Options: EnqueueOptions{Priority: PriorityUrgent}},
+				{TaskName: "order.analytics", Delay: time.Minute},
+			},
+		}, nil
+	})
+
+	client.Enqueue(ctx, "order.place", nil, EnqueueOptions{Headers: map[string]string{"tenant": "acme"}})
+	msg := readOne(t, client, stream)
+	client.handleMessage(ctx, stream, msg)
+
+	pending, _ := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Result()
+	if pending.Count != 0 {
+		t.Errorf("expected the parent to be acknowledged, %d pending", pending.Count)
+	}
+
+	audit := readOne(t, client, stream)
+	email := readOne(t, client, stream)
+	if audit.Values["taskName"] != "order.audit" || email.Values["taskName"] != "order.email" {
+		t.Errorf("expected Next then Fanout in order, got %v and %v", audit.Values["taskName"], email.Values["taskName"])
+	}
+	if messageHeaders(email)["tenant"] != "acme" {
+		t.Errorf("expected headers inherited by fan-out tasks, got %v", email.Values)
+	}
+	if invoice := lastMessage(t, client.redis, client.streamKey(PriorityUrgent)); invoice.Values["taskName"] != "order.invoice" {
+		t.Errorf("expected invoice on the urgent queue, got %v", invoice.Values)
+	}
+	if n, _ := client.redis.ZCard(ctx, client.scheduledKey()).Result(); n != 1 {
+		t.Errorf("expected the delayed task to be scheduled, got %d", n)
+	}
+}
+
+func TestFanoutSkipsDeduplicatedTask(t *testing.T) {
+	client := newIsolatedClient(t, "test-fanout-dedupe")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	dedupe := EnqueueOptions{Dedupe: &DedupeConfig{Key: "report", TTL: time.Minute}}
+	client.Enqueue(ctx, "report.build", nil, dedupe)
+	readOne(t, client, stream) // Existing report build holds the key
+
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{Fanout: []NextTask{
+			{TaskName: "report.build", Options: dedupe},
+			{TaskName: "order.email"},
+		}}, nil
+	})
+
+	client.Enqueue(ctx, "order.place", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if email := readOne(t, client, stream); email.Values["taskName"] != "order.email" {
+		t.Errorf("expected only the email task chained, got %v", email.Values)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 3 {
+		t.Errorf("expected the duplicate report to be skipped, stream has %d entries", n)
+	}
+}
+
+func TestFanoutFailureLeavesParentPending(t *testing.T) {
+	client := newIsolatedClient(t, "test-fanout-fail")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{Fanout: []NextTask{
+			{TaskName: "order.email"},
+			{TaskName: "order.sync", Options: EnqueueOptions{Debounce: &DebounceConfig{Key: "sync", Wait: time.Second}}},
+		}}, nil
+	})
+
+	client.Enqueue(ctx, "order.place", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	pending, _ := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Result()
+	if pending.Count != 1 || len(client.ackChan) != 0 {
+		t.Errorf("expected the parent to stay pending, %d pending", pending.Count)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 1 {
+		t.Errorf("expected no chained task written, stream has %d entries", n)
+	}
+}
+
+func TestFanoutDelayJSONInMilliseconds(t *testing.T) {
+	result := WorkflowInstruction{
+		Next:   "order.ship",
+		Delay:  1500,
+		Fanout: []NextTask{{TaskName: "order.analytics", Delay: 1500 * time.Millisecond}},
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var raw struct {
+		Delay  int64
+		Fanout []struct{ Delay int64 }
+	}
+	json.Unmarshal(data, &raw)
+	if raw.Delay != 1500 || raw.Fanout[0].Delay != 1500 {
+		t.Errorf("expected both delays in milliseconds, got %s", data)
+	}
+
+	var decoded WorkflowInstruction
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.Fanout[0].Delay != 1500*time.Millisecond {
+		t.Errorf("expected the fanout delay to round-trip, got %v", decoded.Fanout[0].Delay)
+	}
+}
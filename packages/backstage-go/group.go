@@ -0,0 +1,390 @@
+// Package backstage groups and chords.
+// Runs a set of tasks in parallel, tracks their completion in Redis and, for
+// a chord, enqueues a callback with their results once all have finished.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultGroupTTL is how long group state is kept when GroupOptions.TTL is
+// not set.
+const DefaultGroupTTL = 24 * time.Hour
+
+// GroupFailurePolicy controls what a member failure does to its group.
+// A member fails when it is dead-lettered or expires.
+type GroupFailurePolicy string
+
+const (
+	// GroupFailFast fails the group on the first member failure; a chord's
+	// callback never runs. This is the default.
+	GroupFailFast GroupFailurePolicy = "fail"
+	// GroupContinue records the failure and waits for the other members; a
+	// chord's callback runs with partial results.
+	GroupContinue GroupFailurePolicy = "continue"
+)
+
+// GroupStatus is the state of a group.
+type GroupStatus string
+
+const (
+	GroupPending   GroupStatus = "pending"
+	GroupCompleted GroupStatus = "completed"
+	GroupFailed    GroupStatus = "failed"
+)
+
+// GroupOptions configures EnqueueGroup and EnqueueChord.
+type GroupOptions struct {
+	// OnFailure is the member failure policy (default: GroupFailFast).
+	OnFailure GroupFailurePolicy
+	// TTL is how long the group's state is kept after it is enqueued
+	// (default: DefaultGroupTTL). Members finishing after that are not
+	// tracked anymore.
+	TTL time.Duration
+}
+
+// GroupInfo is the state of a group, as returned by GetGroup.
+type GroupInfo struct {
+	ID     string
+	Status GroupStatus
+	// Total is the number of members; Finished counts those that succeeded
+	// or failed.
+	Total    int
+	Finished int
+	// Results holds each member's SetResult value by member index; null for
+	// members that failed, have not finished or set no result.
+	Results []json.RawMessage
+	// Failed lists the indexes of the members that failed.
+	Failed []int
+	// Waiting counts the items of a map step not enqueued yet (see MapStep).
+	Waiting int
+}
+
+// ChordResult is the payload of a chord callback.
+type ChordResult struct {
+	GroupID string `json:"groupId"`
+	// Payload is the callback's own payload.
+	Payload json.RawMessage `json:"payload"`
+	// Results holds each member's SetResult value by member index; null for
+	// members that failed or set no result.
+	Results []json.RawMessage `json:"results"`
+	// Failed lists the indexes of the members that failed (GroupContinue
+	// only).
+	Failed []int `json:"failed"`
+}
+
+// Lua script that records a finished group member.
+// KEYS[1]: group hash, KEYS[2]: results hash, KEYS[3]: finished set,
+// KEYS[4]: failed set, KEYS[5]: waiting items list (map steps), KEYS[6]:
+// callback stream, KEYS[7]: item stream, KEYS[8]: lineage index (the group
+// hash for any the group has none of)
+// ARGV[1]: member index, ARGV[2]: "1" if the member failed, ARGV[3]: result
+// JSON ("" for none), ARGV[4]: group ID, ARGV[5]: now in ms, ARGV[6]: lineage
+// TTL in ms
+//
+// A member is only counted once, however often it is reported. Each member
+// of a map step that finishes while the group is pending enqueues the next
+// waiting item; a map's items and reduce task are added to the lineage index
+// as they are enqueued. Returns 1 when this member completed the group (its
+// callback, if any, is enqueued), 2 when it failed the group, 0 otherwise.
+const groupMemberLua = `
+local meta = redis.call('HMGET', KEYS[1], 'total', 'policy', 'status', 'stream', 'callback', 'itemStream',
+    'lineage', 'callbackId', 'callbackEntry')
+local total = tonumber(meta[1])
+if not total then
+    return 0
+end
+if redis.call('SADD', KEYS[3], ARGV[1]) == 0 then
+    return 0
+end
+
+local ttl = redis.call('PTTL', KEYS[1])
+local function keep(key)
+    if ttl > 0 then
+        redis.call('PEXPIRE', key, ttl)
+    end
+end
+keep(KEYS[3])
+
+local function record(id, raw)
+    if meta[7] then
+        local entry = cjson.decode(raw)
+        entry.enqueuedAt = tonumber(ARGV[5])
+        redis.call('HSET', KEYS[8], id, cjson.encode(entry))
+        redis.call('PEXPIRE', KEYS[8], ARGV[6])
+    end
+end
+
+if ARGV[2] == '1' then
+    redis.call('SADD', KEYS[4], ARGV[1])
+    keep(KEYS[4])
+    if meta[2] == 'fail' and meta[3] == 'pending' then
+        redis.call('HSET', KEYS[1], 'status', 'failed')
+        redis.call('DEL', KEYS[5])
+        return 2
+    end
+elseif ARGV[3] ~= '' then
+    redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+    keep(KEYS[2])
+end
+
+if meta[6] and meta[3] == 'pending' then
+    local raw = redis.call('LPOP', KEYS[5])
+    if raw then
+        local item = cjson.decode(raw)
+        local fields = item.fields
+        fields[#fields + 1] = 'enqueuedAt'
+        fields[#fields + 1] = ARGV[5]
+        redis.call('XADD', KEYS[7], '*', unpack(fields))
+        record(item.id, item.entry)
+    end
+end
+
+if meta[3] ~= 'pending' or redis.call('SCARD', KEYS[3]) < total then
+    return 0
+end
+redis.call('HSET', KEYS[1], 'status', 'completed')
+if not meta[5] then
+    return 1
+end
+
+-- Chord: enqueue the callback with the collected results
+local results = {}
+for i = 0, total - 1 do
+    results[#results + 1] = redis.call('HGET', KEYS[2], tostring(i)) or 'null'
+end
+local failed = redis.call('SMEMBERS', KEYS[4])
+table.sort(failed, function(a, b) return tonumber(a) < tonumber(b) end)
+
+local fields = cjson.decode(meta[5])
+for i = 1, #fields, 2 do
+    if fields[i] == 'payload' then
+        fields[i + 1] = '{"groupId":' .. cjson.encode(ARGV[4]) ..
+            ',"payload":' .. fields[i + 1] ..
+            ',"results":[' .. table.concat(results, ',') ..
+            '],"failed":[' .. table.concat(failed, ',') .. ']}'
+    end
+end
+redis.call('XADD', KEYS[6], '*', unpack(fields))
+if meta[8] then
+    record(meta[8], meta[9])
+end
+return 1
+`
+
+// groupKey returns the hash holding a group's state.
+func (c *Client) groupKey(id string) string {
+	return fmt.Sprintf("%s:group:%s", c.config.Prefix, id)
+}
+
+// groupKeys returns the groupMemberLua keys of a group.
+func (c *Client) groupKeys(id string) []string {
+	key := c.groupKey(id)
+	return []string{key, key + ":results", key + ":finished", key + ":failed", key + ":items"}
+}
+
+// EnqueueGroup enqueues tasks to run in parallel as a group, atomically.
+// Members may report a result with SetResult; track the group with GetGroup.
+// Returns the group ID.
+func (c *Client) EnqueueGroup(ctx context.Context, tasks []TaskSpec, opts ...GroupOptions) (string, error) {
+	return c.enqueueGroup(ctx, tasks, nil, opts)
+}
+
+// EnqueueChord enqueues tasks as a group, like EnqueueGroup, and enqueues
+// callback exactly once when the last member finishes. The callback's payload
+// is a ChordResult carrying its own payload and the members' results.
+//
+// Members cannot be deduplicated, debounced, throttled or have
+// dependencies; the callback cannot be delayed either. Returns the group ID.
+func (c *Client) EnqueueChord(ctx context.Context, tasks []TaskSpec, callback TaskSpec, opts ...GroupOptions) (string, error) {
+	return c.enqueueGroup(ctx, tasks, &callback, opts)
+}
+
+func (c *Client) enqueueGroup(ctx context.Context, tasks []TaskSpec, callback *TaskSpec, opts []GroupOptions) (string, error) {
+	var opt GroupOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if len(tasks) == 0 {
+		return "", errors.New("group has no tasks")
+	}
+	if opt.OnFailure == "" {
+		opt.OnFailure = GroupFailFast
+	}
+	if opt.OnFailure != GroupFailFast && opt.OnFailure != GroupContinue {
+		return "", fmt.Errorf("unknown group failure policy %q", opt.OnFailure)
+	}
+	if opt.TTL <= 0 {
+		opt.TTL = DefaultGroupTTL
+	}
+
+	id, err := newTaskID()
+	if err != nil {
+		return "", err
+	}
+
+	state := map[string]interface{}{
+		"total":     len(tasks),
+		"policy":    string(opt.OnFailure),
+		"status":    string(GroupPending),
+		"createdAt": time.Now().UnixMilli(),
+	}
+	if callback != nil {
+		cb := callback.Options
+		if err := checkOptions("chord callback", cb, ruleWrittenByScript); err != nil {
+			return "", err
+		}
+		task, err := c.prepareTask(callback.TaskName, callback.Payload, cb)
+		if err != nil {
+			return "", fmt.Errorf("callback: %w", err)
+		}
+		fieldsJSON, _ := json.Marshal(task.fields())
+		state["stream"] = task.streamKey
+		state["callback"] = string(fieldsJSON)
+	}
+
+	plan := newAtomicPlan()
+	for i, spec := range tasks {
+		o := spec.Options
+		if err := checkOptions("group members", o, ruleWrittenByScript&^ruleDelay); err != nil {
+			return "", fmt.Errorf("task %d: %w", i, err)
+		}
+		task, err := c.prepareTask(spec.TaskName, spec.Payload, o)
+		if err != nil {
+			return "", fmt.Errorf("task %d: %w", i, err)
+		}
+		task.setField("groupId", id)
+		task.setField("groupIndex", i)
+		plan.add(c, task)
+	}
+
+	// The state exists before any member can finish
+	key := c.groupKey(id)
+	pipe := c.redis.TxPipeline()
+	pipe.HSet(ctx, key, state)
+	pipe.PExpire(ctx, key, opt.TTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("create group: %w", err)
+	}
+
+	_, conflict, err := plan.run(ctx, c.redis).result()
+	if err != nil {
+		c.redis.Del(ctx, key)
+		if err == ErrQueueFull {
+			return "", fmt.Errorf("task %d: %w", conflict, err)
+		}
+		return "", fmt.Errorf("enqueue group: %w", err)
+	}
+	return id, nil
+}
+
+// finishGroupMember records that msg finished, if it is a group member.
+// result is its SetResult value, if any.
+func (c *Client) finishGroupMember(ctx context.Context, msg redis.XMessage, result json.RawMessage, failed bool) error {
+	id, _ := msg.Values["groupId"].(string)
+	if id == "" {
+		return nil
+	}
+	index, _ := asInt64(msg.Values["groupIndex"])
+
+	failedArg := "0"
+	if failed {
+		failedArg = "1"
+	}
+	// The streams a member may enqueue to, and the lineage index, are fixed
+	// when the group is created
+	keys := c.groupKeys(id)
+	streams, err := c.redis.HMGet(ctx, keys[0], "stream", "itemStream", "lineage").Result()
+	if err != nil {
+		return err
+	}
+	for _, v := range streams {
+		stream, _ := v.(string)
+		if stream == "" {
+			stream = keys[0]
+		}
+		keys = append(keys, stream)
+	}
+	status, err := c.redis.Eval(ctx, groupMemberLua, keys,
+		index, failedArg, string(result), id, time.Now().UnixMilli(), lineageTTL.Milliseconds(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case 1:
+		c.logger.Info("Group completed", "group", id)
+	case 2:
+		c.logger.Warn("Group failed", "group", id, "member", index)
+	}
+	return nil
+}
+
+// GetGroup returns the state of a group, or ErrGroupNotFound if it does not
+// exist or its state expired.
+func (c *Client) GetGroup(ctx context.Context, id string) (*GroupInfo, error) {
+	keys := c.groupKeys(id)
+	pipe := c.redis.Pipeline()
+	stateCmd := pipe.HGetAll(ctx, keys[0])
+	resultsCmd := pipe.HGetAll(ctx, keys[1])
+	finishedCmd := pipe.SCard(ctx, keys[2])
+	failedCmd := pipe.SMembers(ctx, keys[3])
+	waitingCmd := pipe.LLen(ctx, keys[4])
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("get group: %w", err)
+	}
+
+	state := stateCmd.Val()
+	if len(state) == 0 {
+		return nil, ErrGroupNotFound
+	}
+	total, _ := strconv.Atoi(state["total"])
+
+	info := &GroupInfo{
+		ID:       id,
+		Status:   GroupStatus(state["status"]),
+		Total:    total,
+		Finished: int(finishedCmd.Val()),
+		Results:  make([]json.RawMessage, total),
+		Waiting:  int(waitingCmd.Val()),
+	}
+	for i := range info.Results {
+		info.Results[i] = json.RawMessage("null")
+	}
+	for k, v := range resultsCmd.Val() {
+		if i, err := strconv.Atoi(k); err == nil && i >= 0 && i < total {
+			info.Results[i] = json.RawMessage(v)
+		}
+	}
+	for _, v := range failedCmd.Val() {
+		if i, err := strconv.Atoi(v); err == nil {
+			info.Failed = append(info.Failed, i)
+		}
+	}
+	sort.Ints(info.Failed)
+	return info, nil
+}
+
+// SetResult records the result of the task running in ctx. The result of a
+// group member is collected when it succeeds and passed to its chord's
+// callback. v must marshal to JSON. Returns ErrNoTask outside a handler.
+func SetResult(ctx context.Context, v interface{}) error {
+	info, ok := TaskInfoFromContext(ctx)
+	if !ok {
+		return ErrNoTask
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal result: %w", err)
+	}
+	info.result = data
+	return nil
+}
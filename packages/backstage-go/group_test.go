@@ -0,0 +1,172 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// runMembers delivers and handles n messages of the default stream.
+func runMembers(t *testing.T, client *Client, n int) {
+	t.Helper()
+	stream := client.streamKey(PriorityDefault)
+	for i := 0; i < n; i++ {
+		client.handleMessage(context.Background(), stream, readOne(t, client, stream))
+	}
+}
+
+func TestChordCallbackWithResults(t *testing.T) {
+	client := newIsolatedClient(t, "test-chord")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.On("square", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		var n int
+		json.Unmarshal(payload, &n)
+		return nil, SetResult(ctx, n*n)
+	})
+
+	id, err := client.EnqueueChord(ctx,
+		[]TaskSpec{{TaskName: "square", Payload: 2}, {TaskName: "square", Payload: 3}, {TaskName: "square", Payload: 4}},
+		TaskSpec{TaskName: "sum", Payload: "totals"},
+	)
+	if err != nil {
+		t.Fatalf("EnqueueChord failed: %v", err)
+	}
+
+	runMembers(t, client, 3)
+
+	callback := lastMessage(t, client.redis, stream)
+	if callback.Values["taskName"] != "sum" {
+		t.Fatalf("expected the callback enqueued, got %v", callback.Values)
+	}
+	var result ChordResult
+	if err := json.Unmarshal([]byte(callback.Values["payload"].(string)), &result); err != nil {
+		t.Fatalf("decode callback payload: %v", err)
+	}
+	if result.GroupID != id || string(result.Payload) != `"totals"` {
+		t.Errorf("unexpected callback payload: %+v", result)
+	}
+	if len(result.Results) != 3 || string(result.Results[0]) != "4" || string(result.Results[2]) != "16" {
+		t.Errorf("expected results in member order, got %s", result.Results)
+	}
+
+	info, err := client.GetGroup(ctx, id)
+	if err != nil {
+		t.Fatalf("GetGroup failed: %v", err)
+	}
+	if info.Status != GroupCompleted || info.Finished != 3 {
+		t.Errorf("expected a completed group, got %+v", info)
+	}
+}
+
+func TestChordCallbackExactlyOnce(t *testing.T) {
+	client := newIsolatedClient(t, "test-chord-once")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("work", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, nil
+	})
+
+	client.EnqueueChord(ctx, []TaskSpec{{TaskName: "work"}, {TaskName: "work"}}, TaskSpec{TaskName: "done"})
+
+	first := readOne(t, client, stream)
+	last := readOne(t, client, stream)
+	client.handleMessage(ctx, stream, first)
+	client.handleMessage(ctx, stream, last)
+	client.handleDelivery(ctx, stream, last, 2) // Redelivered after a lost ACK
+	client.handleDelivery(ctx, stream, first, 2)
+
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 3 {
+		t.Errorf("expected one callback, stream has %d entries", n)
+	}
+}
+
+func TestGroupFailFast(t *testing.T) {
+	client := newIsolatedClient(t, "test-group-fail")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("work", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, nil
+	})
+
+	id, _ := client.EnqueueChord(ctx, []TaskSpec{{TaskName: "work"}, {TaskName: "work"}}, TaskSpec{TaskName: "done"})
+
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+	runMembers(t, client, 1)
+
+	info, _ := client.GetGroup(ctx, id)
+	if info.Status != GroupFailed || len(info.Failed) != 1 || info.Failed[0] != 0 {
+		t.Errorf("expected a failed group, got %+v", info)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 2 {
+		t.Errorf("expected no callback, stream has %d entries", n)
+	}
+}
+
+func TestGroupContinueWithPartialResults(t *testing.T) {
+	client := newIsolatedClient(t, "test-group-continue")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("work", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, SetResult(ctx, "ok")
+	})
+
+	client.EnqueueChord(ctx, []TaskSpec{{TaskName: "work"}, {TaskName: "work"}}, TaskSpec{TaskName: "done"},
+		GroupOptions{OnFailure: GroupContinue})
+
+	runMembers(t, client, 1)
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+
+	callback := lastMessage(t, client.redis, stream)
+	var result ChordResult
+	json.Unmarshal([]byte(callback.Values["payload"].(string)), &result)
+	if callback.Values["taskName"] != "done" || string(result.Results[0]) != `"ok"` || string(result.Results[1]) != "null" {
+		t.Errorf("expected a callback with partial results, got %v", callback.Values)
+	}
+	if len(result.Failed) != 1 || result.Failed[0] != 1 {
+		t.Errorf("expected member 1 reported failed, got %v", result.Failed)
+	}
+}
+
+func TestEnqueueGroupWithoutCallback(t *testing.T) {
+	client := newIsolatedClient(t, "test-group")
+	ctx := context.Background()
+	client.initConsumerGroups(ctx)
+	client.On("work", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, nil
+	})
+
+	id, err := client.EnqueueGroup(ctx, []TaskSpec{{TaskName: "work"}, {TaskName: "work"}})
+	if err != nil {
+		t.Fatalf("EnqueueGroup failed: %v", err)
+	}
+	runMembers(t, client, 1)
+
+	info, _ := client.GetGroup(ctx, id)
+	if info.Status != GroupPending || info.Total != 2 || info.Finished != 1 {
+		t.Errorf("expected one of two members finished, got %+v", info)
+	}
+	runMembers(t, client, 1)
+	if info, _ := client.GetGroup(ctx, id); info.Status != GroupCompleted {
+		t.Errorf("expected a completed group, got %+v", info)
+	}
+
+	if _, err := client.GetGroup(ctx, "missing"); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("expected ErrGroupNotFound, got %v", err)
+	}
+	if _, err := client.EnqueueGroup(ctx, nil); err == nil {
+		t.Error("expected an empty group to be rejected")
+	}
+}
+
+func TestSetResultOutsideHandler(t *testing.T) {
+	if err := SetResult(context.Background(), 1); !errors.Is(err, ErrNoTask) {
+		t.Errorf("expected ErrNoTask, got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestHeadersPropagateThroughChain(t *testing.T) {
+	client := newIsolatedClient(t, "test-headers")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	var first, second map[string]string
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		first = HeadersFromContext(ctx)
+		return &WorkflowInstruction{Next: "order.confirm"}, nil
+	})
+	client.On("order.confirm", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		second = HeadersFromContext(ctx)
+		return nil, nil
+	})
+
+	client.Enqueue(ctx, "order.place", nil, EnqueueOptions{
+		Headers: map[string]string{"correlationId": "c-42", "tenant": "acme"},
+	})
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if first["correlationId"] != "c-42" || first["tenant"] != "acme" {
+		t.Errorf("expected headers in the handler, got %v", first)
+	}
+	if second["correlationId"] != "c-42" {
+		t.Errorf("expected headers copied onto the chained task, got %v", second)
+	}
+}
+
+func TestHeadersKeptOnDeadLetter(t *testing.T) {
+	client := newIsolatedClient(t, "test-headers-dlq")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.Enqueue(ctx, "order.place", nil, EnqueueOptions{
+		Headers: map[string]string{"correlationId": "c-7"},
+	})
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+
+	dead := lastMessage(t, client.redis, client.deadLetterKey(PriorityDefault))
+	if headers := messageHeaders(dead); headers["correlationId"] != "c-7" {
+		t.Errorf("expected headers kept on the dead-letter entry, got %v", dead.Values)
+	}
+}
+
+func TestHeadersOutsideHandler(t *testing.T) {
+	if HeadersFromContext(context.Background()) != nil {
+		t.Error("expected no headers outside a handler")
+	}
+}
@@ -0,0 +1,112 @@
+// Package backstage consumer-side idempotency.
+// Records task completion so redeliveries of an already-processed task are
+// acknowledged without running the handler a second time.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultIdempotencyTTL is how long a completion record is kept when
+// IdempotencyConfig.TTL is not set.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// IdempotencyConfig opts a task into consumer-side idempotency.
+// Backstage delivers at least once: a reclaim, a network blip between handler
+// success and the batched ACK, or a crash before the ACK buffer is flushed can
+// all deliver the same task again. With idempotency enabled, the consumer
+// records the completion and later deliveries with the same key are
+// acknowledged without invoking the handler.
+type IdempotencyConfig struct {
+	// Key identifies the unit of work. Defaults to the stream message ID, which
+	// covers redeliveries of the same message; set it explicitly to also
+	// collapse separate enqueues of the same logical task.
+	Key string
+	// TTL is how long the completion record is kept (default: 24 hours).
+	TTL time.Duration
+}
+
+// IdempotencyRecord is stored when an idempotent task completes successfully.
+type IdempotencyRecord struct {
+	MessageID   string               `json:"messageId"`
+	TaskName    string               `json:"taskName"`
+	CompletedAt int64                `json:"completedAt"`
+	Result      *WorkflowInstruction `json:"result,omitempty"`
+}
+
+// setIdempotencyFields adds the idempotency settings to a stream entry.
+func setIdempotencyFields(values map[string]interface{}, cfg *IdempotencyConfig) {
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	values["idempotencyTTL"] = ttl.Milliseconds()
+	if cfg.Key != "" {
+		values["idempotencyKey"] = cfg.Key
+	}
+}
+
+// idempotencyKey returns the Redis key holding the completion record for key.
+func (c *Client) idempotencyKey(key string) string {
+	return fmt.Sprintf("%s:idempotency:%s", c.config.Prefix, key)
+}
+
+// messageIdempotency returns the idempotency key and TTL for a message, or an
+// empty key if the task did not opt in.
+func messageIdempotency(msg redis.XMessage) (string, time.Duration) {
+	ttlMs, ok := asInt64(msg.Values["idempotencyTTL"])
+	if !ok {
+		return "", 0
+	}
+	key, _ := msg.Values["idempotencyKey"].(string)
+	if key == "" {
+		key = msg.ID
+	}
+	return key, time.Duration(ttlMs) * time.Millisecond
+}
+
+// isCompleted reports whether an idempotent task has already completed.
+// Lookup errors are treated as "not completed" so the handler still runs.
+func (c *Client) isCompleted(ctx context.Context, key string) bool {
+	n, err := c.redis.Exists(ctx, c.idempotencyKey(key)).Result()
+	return err == nil && n > 0
+}
+
+// recordCompletion stores the completion record for an idempotent task.
+func (c *Client) recordCompletion(ctx context.Context, key string, ttl time.Duration, taskName, messageID string, result *WorkflowInstruction) error {
+	data, err := json.Marshal(IdempotencyRecord{
+		MessageID:   messageID,
+		TaskName:    taskName,
+		CompletedAt: time.Now().UnixMilli(),
+		Result:      result,
+	})
+	if err != nil {
+		return err
+	}
+	return c.redis.Set(ctx, c.idempotencyKey(key), data, ttl).Err()
+}
+
+// GetIdempotencyRecord returns the completion record stored for an
+// idempotency key (the caller-supplied key, or the message ID when none was
+// given), including the handler's result. Returns ErrTaskNotFound if the task
+// has not completed or its record has expired.
+func (c *Client) GetIdempotencyRecord(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	data, err := c.redis.Get(ctx, c.idempotencyKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec IdempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("decode idempotency record: %w", err)
+	}
+	return &rec, nil
+}
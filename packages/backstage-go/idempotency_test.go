@@ -0,0 +1,152 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestIdempotencySkipsRedelivery(t *testing.T) {
+	client := newIsolatedClient(t, "test-idem-redelivery")
+	ctx := context.Background()
+
+	runs := 0
+	client.On("idem.task", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		runs++
+		return nil, nil
+	})
+
+	id, err := client.Enqueue(ctx, "idem.task", nil, EnqueueOptions{
+		Idempotency: &IdempotencyConfig{TTL: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	msg := lastMessage(t, client.redis, client.streamKey(PriorityDefault))
+	client.handleMessage(ctx, client.streamKey(PriorityDefault), msg)
+	client.handleMessage(ctx, client.streamKey(PriorityDefault), msg)
+
+	if runs != 1 {
+		t.Errorf("expected handler to run once, ran %d times", runs)
+	}
+
+	rec, err := client.GetIdempotencyRecord(ctx, id)
+	if err != nil {
+		t.Fatalf("GetIdempotencyRecord failed: %v", err)
+	}
+	if rec.MessageID != id || rec.TaskName != "idem.task" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+}
+
+func TestIdempotencyCallerKey(t *testing.T) {
+	client := newIsolatedClient(t, "test-idem-key")
+	ctx := context.Background()
+
+	runs := 0
+	client.On("idem.keyed", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		runs++
+		return &WorkflowInstruction{Next: "idem.after"}, nil
+	})
+
+	opts := EnqueueOptions{Idempotency: &IdempotencyConfig{Key: "order-42"}}
+	stream := client.streamKey(PriorityDefault)
+
+	client.Enqueue(ctx, "idem.keyed", nil, opts)
+	client.handleMessage(ctx, stream, lastMessage(t, client.redis, stream))
+
+	client.Enqueue(ctx, "idem.keyed", nil, opts)
+	client.handleMessage(ctx, stream, lastMessage(t, client.redis, stream))
+
+	if runs != 1 {
+		t.Errorf("expected handler to run once, ran %d times", runs)
+	}
+
+	rec, err := client.GetIdempotencyRecord(ctx, "order-42")
+	if err != nil {
+		t.Fatalf("GetIdempotencyRecord failed: %v", err)
+	}
+	if rec.Result == nil || rec.Result.Next != "idem.after" {
+		t.Errorf("expected stored result, got %+v", rec.Result)
+	}
+
+	ttl := client.redis.PTTL(ctx, client.idempotencyKey("order-42")).Val()
+	if ttl <= time.Hour || ttl > DefaultIdempotencyTTL {
+		t.Errorf("expected default TTL, got %v", ttl)
+	}
+}
+
+func TestIdempotencyMissingRecord(t *testing.T) {
+	client := newIsolatedClient(t, "test-idem-missing")
+
+	if _, err := client.GetIdempotencyRecord(context.Background(), "nope"); err != ErrTaskNotFound {
+		t.Errorf("expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestScheduledTaskKeepsMetadata(t *testing.T) {
+	client := newIsolatedClient(t, "test-idem-scheduled")
+	ctx := context.Background()
+
+	_, err := client.Schedule(ctx, "idem.scheduled", nil, time.Millisecond, EnqueueOptions{
+		Queue:       "reports",
+		Attempts:    4,
+		Idempotency: &IdempotencyConfig{Key: "report-1"},
+	})
+	if err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	client.redis.Eval(ctx, processScheduledLua, []string{client.scheduledKey()},
+		time.Now().UnixMilli(), client.config.Prefix, string(PriorityDefault))
+
+	msg := lastMessage(t, client.redis, client.config.Prefix+":reports")
+	if msg.Values["idempotencyKey"] != "report-1" {
+		t.Errorf("expected idempotencyKey to survive the move, got %v", msg.Values["idempotencyKey"])
+	}
+	if msg.Values["attempts"] != "4" {
+		t.Errorf("expected attempts to survive the move, got %v", msg.Values["attempts"])
+	}
+}
+
+func TestIdempotencyRecordedAfterChain(t *testing.T) {
+	client := newIsolatedClient(t, "test-idem-chain")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	low := client.streamKey(PriorityLow)
+	client.initConsumerGroups(ctx)
+
+	runs := 0
+	client.On("idem.chain", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		runs++
+		return &WorkflowInstruction{Next: "idem.next", Priority: PriorityLow}, nil
+	})
+
+	id, _ := client.Enqueue(ctx, "idem.chain", nil, EnqueueOptions{
+		Idempotency: &IdempotencyConfig{TTL: time.Minute},
+	})
+	msg := readOne(t, client, stream)
+
+	// The chain fails: the task must not be recorded as completed
+	client.redis.Del(ctx, low)
+	client.redis.Set(ctx, low, "not a stream", 0)
+	client.handleMessage(ctx, stream, msg)
+	if _, err := client.GetIdempotencyRecord(ctx, id); err != ErrTaskNotFound {
+		t.Fatalf("expected no completion record after a failed chain, got %v", err)
+	}
+
+	client.redis.Del(ctx, low)
+	client.handleDelivery(ctx, stream, msg, 2)
+	if runs != 2 {
+		t.Errorf("expected the redelivery to run the handler again, ran %d times", runs)
+	}
+	if n := client.redis.XLen(ctx, low).Val(); n != 1 {
+		t.Errorf("expected the next task chained on redelivery, got %d", n)
+	}
+	if _, err := client.GetIdempotencyRecord(ctx, id); err != nil {
+		t.Errorf("expected a completion record once chained, got %v", err)
+	}
+}
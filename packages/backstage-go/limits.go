@@ -0,0 +1,115 @@
+// Package backstage producer backpressure.
+// Bounds how many unprocessed tasks a queue may hold and what producers do
+// once it is full.
+package backstage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OverflowPolicy controls what Enqueue does when a queue is at its limit.
+type OverflowPolicy string
+
+const (
+	// OverflowReject fails the enqueue with ErrQueueFull. This is the default.
+	OverflowReject OverflowPolicy = "reject"
+	// OverflowBlock waits for the queue to drain below its limit, until the
+	// context ends.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDivert writes the task to QueueLimit.OverflowQueue instead.
+	OverflowDivert OverflowPolicy = "divert"
+)
+
+// QueueLimit bounds the depth of a queue: the tasks not yet delivered to its
+// consumer group plus those delivered but not acknowledged. With several
+// groups, the deepest one counts; without any, the stream length.
+//
+// The limit is checked when producers enqueue. Tasks already admitted are
+// written past it: delayed, debounced and throttled tasks when they run,
+// tasks chained by a handler (diverted with OverflowDivert) and tasks
+// released by workflows, groups, maps, signals and dependencies.
+type QueueLimit struct {
+	// MaxDepth is the depth at which the queue is full.
+	MaxDepth int64
+	// Policy applies once the queue is full (default: OverflowReject).
+	Policy OverflowPolicy
+	// OverflowQueue receives tasks diverted by OverflowDivert. It is not
+	// subject to this limit.
+	OverflowQueue string
+}
+
+// validate reports a limit on the queue name that cannot be applied.
+func (l QueueLimit) validate(name string) error {
+	switch l.Policy {
+	case "", OverflowReject, OverflowBlock:
+	case OverflowDivert:
+		if l.OverflowQueue == "" {
+			return errors.New("OverflowDivert needs an OverflowQueue")
+		}
+		if l.OverflowQueue == name {
+			return errors.New("OverflowQueue cannot be the limited queue")
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy %q", l.Policy)
+	}
+	return nil
+}
+
+// Backoff bounds for Enqueue waiting on a full queue with OverflowBlock.
+const (
+	minOverflowWait = 50 * time.Millisecond
+	maxOverflowWait = time.Second
+)
+
+// queueName returns the name of a stream key, without the prefix.
+func (c *Client) queueName(streamKey string) string {
+	return strings.TrimPrefix(streamKey, c.config.Prefix+":")
+}
+
+// checkLimit returns an error if the limit configured for a stream key is
+// invalid, so that tasks for it are refused rather than silently rejected.
+func (c *Client) checkLimit(streamKey string) error {
+	name := c.queueName(streamKey)
+	if limit, ok := c.config.Limits[name]; ok {
+		if err := limit.validate(name); err != nil {
+			return fmt.Errorf("queue limit %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// limitFor returns the depth limit configured for a stream key.
+func (c *Client) limitFor(streamKey string) (QueueLimit, bool) {
+	limit, ok := c.config.Limits[c.queueName(streamKey)]
+	return limit, ok && limit.MaxDepth > 0
+}
+
+// limited reports whether writing task checks a queue depth limit.
+func (c *Client) limited(task *preparedTask) bool {
+	if task.executeAt > 0 {
+		return false
+	}
+	_, ok := c.limitFor(task.streamKey)
+	return ok
+}
+
+// waitForCapacity sleeps before retrying an enqueue into a full queue with
+// OverflowBlock. Returns an error wrapping ErrQueueFull once ctx ends.
+func waitForCapacity(ctx context.Context, wait *time.Duration) error {
+	if *wait == 0 {
+		*wait = minOverflowWait
+	}
+	select {
+	case <-time.After(*wait):
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrQueueFull, ctx.Err())
+	}
+	if *wait *= 2; *wait > maxOverflowWait {
+		*wait = maxOverflowWait
+	}
+	return nil
+}
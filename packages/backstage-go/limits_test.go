@@ -0,0 +1,141 @@
+package backstage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueueLimitReject(t *testing.T) {
+	client := newIsolatedClient(t, "test-limit-reject")
+	client.config.Limits = map[string]QueueLimit{"default": {MaxDepth: 2}}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Enqueue(ctx, "event.ingest", i); err != nil {
+			t.Fatalf("enqueue %d failed: %v", i, err)
+		}
+	}
+	if _, err := client.Enqueue(ctx, "event.ingest", 2); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if n := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); n != 2 {
+		t.Errorf("expected 2 tasks, got %d", n)
+	}
+
+	// Delayed tasks are not limited at enqueue time
+	if _, err := client.Schedule(ctx, "event.ingest", 3, time.Hour); err != nil {
+		t.Errorf("expected scheduling to succeed, got %v", err)
+	}
+}
+
+func TestQueueLimitCountsOnlyUnprocessed(t *testing.T) {
+	client := newIsolatedClient(t, "test-limit-acked")
+	client.config.Limits = map[string]QueueLimit{"default": {MaxDepth: 1}}
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.Enqueue(ctx, "event.ingest", 0)
+	msg := readOne(t, client, stream)
+	client.redis.XAck(ctx, stream, client.config.ConsumerGroup, msg.ID)
+
+	if _, err := client.Enqueue(ctx, "event.ingest", 1); err != nil {
+		t.Errorf("expected acknowledged tasks not to count, got %v", err)
+	}
+}
+
+func TestQueueLimitDivert(t *testing.T) {
+	client := newIsolatedClient(t, "test-limit-divert")
+	client.config.Limits = map[string]QueueLimit{
+		"default": {MaxDepth: 1, Policy: OverflowDivert, OverflowQueue: "overflow"},
+	}
+	ctx := context.Background()
+
+	client.Enqueue(ctx, "event.ingest", 0)
+	id, err := client.Enqueue(ctx, "event.ingest", 1)
+	if err != nil || id == "" {
+		t.Fatalf("expected the task to be diverted, got %q (%v)", id, err)
+	}
+
+	msgs, _ := client.redis.XRange(ctx, client.config.Prefix+":overflow", "-", "+").Result()
+	if len(msgs) != 1 || msgs[0].ID != id {
+		t.Errorf("expected the task in the overflow queue, got %v", msgs)
+	}
+}
+
+func TestQueueLimitDivertNeedsQueue(t *testing.T) {
+	client := newIsolatedClient(t, "test-limit-divert-invalid")
+	client.config.Limits = map[string]QueueLimit{
+		"default": {MaxDepth: 1, Policy: OverflowDivert},
+	}
+	ctx := context.Background()
+
+	if _, err := client.Enqueue(ctx, "event.ingest", 0); err == nil || errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected the misconfigured limit reported, got %v", err)
+	}
+	if n := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); n != 0 {
+		t.Errorf("expected nothing written, got %d", n)
+	}
+	if _, err := client.Enqueue(ctx, "event.ingest", 0, EnqueueOptions{Priority: PriorityUrgent}); err != nil {
+		t.Errorf("expected other queues unaffected, got %v", err)
+	}
+}
+
+func TestQueueLimitBlock(t *testing.T) {
+	client := newIsolatedClient(t, "test-limit-block")
+	client.config.Limits = map[string]QueueLimit{"default": {MaxDepth: 1, Policy: OverflowBlock}}
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	first, _ := client.Enqueue(ctx, "event.ingest", 0)
+
+	// Times out while the queue stays full
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.Enqueue(timeout, "event.ingest", 1); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull once the context ended, got %v", err)
+	}
+
+	// Proceeds as soon as there is room
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.redis.XDel(ctx, stream, first)
+	}()
+	if _, err := client.Enqueue(ctx, "event.ingest", 2); err != nil {
+		t.Errorf("expected the enqueue to proceed once drained, got %v", err)
+	}
+}
+
+func TestQueueLimitAtomic(t *testing.T) {
+	client := newIsolatedClient(t, "test-limit-atomic")
+	client.config.Limits = map[string]QueueLimit{"default": {MaxDepth: 2}}
+	ctx := context.Background()
+
+	_, err := client.EnqueueAtomic(ctx, []TaskSpec{{TaskName: "a"}, {TaskName: "b"}, {TaskName: "c"}})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if n := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); n != 0 {
+		t.Errorf("expected nothing written, got %d", n)
+	}
+}
+
+func TestQueueLimitWorkflowsAndSagas(t *testing.T) {
+	client := newIsolatedClient(t, "test-limit-start")
+	client.config.Limits = map[string]QueueLimit{"default": {MaxDepth: 1}}
+	ctx := context.Background()
+	client.Enqueue(ctx, "filler", nil)
+
+	_, err := client.StartWorkflow(ctx, Workflow{Nodes: []WorkflowNode{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}}}})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected StartWorkflow to return ErrQueueFull, got %v", err)
+	}
+	if _, err := client.StartSaga(ctx, "seat.reserve", nil); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected StartSaga to return ErrQueueFull, got %v", err)
+	}
+	if keys, _ := client.redis.Keys(ctx, "test-limit-start:*").Result(); len(keys) != 1 {
+		t.Errorf("expected no run or saga state written, got %v", keys)
+	}
+}
@@ -0,0 +1,213 @@
+// Package backstage workflow lineage.
+// Records which task enqueued which, so that the whole tree of tasks
+// descending from a root task can be inspected.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// lineageTTL is how long a lineage index is kept after its last write.
+const lineageTTL = 7 * 24 * time.Hour
+
+// lineage links a task to the task that enqueued it.
+type lineage struct {
+	parentID string
+	rootID   string
+	parent   string // Lineage entry of the parent, recorded if missing
+	deadline int64  // Workflow deadline in ms, 0 if none
+}
+
+// lineageEntry is a task's entry in its root's lineage index.
+type lineageEntry struct {
+	ParentID   string `json:"parentId,omitempty"`
+	TaskName   string `json:"taskName"`
+	Stream     string `json:"stream"`
+	EnqueuedAt int64  `json:"enqueuedAt"`
+}
+
+// LineageNode is a task of a lineage tree, as returned by GetLineage.
+type LineageNode struct {
+	TaskID     string
+	ParentID   string // Empty for the root
+	TaskName   string
+	Stream     string
+	EnqueuedAt time.Time
+	// State is the task's last recorded state; nil unless Config.TrackTasks
+	// is set and the task has one.
+	State *TaskState
+	// Children are the tasks this task enqueued, oldest first.
+	Children []*LineageNode
+}
+
+// lineageKey returns the hash indexing the descendants of a root task.
+func (c *Client) lineageKey(rootID string) string {
+	return fmt.Sprintf("%s:lineage:%s", c.config.Prefix, rootID)
+}
+
+// lineageOf returns the lineage of tasks enqueued by the task info describes.
+func lineageOf(info *TaskInfo) *lineage {
+	entry, _ := json.Marshal(lineageEntry{
+		ParentID:   info.ParentID,
+		TaskName:   info.TaskName,
+		Stream:     info.Stream,
+		EnqueuedAt: info.EnqueuedAt,
+	})
+	l := &lineage{parentID: info.TaskID, rootID: info.RootID, parent: string(entry)}
+	if !info.WorkflowDeadline.IsZero() {
+		l.deadline = info.WorkflowDeadline.UnixMilli()
+	}
+	return l
+}
+
+// inherit makes task a child in l, bound by its workflow deadline. The task
+// gets its ID now, so that its lineage entry can be written together with
+// it.
+func (task *preparedTask) inherit(l *lineage) error {
+	if task.id == "" {
+		id, err := newTaskID()
+		if err != nil {
+			return err
+		}
+		task.id = id
+	}
+	task.setField("taskId", task.id)
+	task.setField("parentId", l.parentID)
+	task.setField("rootId", l.rootID)
+	if own, _ := asInt64(task.values["workflowDeadline"]); l.deadline > 0 && (own == 0 || l.deadline < own) {
+		task.setField("workflowDeadline", l.deadline)
+	}
+	task.lineage = l
+	return nil
+}
+
+// lineageEntry encodes the task's entry in its root's lineage index.
+func (task *preparedTask) lineageEntry() string {
+	enqueuedAt, _ := asInt64(task.values["enqueuedAt"])
+	entry, _ := json.Marshal(lineageEntry{
+		ParentID:   task.lineage.parentID,
+		TaskName:   fmt.Sprint(task.values["taskName"]),
+		Stream:     task.streamKey,
+		EnqueuedAt: enqueuedAt,
+	})
+	return string(entry)
+}
+
+// recordLineage queues the lineage entries of task, and of its parent if
+// missing, on pipe.
+func (c *Client) recordLineage(ctx context.Context, pipe redis.Pipeliner, task *preparedTask) {
+	key := c.lineageKey(task.lineage.rootID)
+	pipe.HSetNX(ctx, key, task.lineage.parentID, task.lineage.parent)
+	pipe.HSet(ctx, key, task.id, task.lineageEntry())
+	pipe.PExpire(ctx, key, lineageTTL)
+}
+
+// refuseCancelled returns ErrWorkflowCancelled if ctx is the context of a
+// handler whose workflow was cancelled by any client, which its cancellation
+// marker records.
+func (c *Client) refuseCancelled(ctx context.Context) error {
+	info, ok := TaskInfoFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	n, err := c.redis.Exists(ctx, c.cancelledKey(info.RootID)).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrWorkflowCancelled
+	}
+	return nil
+}
+
+// prepareIn prepares a task enqueued with ctx. Tasks enqueued from a handler
+// become children of the running task; they are refused with
+// ErrWorkflowCancelled once its workflow is cancelled, as far as this
+// consumer knows (see refuseCancelled).
+func (c *Client) prepareIn(ctx context.Context, taskName string, payload interface{}, opt EnqueueOptions) (*preparedTask, error) {
+	task, err := c.prepareTask(taskName, payload, opt)
+	if err != nil {
+		return nil, err
+	}
+	if info, ok := TaskInfoFromContext(ctx); ok {
+		if workflowCancelled(ctx, info) {
+			return nil, ErrWorkflowCancelled
+		}
+		if err := task.inherit(lineageOf(info)); err != nil {
+			return nil, err
+		}
+	}
+	return task, nil
+}
+
+// GetLineage returns the tree of tasks descending from a root task: every
+// task enqueued from its handler or chained from it, recursively. Returns
+// ErrTaskNotFound if the root has no recorded descendants.
+func (c *Client) GetLineage(ctx context.Context, rootID string) (*LineageNode, error) {
+	entries, err := c.redis.HGetAll(ctx, c.lineageKey(rootID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get lineage: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, ErrTaskNotFound
+	}
+
+	nodes := make(map[string]*LineageNode, len(entries)+1)
+	for id, raw := range entries {
+		var entry lineageEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			return nil, fmt.Errorf("decode lineage of %s: %w", id, err)
+		}
+		nodes[id] = &LineageNode{
+			TaskID:     id,
+			ParentID:   entry.ParentID,
+			TaskName:   entry.TaskName,
+			Stream:     entry.Stream,
+			EnqueuedAt: time.UnixMilli(entry.EnqueuedAt),
+		}
+	}
+	root, ok := nodes[rootID]
+	if !ok {
+		root = &LineageNode{TaskID: rootID}
+		nodes[rootID] = root
+	}
+
+	for id, node := range nodes {
+		if id == rootID {
+			continue
+		}
+		if parent, ok := nodes[node.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		}
+	}
+	for _, node := range nodes {
+		sort.Slice(node.Children, func(i, j int) bool {
+			a, b := node.Children[i], node.Children[j]
+			if !a.EnqueuedAt.Equal(b.EnqueuedAt) {
+				return a.EnqueuedAt.Before(b.EnqueuedAt)
+			}
+			return a.TaskID < b.TaskID
+		})
+	}
+
+	if c.config.TrackTasks {
+		ids := make([]string, 0, len(nodes))
+		for id := range nodes {
+			ids = append(ids, id)
+		}
+		states, err := c.getTaskStates(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for id, state := range states {
+			nodes[id].State = state
+		}
+	}
+	return root, nil
+}
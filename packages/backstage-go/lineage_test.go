@@ -0,0 +1,153 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestLineageTree(t *testing.T) {
+	client := newIsolatedClient(t, "test-lineage")
+	ctx := context.Background()
+	client.initConsumerGroups(ctx)
+
+	infos := make(map[string]*TaskInfo)
+	record := func(ctx context.Context) {
+		info, _ := TaskInfoFromContext(ctx)
+		infos[info.TaskName] = info
+	}
+	client.On("order.place", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		record(ctx)
+		if _, err := client.Enqueue(ctx, "order.audit", nil); err != nil {
+			return nil, err
+		}
+		return &WorkflowInstruction{Next: "order.ship"}, nil
+	})
+	client.On("order.ship", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		record(ctx)
+		return &WorkflowInstruction{Next: "order.notify"}, nil
+	})
+	for _, name := range []string{"order.audit", "order.notify"} {
+		client.On(name, func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+			record(ctx)
+			return nil, nil
+		})
+	}
+
+	rootID, _ := client.Enqueue(ctx, "order.place", nil)
+	runMembers(t, client, 4)
+
+	root := infos["order.place"]
+	if root.TaskID != rootID || root.RootID != rootID || root.ParentID != "" {
+		t.Errorf("expected the root to be its own root, got %+v", root)
+	}
+	ship := infos["order.ship"]
+	if ship.ParentID != rootID || ship.RootID != rootID {
+		t.Errorf("expected order.ship to descend from the root, got parent %q root %q", ship.ParentID, ship.RootID)
+	}
+	if notify := infos["order.notify"]; notify.ParentID != ship.TaskID || notify.RootID != rootID {
+		t.Errorf("expected order.notify under order.ship, got parent %q root %q", notify.ParentID, notify.RootID)
+	}
+
+	tree, err := client.GetLineage(ctx, rootID)
+	if err != nil {
+		t.Fatalf("GetLineage failed: %v", err)
+	}
+	if tree.TaskID != rootID || tree.TaskName != "order.place" || len(tree.Children) != 2 {
+		t.Fatalf("expected the root with two children, got %+v", tree)
+	}
+	var shipNode *LineageNode
+	for _, child := range tree.Children {
+		if child.TaskName == "order.ship" {
+			shipNode = child
+		}
+	}
+	if shipNode == nil || shipNode.TaskID != ship.TaskID || len(shipNode.Children) != 1 ||
+		shipNode.Children[0].TaskName != "order.notify" {
+		t.Errorf("expected order.notify under order.ship, got %+v", shipNode)
+	}
+	if tree.State != nil {
+		t.Error("expected no state without task tracking")
+	}
+
+	if _, err := client.GetLineage(ctx, "missing"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestLineageAtomicEnqueue(t *testing.T) {
+	client := newIsolatedClient(t, "test-lineage-atomic")
+	ctx := context.Background()
+	client.initConsumerGroups(ctx)
+
+	var ids []string
+	client.On("batch", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		res, err := client.EnqueueAtomic(ctx, []TaskSpec{{TaskName: "item"}, {TaskName: "item"}})
+		if err != nil {
+			return nil, err
+		}
+		ids = res.IDs
+		return nil, nil
+	})
+
+	rootID, _ := client.Enqueue(ctx, "batch", nil)
+	runMembers(t, client, 1)
+
+	tree, err := client.GetLineage(ctx, rootID)
+	if err != nil {
+		t.Fatalf("GetLineage failed: %v", err)
+	}
+	if len(tree.Children) != 2 {
+		t.Fatalf("expected two children, got %d", len(tree.Children))
+	}
+	for _, child := range tree.Children {
+		if child.TaskID != ids[0] && child.TaskID != ids[1] {
+			t.Errorf("expected the child IDs EnqueueAtomic returned %v, got %s", ids, child.TaskID)
+		}
+	}
+}
+
+func TestTrackTasks(t *testing.T) {
+	client := newIsolatedClient(t, "test-track")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.config.TrackTasks = true
+	client.initConsumerGroups(ctx)
+
+	client.On("parent", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{Next: "child"}, nil
+	})
+	client.On("child", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, errors.New("boom")
+	})
+
+	rootID, _ := client.Enqueue(ctx, "parent", nil)
+	runMembers(t, client, 1)
+
+	tree, _ := client.GetLineage(ctx, rootID)
+	if tree.State == nil || tree.State.Status != TaskSucceeded || tree.State.WorkerID != "test-worker" {
+		t.Errorf("expected the root succeeded, got %+v", tree.State)
+	}
+	if child := tree.Children[0]; child.State != nil {
+		t.Errorf("expected no state for a queued child, got %+v", child.State)
+	}
+
+	child := readOne(t, client, stream)
+	client.handleDelivery(ctx, stream, child, 2)
+	state, err := client.GetTaskState(ctx, messageTaskID(child))
+	if err != nil {
+		t.Fatalf("GetTaskState failed: %v", err)
+	}
+	if state.Status != TaskRetrying || state.Error != "boom" || state.Attempt != 2 {
+		t.Errorf("expected the failed attempt recorded, got %+v", state)
+	}
+
+	client.moveToDeadLetter(ctx, PriorityDefault, child)
+	if state, _ := client.GetTaskState(ctx, messageTaskID(child)); state.Status != TaskDeadLettered {
+		t.Errorf("expected the child dead-lettered, got %s", state.Status)
+	}
+	if _, err := client.GetTaskState(ctx, "missing"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("expected ErrTaskNotFound, got %v", err)
+	}
+}
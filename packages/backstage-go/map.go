@@ -0,0 +1,188 @@
+// Package backstage map steps.
+// Runs one task per item of a collection with bounded parallelism and hands
+// their results to a reduce task, on top of groups and chords.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DefaultMapParallelism is how many items of a map step run at once when
+// MapStep.Parallelism is not set.
+const DefaultMapParallelism = 10
+
+// MapStep runs a task for each item of a collection (see
+// WorkflowInstruction.Map).
+type MapStep struct {
+	// TaskName is the task run for each item, with the item as its payload.
+	TaskName string `json:"taskName"`
+	// Items is the collection; it must marshal to a JSON array.
+	Items interface{} `json:"items"`
+	// Options are the options of each item task. Items cannot be delayed,
+	// deduplicated, debounced, throttled or have dependencies.
+	Options EnqueueOptions `json:"options,omitempty"`
+	// Parallelism bounds the items enqueued but not finished yet (default:
+	// DefaultMapParallelism). Each finished item enqueues the next one.
+	Parallelism int `json:"parallelism,omitempty"`
+	// Reduce is the task run once every item has finished, with a
+	// ChordResult carrying ReducePayload and each item's SetResult value.
+	// Optional; it cannot use the options items cannot.
+	Reduce        string         `json:"reduce,omitempty"`
+	ReducePayload interface{}    `json:"reducePayload,omitempty"`
+	ReduceOptions EnqueueOptions `json:"reduceOptions,omitempty"`
+	// OnFailure is the item failure policy (default: GroupFailFast, which
+	// also stops enqueueing the remaining items).
+	OnFailure GroupFailurePolicy `json:"onFailure,omitempty"`
+	// TTL is how long the map's state is kept (default: DefaultGroupTTL).
+	// Items finishing after that no longer enqueue the next ones.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// mapItem is a map item waiting for groupMemberLua to enqueue it.
+type mapItem struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"` // Stream entry without enqueuedAt
+	Entry  string   `json:"entry"`  // Lineage entry, stamped when enqueued
+}
+
+// planMap writes the state of the map step returned by the task info
+// describes, under the task's ID, to plan, along with its first items. The
+// remaining items wait in Redis until running ones finish (see
+// groupMemberLua); they are staged in chunks under a key of their own first,
+// and the plan only renames that list. Nothing becomes visible unless the
+// plan commits, so a redelivered step finds no state left by an earlier
+// attempt; an abandoned staged list expires with the map's TTL. Items and
+// the reduce task join the lineage when they are enqueued.
+func (c *Client) planMap(ctx context.Context, plan *atomicPlan, info *TaskInfo, sagaID string, step *MapStep) error {
+	if sagaID != "" {
+		return errors.New("map steps are not supported in sagas")
+	}
+	if step.TaskName == "" {
+		return errors.New("map step has no task name")
+	}
+	raw, err := json.Marshal(step.Items)
+	if err != nil {
+		return fmt.Errorf("marshal map items: %w", err)
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return fmt.Errorf("map items must be an array: %w", err)
+	}
+	if err := checkOptions("map items", step.Options, ruleWrittenByScript); err != nil {
+		return err
+	}
+	if err := checkOptions("map reduce task", step.ReduceOptions, ruleWrittenByScript); err != nil {
+		return err
+	}
+	policy := step.OnFailure
+	if policy == "" {
+		policy = GroupFailFast
+	}
+	if policy != GroupFailFast && policy != GroupContinue {
+		return fmt.Errorf("unknown group failure policy %q", policy)
+	}
+	parallelism := step.Parallelism
+	if parallelism <= 0 {
+		parallelism = DefaultMapParallelism
+	}
+	ttl := step.TTL
+	if ttl <= 0 {
+		ttl = DefaultGroupTTL
+	}
+
+	id := info.TaskID
+	keys := c.groupKeys(id)
+	state := map[string]string{
+		"total":     strconv.Itoa(len(items)),
+		"policy":    string(policy),
+		"status":    string(GroupPending),
+		"createdAt": strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}
+	if len(items) == 0 {
+		state["status"] = string(GroupCompleted)
+	}
+
+	if step.Reduce != "" {
+		if len(items) == 0 {
+			// Nothing to wait for
+			payload, err := json.Marshal(step.ReducePayload)
+			if err != nil {
+				return fmt.Errorf("marshal reduce payload: %w", err)
+			}
+			reduce, err := c.prepareChild(info, "", NextTask{
+				TaskName: step.Reduce,
+				Payload:  ChordResult{GroupID: id, Payload: payload, Results: []json.RawMessage{}, Failed: []int{}},
+				Options:  step.ReduceOptions,
+			})
+			if err != nil {
+				return fmt.Errorf("reduce task (%s): %w", step.Reduce, err)
+			}
+			plan.add(c, reduce)
+		} else {
+			reduce, err := c.prepareChild(info, "", NextTask{
+				TaskName: step.Reduce,
+				Payload:  step.ReducePayload,
+				Options:  step.ReduceOptions,
+			})
+			if err != nil {
+				return fmt.Errorf("reduce task (%s): %w", step.Reduce, err)
+			}
+			fieldsJSON, _ := json.Marshal(reduce.fields())
+			state["stream"] = reduce.streamKey
+			state["callback"] = string(fieldsJSON)
+			state["callbackId"] = reduce.id
+			state["callbackEntry"] = reduce.lineageEntry()
+		}
+	}
+
+	var waiting []interface{}
+	for i, item := range items {
+		task, err := c.prepareChild(info, "", NextTask{TaskName: step.TaskName, Payload: item, Options: step.Options})
+		if err != nil {
+			return fmt.Errorf("map item %d: %w", i, err)
+		}
+		task.setField("groupId", id)
+		task.setField("groupIndex", i)
+		if i < parallelism {
+			plan.add(c, task)
+			continue
+		}
+		// Enqueued later, so it gets its enqueue time then
+		raw, _ := json.Marshal(mapItem{ID: task.id, Fields: task.fields("enqueuedAt"), Entry: task.lineageEntry()})
+		waiting = append(waiting, string(raw))
+		state["itemStream"] = task.streamKey
+	}
+	if state["itemStream"] != "" || state["callback"] != "" {
+		state["lineage"] = c.lineageKey(info.RootID)
+	}
+
+	if len(waiting) > 0 {
+		token, err := newTaskID()
+		if err != nil {
+			return err
+		}
+		staged := keys[4] + ":staged:" + token
+		pipe := c.redis.Pipeline()
+		for start := 0; start < len(waiting); start += enqueueManyChunk {
+			end := start + enqueueManyChunk
+			if end > len(waiting) {
+				end = len(waiting)
+			}
+			pipe.RPush(ctx, staged, waiting[start:end]...)
+		}
+		pipe.PExpire(ctx, staged, ttl)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("stage map items: %w", err)
+		}
+		plan.rename(staged, keys[4], ttl)
+	}
+	for field, value := range state {
+		plan.hset(keys[0], field, value, false, ttl)
+	}
+	return nil
+}
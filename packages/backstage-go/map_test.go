@@ -0,0 +1,170 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// newMapClient registers "csv.split", mapping "row.double" over rows two at
+// a time and reducing into "csv.sum", which records its payload in got.
+func newMapClient(t *testing.T, prefix string, rows []int, got *ChordResult) *Client {
+	client := newIsolatedClient(t, prefix)
+	client.initConsumerGroups(context.Background())
+
+	client.On("csv.split", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{Map: &MapStep{
+			TaskName:      "row.double",
+			Items:         rows,
+			Parallelism:   2,
+			Reduce:        "csv.sum",
+			ReducePayload: "report",
+		}}, nil
+	})
+	client.On("row.double", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		var row int
+		json.Unmarshal(payload, &row)
+		return nil, SetResult(ctx, row*2)
+	})
+	client.On("csv.sum", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, json.Unmarshal(payload, got)
+	})
+	return client
+}
+
+func TestMapReduce(t *testing.T) {
+	var got ChordResult
+	client := newMapClient(t, "test-map", []int{1, 2, 3, 4, 5}, &got)
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, _ := client.Enqueue(ctx, "csv.split", nil)
+	runMembers(t, client, 1)
+
+	group, err := client.GetGroup(ctx, id)
+	if err != nil {
+		t.Fatalf("GetGroup failed: %v", err)
+	}
+	if group.Total != 5 || group.Waiting != 3 {
+		t.Errorf("expected 2 of 5 items enqueued, got %+v", group)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 3 {
+		t.Errorf("expected the first two items enqueued, stream has %d entries", n-1)
+	}
+	if tree, _ := client.GetLineage(ctx, id); len(tree.Children) != 2 {
+		t.Errorf("expected only the enqueued items in the lineage, got %d children", len(tree.Children))
+	}
+
+	// Each finished item enqueues the next
+	runMembers(t, client, 1)
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 4 {
+		t.Errorf("expected a third item enqueued, stream has %d entries", n-1)
+	}
+	runMembers(t, client, 5) // The other items, then the reduce task
+
+	if got.GroupID != id || string(got.Payload) != `"report"` || len(got.Results) != 5 {
+		t.Fatalf("expected the reduce task to get every result, got %+v", got)
+	}
+	for i, r := range got.Results {
+		if want := []string{"2", "4", "6", "8", "10"}[i]; string(r) != want {
+			t.Errorf("result %d: expected %s, got %s", i, want, r)
+		}
+	}
+	if group, _ := client.GetGroup(ctx, id); group.Status != GroupCompleted || group.Waiting != 0 {
+		t.Errorf("expected a completed map, got %+v", group)
+	}
+
+	tree, _ := client.GetLineage(ctx, id)
+	if len(tree.Children) != 6 {
+		t.Errorf("expected the items and the reduce task in the lineage, got %d children", len(tree.Children))
+	}
+}
+
+func TestMapManyItems(t *testing.T) {
+	rows := make([]int, 3*enqueueManyChunk)
+	var got ChordResult
+	client := newMapClient(t, "test-map-many", rows, &got)
+	ctx := context.Background()
+
+	id, _ := client.Enqueue(ctx, "csv.split", nil)
+	runMembers(t, client, 1)
+
+	group, err := client.GetGroup(ctx, id)
+	if err != nil {
+		t.Fatalf("GetGroup failed: %v", err)
+	}
+	if group.Waiting != len(rows)-2 {
+		t.Errorf("expected %d items waiting, got %+v", len(rows)-2, group)
+	}
+	keys, _ := client.redis.Keys(ctx, client.groupKeys(id)[4]+":staged:*").Result()
+	if len(keys) != 0 {
+		t.Errorf("expected the staged items moved, got %v", keys)
+	}
+}
+
+func TestMapFailFast(t *testing.T) {
+	var got ChordResult
+	client := newMapClient(t, "test-map-fail", []int{1, 2, 3, 4}, &got)
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, _ := client.Enqueue(ctx, "csv.split", nil)
+	runMembers(t, client, 1)
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+	runMembers(t, client, 1)
+
+	group, _ := client.GetGroup(ctx, id)
+	if group.Status != GroupFailed || group.Waiting != 0 {
+		t.Errorf("expected a failed map with no waiting items, got %+v", group)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 3 {
+		t.Errorf("expected no item enqueued after the failure, stream has %d entries", n)
+	}
+}
+
+func TestMapEmpty(t *testing.T) {
+	var got ChordResult
+	client := newMapClient(t, "test-map-empty", []int{}, &got)
+	ctx := context.Background()
+
+	id, _ := client.Enqueue(ctx, "csv.split", nil)
+	runMembers(t, client, 2)
+
+	if got.GroupID != id || len(got.Results) != 0 {
+		t.Errorf("expected the reduce task to run at once, got %+v", got)
+	}
+	if group, _ := client.GetGroup(ctx, id); group.Status != GroupCompleted {
+		t.Errorf("expected a completed map, got %+v", group)
+	}
+}
+
+func TestMapWrittenWithAck(t *testing.T) {
+	client := newIsolatedClient(t, "test-map-atomic")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+	client.On("csv.split", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{Map: &MapStep{
+			TaskName:    "row.double",
+			Items:       []int{1, 2, 3},
+			Options:     EnqueueOptions{Queue: "rows"},
+			Parallelism: 1,
+			Reduce:      "csv.sum",
+		}}, nil
+	})
+
+	// The first item cannot be written, so the plan fails
+	client.redis.Set(ctx, "test-map-atomic:rows", "x", 0)
+	id, _ := client.Enqueue(ctx, "csv.split", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if _, err := client.GetGroup(ctx, id); err != ErrGroupNotFound {
+		t.Errorf("expected no map state without the ACK, got %v", err)
+	}
+	if n, _ := client.redis.Exists(ctx, client.groupKeys(id)[4], client.lineageKey(id)).Result(); n != 0 {
+		t.Errorf("expected no waiting items or lineage without the ACK, %d keys exist", n)
+	}
+	if pending, _ := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Result(); pending.Count != 1 {
+		t.Errorf("expected the step left pending, got %d pending", pending.Count)
+	}
+}
@@ -0,0 +1,240 @@
+// Package backstage transactional outbox.
+// Lets applications enqueue tasks in the same database transaction as their
+// business writes; a relay publishes committed rows to Redis afterwards.
+package backstage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// OutboxSchema is a portable definition of the outbox table. Adjust the types
+// to your database if needed; the column names are what Outbox relies on.
+const OutboxSchema = `CREATE TABLE backstage_outbox (
+    id         VARCHAR(64)  PRIMARY KEY,
+    task_name  VARCHAR(255) NOT NULL,
+    payload    TEXT         NOT NULL,
+    options    TEXT         NOT NULL,
+    created_at BIGINT       NOT NULL,
+    sent_at    BIGINT
+)`
+
+// OutboxConfig configures an Outbox.
+type OutboxConfig struct {
+	// Table is the outbox table name (default: "backstage_outbox").
+	Table string
+	// Placeholder formats the n-th (1-based) bind parameter. Defaults to
+	// QuestionPlaceholder; use DollarPlaceholder for PostgreSQL.
+	Placeholder func(n int) string
+	// LockClause is appended to the relay's SELECT, e.g.
+	// "FOR UPDATE SKIP LOCKED" so several relays can run concurrently.
+	// Leave empty when a single relay runs.
+	LockClause string
+	// BatchSize is the maximum number of rows relayed per transaction
+	// (default: 100).
+	BatchSize int
+	// PollInterval is how long Run waits when the outbox is empty
+	// (default: 1 second).
+	PollInterval time.Duration
+	// DedupeTTL is how long a relayed row's dedupe key is held, which bounds
+	// the window in which a row re-sent after a crash is recognised
+	// (default: 24 hours).
+	DedupeTTL time.Duration
+}
+
+// QuestionPlaceholder formats bind parameters as "?" (MySQL, SQLite).
+func QuestionPlaceholder(n int) string { return "?" }
+
+// DollarPlaceholder formats bind parameters as "$n" (PostgreSQL).
+func DollarPlaceholder(n int) string { return fmt.Sprintf("$%d", n) }
+
+// Outbox writes tasks to a database table inside application transactions
+// and relays them to Redis once committed.
+type Outbox struct {
+	db     *sql.DB
+	client *Client
+	cfg    OutboxConfig
+	logger *Logger
+}
+
+// NewOutbox creates an outbox on db that publishes through client.
+func NewOutbox(db *sql.DB, client *Client, cfg OutboxConfig) *Outbox {
+	if cfg.Table == "" {
+		cfg.Table = "backstage_outbox"
+	}
+	if cfg.Placeholder == nil {
+		cfg.Placeholder = QuestionPlaceholder
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.DedupeTTL <= 0 {
+		cfg.DedupeTTL = 24 * time.Hour
+	}
+
+	return &Outbox{
+		db:     db,
+		client: client,
+		cfg:    cfg,
+		logger: NewLogger("Outbox"),
+	}
+}
+
+// EnqueueTx records a task in the outbox as part of tx. The task is only
+// published if tx commits, and is then enqueued with opts by the relay.
+// Options Enqueue would refuse are refused here, before the row is written.
+// Returns the outbox row ID.
+func (o *Outbox) EnqueueTx(ctx context.Context, tx *sql.Tx, taskName string, payload interface{}, opts ...EnqueueOptions) (string, error) {
+	var opt EnqueueOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("marshal payload: %w", err)
+	}
+	relayed := opt // As the relay will enqueue it
+	o.addDedupe("", &relayed)
+	if _, err := o.client.prepareTask(taskName, json.RawMessage(payloadBytes), relayed); err != nil {
+		return "", err
+	}
+	optBytes, err := json.Marshal(opt)
+	if err != nil {
+		return "", fmt.Errorf("marshal options: %w", err)
+	}
+
+	// IDs start with the creation time so rows created in the same
+	// millisecond are still relayed in order.
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("generate outbox id: %w", err)
+	}
+	now := time.Now()
+	id := fmt.Sprintf("%016x%s", now.UnixNano(), hex.EncodeToString(raw[:]))
+
+	p := o.cfg.Placeholder
+	query := fmt.Sprintf("INSERT INTO %s (id, task_name, payload, options, created_at) VALUES (%s, %s, %s, %s, %s)",
+		o.cfg.Table, p(1), p(2), p(3), p(4), p(5))
+	if _, err := tx.ExecContext(ctx, query, id, taskName, string(payloadBytes), string(optBytes), now.UnixMilli()); err != nil {
+		return "", fmt.Errorf("insert outbox row: %w", err)
+	}
+	return id, nil
+}
+
+// RelayOnce publishes up to BatchSize unsent rows, oldest first, and marks
+// them sent in the same database transaction. Each row is enqueued with a
+// dedupe key derived from its ID (see addDedupe), so a row published again
+// after a crash between the enqueue and the commit is not enqueued twice.
+// Rows whose options cannot be decoded or are refused by Enqueue are logged
+// and marked sent without being enqueued. Returns the number of rows
+// relayed.
+func (o *Outbox) RelayOnce(ctx context.Context) (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("SELECT id, task_name, payload, options FROM %s WHERE sent_at IS NULL ORDER BY created_at, id LIMIT %d",
+		o.cfg.Table, o.cfg.BatchSize)
+	if o.cfg.LockClause != "" {
+		query += " " + o.cfg.LockClause
+	}
+
+	type outboxRow struct {
+		id, taskName, payload, options string
+	}
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("select outbox rows: %w", err)
+	}
+	var batch []outboxRow
+	for rows.Next() {
+		var r outboxRow
+		if err := rows.Scan(&r.id, &r.taskName, &r.payload, &r.options); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan outbox row: %w", err)
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("select outbox rows: %w", err)
+	}
+
+	p := o.cfg.Placeholder
+	update := fmt.Sprintf("UPDATE %s SET sent_at = %s WHERE id = %s", o.cfg.Table, p(1), p(2))
+
+	relayed := 0
+	for _, r := range batch {
+		var opt EnqueueOptions
+		err := json.Unmarshal([]byte(r.options), &opt)
+		if err == nil {
+			o.addDedupe(r.id, &opt)
+			_, err = o.client.prepareTask(r.taskName, json.RawMessage(r.payload), opt)
+		}
+		if err != nil {
+			// Retrying cannot fix the row; mark it so it stops heading the batch.
+			o.logger.Error("Dropping outbox row with invalid options", "id", r.id, "error", err)
+			if _, err := tx.ExecContext(ctx, update, time.Now().UnixMilli(), r.id); err != nil {
+				return 0, fmt.Errorf("mark outbox row sent: %w", err)
+			}
+			continue
+		}
+
+		if _, err := o.client.Enqueue(ctx, r.taskName, json.RawMessage(r.payload), opt); err != nil {
+			// Keep what was relayed so far; the rest is retried next time.
+			o.logger.Error("Failed to relay outbox row", "id", r.id, "error", err)
+			break
+		}
+		if _, err := tx.ExecContext(ctx, update, time.Now().UnixMilli(), r.id); err != nil {
+			return 0, fmt.Errorf("mark outbox row sent: %w", err)
+		}
+		relayed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return relayed, nil
+}
+
+// addDedupe gives opt the dedupe key of the row with the given ID, unless
+// it carries its own. Debounced, throttled and dependent tasks cannot be
+// deduplicated, so they are relayed without one.
+func (o *Outbox) addDedupe(id string, opt *EnqueueOptions) {
+	if opt.Dedupe != nil || checkOptions("", *opt, ruleDebounce|ruleThrottle|ruleDependencies) != nil {
+		return
+	}
+	opt.Dedupe = &DedupeConfig{Key: "outbox:" + id, TTL: o.cfg.DedupeTTL}
+}
+
+// Run relays the outbox until ctx is cancelled, polling every PollInterval
+// while it is empty.
+func (o *Outbox) Run(ctx context.Context) error {
+	for {
+		n, err := o.RelayOnce(ctx)
+		if err != nil {
+			o.logger.Error("Outbox relay failed", "error", err)
+		}
+
+		if n < o.cfg.BatchSize {
+			select {
+			case <-time.After(o.cfg.PollInterval):
+			case <-ctx.Done():
+				return nil
+			}
+		} else if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
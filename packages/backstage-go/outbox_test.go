@@ -0,0 +1,328 @@
+package backstage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOutboxDB is an in-memory database/sql driver that understands exactly
+// the statements Outbox issues. Transactions work on a copy of the table that
+// replaces it on commit.
+type fakeOutboxDB struct {
+	mu   sync.Mutex
+	rows map[string]fakeOutboxRow
+}
+
+type fakeOutboxRow struct {
+	id, taskName, payload, options string
+	createdAt                      int64
+	sentAt                         *int64
+}
+
+var (
+	fakeOutboxMu  sync.Mutex
+	fakeOutboxDBs = map[string]*fakeOutboxDB{}
+)
+
+func init() {
+	sql.Register("backstage-fake", fakeOutboxDriver{})
+}
+
+// openFakeOutboxDB returns a fresh database and its backing store.
+func openFakeOutboxDB(t *testing.T) (*sql.DB, *fakeOutboxDB) {
+	t.Helper()
+	store := &fakeOutboxDB{rows: map[string]fakeOutboxRow{}}
+	fakeOutboxMu.Lock()
+	fakeOutboxDBs[t.Name()] = store
+	fakeOutboxMu.Unlock()
+
+	db, err := sql.Open("backstage-fake", t.Name())
+	if err != nil {
+		t.Fatalf("open fake db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, store
+}
+
+func (s *fakeOutboxDB) unsent() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, r := range s.rows {
+		if r.sentAt == nil {
+			n++
+		}
+	}
+	return n
+}
+
+type fakeOutboxDriver struct{}
+
+func (fakeOutboxDriver) Open(name string) (driver.Conn, error) {
+	fakeOutboxMu.Lock()
+	defer fakeOutboxMu.Unlock()
+	store, ok := fakeOutboxDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake db %q", name)
+	}
+	return &fakeOutboxConn{store: store}, nil
+}
+
+type fakeOutboxConn struct {
+	store *fakeOutboxDB
+	tx    map[string]fakeOutboxRow // Working copy while a transaction is open
+}
+
+func (c *fakeOutboxConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeOutboxStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeOutboxConn) Close() error { return nil }
+
+func (c *fakeOutboxConn) Begin() (driver.Tx, error) {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.tx = make(map[string]fakeOutboxRow, len(c.store.rows))
+	for k, v := range c.store.rows {
+		c.tx[k] = v
+	}
+	return c, nil
+}
+
+func (c *fakeOutboxConn) Commit() error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.rows, c.tx = c.tx, nil
+	return nil
+}
+
+func (c *fakeOutboxConn) Rollback() error {
+	c.tx = nil
+	return nil
+}
+
+type fakeOutboxStmt struct {
+	conn  *fakeOutboxConn
+	query string
+}
+
+func (s *fakeOutboxStmt) Close() error  { return nil }
+func (s *fakeOutboxStmt) NumInput() int { return -1 }
+
+func (s *fakeOutboxStmt) Exec(args []driver.Value) (driver.Result, error) {
+	rows := s.conn.tx
+	if rows == nil {
+		return nil, errors.New("fake db only supports statements inside transactions")
+	}
+
+	switch {
+	case strings.HasPrefix(s.query, "INSERT INTO"):
+		id := args[0].(string)
+		rows[id] = fakeOutboxRow{
+			id:        id,
+			taskName:  args[1].(string),
+			payload:   args[2].(string),
+			options:   args[3].(string),
+			createdAt: args[4].(int64),
+		}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		id := args[1].(string)
+		r, ok := rows[id]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		sentAt := args[0].(int64)
+		r.sentAt = &sentAt
+		rows[id] = r
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unsupported exec: %s", s.query)
+}
+
+func (s *fakeOutboxStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(s.query, "SELECT") || s.conn.tx == nil {
+		return nil, fmt.Errorf("unsupported query: %s", s.query)
+	}
+
+	var limit int
+	fmt.Sscanf(s.query[strings.Index(s.query, "LIMIT"):], "LIMIT %d", &limit)
+
+	var out []fakeOutboxRow
+	for _, r := range s.conn.tx {
+		if r.sentAt == nil {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].createdAt != out[j].createdAt {
+			return out[i].createdAt < out[j].createdAt
+		}
+		return out[i].id < out[j].id
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return &fakeOutboxRows{rows: out}, nil
+}
+
+type fakeOutboxRows struct {
+	rows []fakeOutboxRow
+	pos  int
+}
+
+func (r *fakeOutboxRows) Columns() []string {
+	return []string{"id", "task_name", "payload", "options"}
+}
+
+func (r *fakeOutboxRows) Close() error { return nil }
+
+func (r *fakeOutboxRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	row := r.rows[r.pos]
+	r.pos++
+	dest[0], dest[1], dest[2], dest[3] = row.id, row.taskName, row.payload, row.options
+	return nil
+}
+
+func TestOutboxRelaysCommittedRows(t *testing.T) {
+	client := newIsolatedClient(t, "test-outbox")
+	db, store := openFakeOutboxDB(t)
+	ctx := context.Background()
+	outbox := NewOutbox(db, client, OutboxConfig{BatchSize: 2})
+
+	// Committed: relayed
+	tx, _ := db.BeginTx(ctx, nil)
+	for i := 0; i < 3; i++ {
+		if _, err := outbox.EnqueueTx(ctx, tx, "invoice.send", map[string]int{"n": i}, EnqueueOptions{Queue: "billing"}); err != nil {
+			t.Fatalf("EnqueueTx failed: %v", err)
+		}
+	}
+	tx.Commit()
+
+	// Rolled back: never relayed
+	tx, _ = db.BeginTx(ctx, nil)
+	outbox.EnqueueTx(ctx, tx, "invoice.send", map[string]int{"n": 99})
+	tx.Rollback()
+
+	if n, err := outbox.RelayOnce(ctx); err != nil || n != 2 {
+		t.Fatalf("first relay: expected 2 rows, got %d (%v)", n, err)
+	}
+	if n, err := outbox.RelayOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("second relay: expected 1 row, got %d (%v)", n, err)
+	}
+	if n, _ := outbox.RelayOnce(ctx); n != 0 {
+		t.Errorf("expected outbox to be drained, relayed %d more", n)
+	}
+
+	if store.unsent() != 0 {
+		t.Errorf("expected every row marked sent, %d left", store.unsent())
+	}
+	msgs, _ := client.redis.XRange(ctx, client.config.Prefix+":billing", "-", "+").Result()
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 relayed tasks, got %d", len(msgs))
+	}
+	if msgs[0].Values["payload"] != `{"n":0}` {
+		t.Errorf("expected rows relayed in order with their payload, got %v", msgs[0].Values["payload"])
+	}
+}
+
+func TestOutboxRelayIsIdempotent(t *testing.T) {
+	client := newIsolatedClient(t, "test-outbox-idempotent")
+	db, store := openFakeOutboxDB(t)
+	ctx := context.Background()
+	outbox := NewOutbox(db, client, OutboxConfig{})
+
+	tx, _ := db.BeginTx(ctx, nil)
+	id, _ := outbox.EnqueueTx(ctx, tx, "invoice.send", nil)
+	tx.Commit()
+
+	// Simulate a relay that published the row but crashed before marking it sent
+	row := store.rows[id]
+	client.Enqueue(ctx, row.taskName, nil, EnqueueOptions{
+		Dedupe: &DedupeConfig{Key: "outbox:" + id, TTL: time.Hour},
+	})
+
+	if n, err := outbox.RelayOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("expected the row to be relayed, got %d (%v)", n, err)
+	}
+	if l := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); l != 1 {
+		t.Errorf("expected the task to be enqueued once, got %d", l)
+	}
+	if store.unsent() != 0 {
+		t.Error("expected the row to be marked sent")
+	}
+}
+
+func TestOutboxDropsInvalidOptions(t *testing.T) {
+	client := newIsolatedClient(t, "test-outbox-invalid")
+	db, store := openFakeOutboxDB(t)
+	ctx := context.Background()
+	outbox := NewOutbox(db, client, OutboxConfig{BatchSize: 1})
+
+	tx, _ := db.BeginTx(ctx, nil)
+	bad, _ := outbox.EnqueueTx(ctx, tx, "invoice.send", nil)
+	outbox.EnqueueTx(ctx, tx, "invoice.send", nil)
+	tx.Commit()
+
+	row := store.rows[bad]
+	row.options = "{not json"
+	store.rows[bad] = row
+
+	if n, err := outbox.RelayOnce(ctx); err != nil || n != 0 {
+		t.Fatalf("expected the invalid row to be dropped, got %d (%v)", n, err)
+	}
+	if n, err := outbox.RelayOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("expected the next row to be relayed, got %d (%v)", n, err)
+	}
+	if store.unsent() != 0 {
+		t.Errorf("expected both rows marked, %d left", store.unsent())
+	}
+	if l := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); l != 1 {
+		t.Errorf("expected only the valid row enqueued, got %d", l)
+	}
+}
+
+func TestOutboxRateLimitedRows(t *testing.T) {
+	client := newIsolatedClient(t, "test-outbox-limited")
+	db, store := openFakeOutboxDB(t)
+	ctx := context.Background()
+	outbox := NewOutbox(db, client, OutboxConfig{})
+
+	// Debounced tasks cannot be deduplicated, so the relay adds no key
+	tx, _ := db.BeginTx(ctx, nil)
+	if _, err := outbox.EnqueueTx(ctx, tx, "search.reindex", nil, EnqueueOptions{Debounce: &DebounceConfig{Key: "k", Wait: time.Minute}}); err != nil {
+		t.Fatalf("EnqueueTx failed: %v", err)
+	}
+	outbox.EnqueueTx(ctx, tx, "invoice.send", nil)
+
+	// Options Enqueue refuses are refused when written
+	if _, err := outbox.EnqueueTx(ctx, tx, "invoice.send", nil, EnqueueOptions{Dedupe: &DedupeConfig{Mode: "bogus"}}); err == nil {
+		t.Error("expected invalid options refused by EnqueueTx")
+	}
+	tx.Commit()
+
+	if n, err := outbox.RelayOnce(ctx); err != nil || n != 2 || store.unsent() != 0 {
+		t.Fatalf("expected both rows relayed, got %d (%v), %d unsent", n, err, store.unsent())
+	}
+	if n := client.redis.ZCard(ctx, client.scheduledKey()).Val(); n != 1 {
+		t.Errorf("expected the debounced task scheduled, got %d", n)
+	}
+}
+
+func TestOutboxPlaceholders(t *testing.T) {
+	if QuestionPlaceholder(3) != "?" || DollarPlaceholder(3) != "$3" {
+		t.Error("unexpected placeholder formatting")
+	}
+}
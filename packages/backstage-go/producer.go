@@ -4,8 +4,11 @@ package backstage
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -28,8 +31,16 @@ type BackoffConfig struct {
 
 // DedupeConfig defines deduplication settings.
 type DedupeConfig struct {
-	Key string        // Unique key for this job instance
+	Key string        // Unique key for this job instance (default: hash of task name and payload)
 	TTL time.Duration // Deduplication window (default: 1 hour)
+	// Mode controls when the lock is released (default: DedupeWindow). For
+	// delayed tasks held until started or completed, TTL counts from when
+	// the task becomes due.
+	Mode DedupeMode
+	// Replace makes a new task replace the holder of the lock instead of
+	// being skipped, as long as the holder is still scheduled. If the holder
+	// already reached its stream, the new task is skipped as usual.
+	Replace bool
 }
 
 // EnqueueOptions configuration for task enqueueing.
@@ -40,45 +51,131 @@ type EnqueueOptions struct {
 	Queue    string
 	// Delay specifies how long to wait before the task becomes available for processing.
 	Delay    time.Duration
+	// ProcessAt is the absolute time at which the task becomes available for
+	// processing. It takes precedence over Delay; a time in the past enqueues
+	// the task immediately.
+	ProcessAt time.Time
 	// Dedupe configuration prevents duplicate tasks from being enqueued within a window.
 	Dedupe   *DedupeConfig
-	// Attempts is the maximum number of times the task will be retried if it fails.
+	// Attempts is the maximum number of times the task is delivered, its first
+	// run included: after that many deliveries the reclaimer dead-letters it.
+	// When set, it replaces ConsumerConfig.MaxDeliveries as the task's
+	// dead-letter limit.
 	Attempts int
 	// Backoff configuration for retry delays.
 	Backoff  *BackoffConfig
 	// Timeout is the maximum execution time for the handler.
 	Timeout  time.Duration
+	// ExpiresAt is when the task becomes worthless: past it, the task is
+	// discarded instead of run (see Config.ExpiredTasks).
+	ExpiresAt time.Time
+	// TTL sets ExpiresAt relative to the enqueue time. Ignored if ExpiresAt
+	// is set.
+	TTL time.Duration
+	// Headers carry metadata such as correlation or tenant IDs alongside the
+	// payload. Handlers read them with HeadersFromContext; they are copied
+	// onto chained tasks and kept when the task is dead-lettered.
+	Headers map[string]string
+	// Idempotency opts the task into consumer-side idempotency, so a
+	// redelivery after a successful run is acknowledged without re-running
+	// the handler.
+	Idempotency *IdempotencyConfig
+	// Debounce delays the task until no other task with the same key was
+	// enqueued for a while; only the latest payload runs. Overrides Delay
+	// and ProcessAt.
+	Debounce *DebounceConfig
+	// Throttle runs tasks with the same key at most once per window.
+	Throttle *ThrottleConfig
+	// WorkflowTimeout bounds the whole workflow this task starts: past it,
+	// the task and every task descending from it are cancelled (see
+	// CancelWorkflow). Descendants inherit the earliest deadline.
+	WorkflowTimeout time.Duration
+	// DependsOn parks the task until every listed task (by the ID Enqueue
+	// returned) has succeeded; it is then released into its queue. Such
+	// tasks cannot be delayed, deduplicated, debounced or throttled, and
+	// require Config.TaskDependencies. A task still parked after 7 days is
+	// dropped without a trace.
+	DependsOn []string
+	// OnDependencyFailure is what happens to the task if a dependency fails
+	// (default: DependencyDeadLetter).
+	OnDependencyFailure DependencyFailurePolicy
 }
 
-// Enqueue adds a task to the queue.
-// It supports priority levels, custom queues, delayed scheduling, deduplication,
-// and execution options like retries and timeouts.
-//
-// Returns the message ID if successful, or an empty string if the task was
-// deduplicated (skipped).
-func (c *Client) Enqueue(ctx context.Context, taskName string, payload interface{}, opts ...EnqueueOptions) (string, error) {
-	var opt EnqueueOptions
-	if len(opts) > 0 {
-		opt = opts[0]
+// preparedTask is a task encoded and ready to be written to Redis.
+type preparedTask struct {
+	streamKey string
+	values    map[string]interface{} // Stream entry fields
+	executeAt int64                  // Due time in ms for delayed tasks, 0 otherwise
+	member    string                 // Scheduled ZSET member for delayed tasks
+	id        string                 // Task ID for delayed tasks
+	dedupeKey string
+	dedupeTTL time.Duration
+	token     string // Value of the dedupe lock while this task holds it
+	replace   bool
+	debounce  *DebounceConfig
+	throttle  *ThrottleConfig
+	lineage   *lineage // Set for tasks enqueued by another task
+	dependsOn []string                // Task IDs the task is parked on
+	depPolicy DependencyFailurePolicy // What a failed dependency does to it
+}
+
+// optionRule is an enqueue option that a kind of task cannot use (see
+// checkOptions).
+type optionRule int
+
+const (
+	ruleDelay optionRule = 1 << iota // Delay and ProcessAt
+	ruleDedupe
+	ruleDebounce
+	ruleThrottle
+	ruleDependencies
+
+	// ruleWrittenByScript rejects every option that keeps a task from being
+	// written as is, which tasks written by a Lua script cannot use.
+	ruleWrittenByScript = ruleDelay | ruleDedupe | ruleDebounce | ruleThrottle | ruleDependencies
+)
+
+// checkOptions returns an error if opt uses an option that rules forbid to
+// what, such as "saga steps".
+func checkOptions(what string, opt EnqueueOptions, rules optionRule) error {
+	used := (rules&ruleDelay != 0 && (opt.Delay > 0 || !opt.ProcessAt.IsZero())) ||
+		(rules&ruleDedupe != 0 && opt.Dedupe != nil) ||
+		(rules&ruleDebounce != 0 && opt.Debounce != nil) ||
+		(rules&ruleThrottle != 0 && opt.Throttle != nil) ||
+		(rules&ruleDependencies != 0 && len(opt.DependsOn) > 0)
+	if !used {
+		return nil
 	}
 
-	// Handle deduplication
-	// Handle deduplication
-	if opt.Dedupe != nil {
-		dedupeKey := fmt.Sprintf("%s:dedupe:%s", c.config.Prefix, opt.Dedupe.Key)
-		ttl := opt.Dedupe.TTL
-		if ttl == 0 {
-			ttl = time.Hour // Default 1 hour
-		}
-		set, err := c.redis.SetNX(ctx, dedupeKey, "1", ttl).Result()
-		if err != nil {
-			return "", fmt.Errorf("dedupe setnx: %w", err)
-		}
-		if !set {
-			return "", nil // Duplicate, skip
+	var forbidden []string
+	for _, r := range []struct {
+		rule optionRule
+		verb string
+	}{
+		{ruleDelay, "delayed"},
+		{ruleDedupe, "deduplicated"},
+		{ruleDebounce, "debounced"},
+		{ruleThrottle, "throttled"},
+	} {
+		if rules&r.rule != 0 {
+			forbidden = append(forbidden, r.verb)
 		}
 	}
+	if len(forbidden) > 0 {
+		forbidden[0] = "be " + forbidden[0]
+	}
+	if rules&ruleDependencies != 0 {
+		forbidden = append(forbidden, "have dependencies")
+	}
+	list := forbidden[len(forbidden)-1]
+	if n := len(forbidden); n > 1 {
+		list = strings.Join(forbidden[:n-1], ", ") + " or " + list
+	}
+	return fmt.Errorf("%s cannot %s", what, list)
+}
 
+// prepareTask resolves the target stream and encodes the task's fields.
+func (c *Client) prepareTask(taskName string, payload interface{}, opt EnqueueOptions) (*preparedTask, error) {
 	// Determine stream key
 	var streamKey string
 	if opt.Queue != "" {
@@ -90,10 +187,13 @@ func (c *Client) Enqueue(ctx context.Context, taskName string, payload interface
 		}
 		streamKey = c.streamKey(priority)
 	}
+	if err := c.checkLimit(streamKey); err != nil {
+		return nil, err
+	}
 
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("marshal payload: %w", err)
+		return nil, fmt.Errorf("marshal payload: %w", err)
 	}
 
 	enqueuedAt := time.Now().UnixMilli()
@@ -114,52 +214,277 @@ func (c *Client) Enqueue(ctx context.Context, taskName string, payload interface
 	if opt.Timeout > 0 {
 		values["timeout"] = opt.Timeout.Milliseconds()
 	}
+	if opt.Idempotency != nil {
+		setIdempotencyFields(values, opt.Idempotency)
+	}
+	if len(opt.Headers) > 0 {
+		headersJSON, err := json.Marshal(opt.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("marshal headers: %w", err)
+		}
+		values["headers"] = string(headersJSON)
+	}
+	if !opt.ExpiresAt.IsZero() {
+		values["expiresAt"] = opt.ExpiresAt.UnixMilli()
+	} else if opt.TTL > 0 {
+		values["expiresAt"] = enqueuedAt + opt.TTL.Milliseconds()
+	}
+	if opt.WorkflowTimeout > 0 {
+		values["workflowDeadline"] = enqueuedAt + opt.WorkflowTimeout.Milliseconds()
+	}
 
-	if opt.Delay > 0 {
-		// Scheduled task
-		executeAt := float64(time.Now().Add(opt.Delay).UnixMilli())
-		scheduledData := map[string]interface{}{
-			"taskName":   taskName,
-			"payload":    string(payloadBytes),
-			"enqueuedAt": enqueuedAt,
-			"streamKey":  streamKey,
+	task := &preparedTask{streamKey: streamKey, values: values}
+
+	if err := validateRateLimits(opt); err != nil {
+		return nil, err
+	}
+	if err := c.validateDependencies(opt); err != nil {
+		return nil, err
+	}
+	task.debounce = opt.Debounce
+	task.throttle = opt.Throttle
+
+	var executeAt time.Time
+	if opt.Debounce != nil {
+		executeAt = time.Now().Add(opt.Debounce.Wait)
+	} else if !opt.ProcessAt.IsZero() {
+		executeAt = opt.ProcessAt
+	} else if opt.Delay > 0 {
+		executeAt = time.Now().Add(opt.Delay)
+	}
+	scheduled := executeAt.After(time.Now())
+	if scheduled || opt.Throttle != nil {
+		// The task ID is copied onto the stream entry, so it stays valid
+		// after the move.
+		if task.id, err = newTaskID(); err != nil {
+			return nil, err
+		}
+		if scheduled {
+			task.executeAt = executeAt.UnixMilli()
+		}
+	}
+
+	if opt.Dedupe != nil {
+		if !validDedupeMode(opt.Dedupe.Mode) {
+			return nil, fmt.Errorf("unknown dedupe mode %q", opt.Dedupe.Mode)
+		}
+		task.dedupeKey = c.dedupeKeyFor(opt.Dedupe, taskName, payloadBytes)
+		task.dedupeTTL = opt.Dedupe.TTL
+		if task.dedupeTTL == 0 {
+			task.dedupeTTL = time.Hour // Default 1 hour
+		}
+		task.replace = opt.Dedupe.Replace
+
+		// The lock holds the scheduled task ID, so Replace can find it
+		task.token = task.id
+		if task.token == "" {
+			if task.token, err = newTaskID(); err != nil {
+				return nil, err
+			}
+		}
+
+		if mode := opt.Dedupe.Mode; mode != "" && mode != DedupeWindow {
+			if scheduled {
+				task.dedupeTTL += time.Until(executeAt)
+			}
+			values["dedupeKey"] = task.dedupeKey
+			values["dedupeMode"] = string(mode)
+			values["dedupeToken"] = task.token
+		}
+	}
+
+	if task.id != "" {
+		// Scheduled task (or a throttled one that may be deferred): carries
+		// the same fields as the stream entry, plus where to put it once it
+		// becomes due.
+		id := task.id
+		scheduledData := make(map[string]interface{}, len(values)+3)
+		for k, v := range values {
+			scheduledData[k] = v
 		}
+		scheduledData["taskId"] = id
+		scheduledData["streamKey"] = streamKey
 		if opt.Priority != "" {
 			scheduledData["priority"] = opt.Priority
 		}
-		if opt.Attempts > 0 {
-			scheduledData["attempts"] = opt.Attempts
+		if c.config.TaskDependencies {
+			// Tasks may depend on it, so it must reach a consumer to expire
+			scheduledData["recordOutcome"] = 1
 		}
-		if opt.Backoff != nil {
-			backoffJSON, _ := json.Marshal(opt.Backoff)
-			scheduledData["backoff"] = string(backoffJSON)
+
+		data, _ := json.Marshal(scheduledData)
+		task.member = string(data)
+	}
+
+	if len(opt.DependsOn) > 0 {
+		// Released by a script, so the task ID is assigned now
+		if task.id, err = newTaskID(); err != nil {
+			return nil, err
 		}
-		if opt.Timeout > 0 {
-			scheduledData["timeout"] = opt.Timeout.Milliseconds()
+		values["taskId"] = task.id
+		task.dependsOn = opt.DependsOn
+		task.depPolicy = opt.OnDependencyFailure
+		if task.depPolicy == "" {
+			task.depPolicy = DependencyDeadLetter
 		}
+	}
 
-		data, _ := json.Marshal(scheduledData)
-		err := c.redis.ZAdd(ctx, c.scheduledKey(), redis.Z{
-			Score:  executeAt,
-			Member: string(data),
-		}).Err()
-		if err != nil {
-			return "", fmt.Errorf("zadd scheduled: %w", err)
+	return task, nil
+}
+
+// setField adds a field to the task's stream entry, and to its scheduled
+// member if it has one.
+func (task *preparedTask) setField(key string, value interface{}) {
+	task.values[key] = value
+	if task.member == "" {
+		return
+	}
+	var data map[string]interface{}
+	json.Unmarshal([]byte(task.member), &data)
+	data[key] = value
+	member, _ := json.Marshal(data)
+	task.member = string(member)
+}
+
+// fields returns the task's stream entry as a flat field/value list, without
+// the omitted fields, for scripts that write it later.
+func (task *preparedTask) fields(omit ...string) []string {
+	fields := make([]string, 0, 2*len(task.values))
+next:
+	for k, v := range task.values {
+		for _, o := range omit {
+			if k == o {
+				continue next
+			}
 		}
+		fields = append(fields, k, fmt.Sprint(v))
+	}
+	return fields
+}
 
-		return fmt.Sprintf("scheduled:%d", int64(executeAt)), nil
+// newTaskID returns a random ID for a scheduled task (or a dedupe token).
+func newTaskID() (string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("generate task id: %w", err)
 	}
+	return hex.EncodeToString(raw[:]), nil
+}
 
-	// Immediate task
-	result, err := c.redis.XAdd(ctx, &redis.XAddArgs{
-		Stream: streamKey,
-		Values: values,
-	}).Result()
+// write queues the commands storing the task on pipe: an index entry and a
+// ZADD for delayed tasks, an XADD otherwise, plus its lineage entry if it has
+// a parent. Returns the command whose result identifies the task.
+func (c *Client) write(ctx context.Context, pipe redis.Pipeliner, task *preparedTask) redis.Cmder {
+	if task.lineage != nil {
+		c.recordLineage(ctx, pipe, task)
+	}
+	if task.executeAt > 0 {
+		pipe.HSet(ctx, c.scheduledIndexKey(), task.id, task.member)
+		return pipe.ZAdd(ctx, c.scheduledKey(), redis.Z{
+			Score:  float64(task.executeAt),
+			Member: task.member,
+		})
+	}
+	cmd := pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: task.streamKey,
+		Values: task.values,
+	})
+	c.capLength(ctx, pipe, task.streamKey)
+	return cmd
+}
+
+// taskID returns the ID reported to the caller for a written task.
+func (task *preparedTask) taskID(cmd redis.Cmder) string {
+	if task.id != "" {
+		return task.id
+	}
+	return cmd.(*redis.StringCmd).Val()
+}
+
+// Enqueue adds a task to the queue.
+// It supports priority levels, custom queues, delayed scheduling, deduplication,
+// and execution options like retries and timeouts.
+//
+// Returns the task ID if successful, or an empty string if the task was
+// deduplicated or dropped by its throttle (skipped). For immediate tasks this is the stream message ID;
+// delayed tasks get a unique ID that can be passed to Reschedule and that
+// stays the task's ID (see TaskInfo.TaskID) once it reaches its stream.
+// Throttled tasks get one too, whether they run at once or are deferred.
+// Tasks enqueued from a handler (ctx is the handler's context) get a unique
+// ID too, and record the running task as their parent (see GetLineage), as
+// do tasks with dependencies (see EnqueueOptions.DependsOn).
+func (c *Client) Enqueue(ctx context.Context, taskName string, payload interface{}, opts ...EnqueueOptions) (string, error) {
+	var opt EnqueueOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	task, err := c.prepareIn(ctx, taskName, payload, opt)
 	if err != nil {
+		return "", err
+	}
+	if err := c.refuseCancelled(ctx); err != nil {
+		return "", err
+	}
+
+	// Tasks with dependencies are parked by their own script
+	if task.dependsOn != nil {
+		pipe := c.redis.TxPipeline()
+		cmd := c.park(ctx, pipe, task)
+		pipe.Exec(ctx)
+		if err := cmd.Err(); err != nil {
+			return "", fmt.Errorf("park: %w", err)
+		}
+		return task.id, nil
+	}
+
+	// Debounced and throttled tasks are written by their own script
+	if task.debounce != nil || task.throttle != nil {
+		id, err := c.writeLimited(ctx, c.redis, task).Text()
+		if err != nil {
+			return "", fmt.Errorf("rate-limited enqueue: %w", err)
+		}
+		return id, nil
+	}
+
+	// Deduplicated tasks take the lock, and tasks for a limited queue check
+	// its depth, in the same script that writes them
+	if task.dedupeKey != "" || c.limited(task) {
+		plan := newAtomicPlan()
+		plan.add(c, task)
+		var wait time.Duration
+		for {
+			ids, conflict, err := plan.run(ctx, c.redis).result()
+			if err == ErrQueueFull {
+				if limit, _ := c.limitFor(task.streamKey); limit.Policy == OverflowBlock {
+					if err := waitForCapacity(ctx, &wait); err != nil {
+						return "", err
+					}
+					continue
+				}
+				return "", ErrQueueFull
+			}
+			if err != nil {
+				return "", fmt.Errorf("enqueue: %w", err)
+			}
+			if conflict >= 0 {
+				return "", nil // Duplicate, skip
+			}
+			return ids[0], nil
+		}
+	}
+
+	pipe := c.redis.TxPipeline()
+	cmd := c.write(ctx, pipe, task)
+	pipe.Exec(ctx)
+	if err := cmd.Err(); err != nil {
+		if task.executeAt > 0 {
+			return "", fmt.Errorf("zadd scheduled: %w", err)
+		}
 		return "", fmt.Errorf("xadd: %w", err)
 	}
 
-	return result, nil
+	return task.taskID(cmd), nil
 }
 
 // Schedule adds a task to run after a specified delay.
@@ -174,6 +499,43 @@ func (c *Client) Schedule(ctx context.Context, taskName string, payload interfac
 	return c.Enqueue(ctx, taskName, payload, opt)
 }
 
+// Lua script that moves a scheduled task to a new due time.
+// KEYS[1]: scheduled set, KEYS[2]: scheduled index
+// ARGV[1]: task ID, ARGV[2]: new due time in ms
+// Returns 1 if the task was rescheduled, 0 if it is no longer scheduled.
+const rescheduleLua = `
+local member = redis.call('HGET', KEYS[2], ARGV[1])
+if not member then
+    return 0
+end
+if not redis.call('ZSCORE', KEYS[1], member) then
+    redis.call('HDEL', KEYS[2], ARGV[1])
+    return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], member)
+return 1
+`
+
+// Reschedule changes when a delayed task becomes available for processing.
+// id is the ID returned by Enqueue or Schedule for a delayed task. A time in
+// the past makes the task due on the next scheduler tick.
+//
+// Returns ErrTaskNotFound if the task is not (or no longer) scheduled, e.g.
+// because it was already moved to its stream.
+func (c *Client) Reschedule(ctx context.Context, id string, at time.Time) error {
+	moved, err := c.redis.Eval(ctx, rescheduleLua,
+		[]string{c.scheduledKey(), c.scheduledIndexKey()},
+		id, at.UnixMilli(),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("reschedule: %w", err)
+	}
+	if moved == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
 // Broadcast sends a task to all workers.
 // The message is added to the broadcast stream, where every active worker
 // (listening via BroadcastListener) will receive a copy.
@@ -183,8 +545,9 @@ func (c *Client) Broadcast(ctx context.Context, taskName string, payload interfa
 		return "", fmt.Errorf("marshal payload: %w", err)
 	}
 
+	streamKey := fmt.Sprintf("%s:broadcast", c.config.Prefix)
 	result, err := c.redis.XAdd(ctx, &redis.XAddArgs{
-		Stream: fmt.Sprintf("%s:broadcast", c.config.Prefix),
+		Stream: streamKey,
 		Values: map[string]interface{}{
 			"taskName":   taskName,
 			"payload":    string(payloadBytes),
@@ -194,6 +557,7 @@ func (c *Client) Broadcast(ctx context.Context, taskName string, payload interfa
 	if err != nil {
 		return "", fmt.Errorf("xadd broadcast: %w", err)
 	}
+	c.capLength(ctx, c.redis, streamKey)
 
 	return result, nil
 }
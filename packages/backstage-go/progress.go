@@ -0,0 +1,199 @@
+// Package backstage progress reporting.
+// Lets long-running handlers publish how far along they are, stored under the
+// task ID and pushed live to subscribers.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultProgressInterval is the minimum time between stored progress
+	// updates of one task when Config.ProgressInterval is not set.
+	DefaultProgressInterval = 500 * time.Millisecond
+	// progressTTL is how long the last progress of a task is kept.
+	progressTTL = 24 * time.Hour
+)
+
+// Progress is the latest progress reported by a task.
+type Progress struct {
+	TaskID    string  `json:"taskId"`
+	Percent   float64 `json:"percent"`
+	Note      string  `json:"note,omitempty"`
+	UpdatedAt int64   `json:"updatedAt"`
+}
+
+// progressState throttles the progress updates of one running task. An update
+// arriving inside the throttle window is kept in pending and written when the
+// window ends or the handler returns, so the latest progress is never lost.
+type progressState struct {
+	mu      sync.Mutex
+	last    time.Time
+	pending *Progress
+	timer   *time.Timer
+}
+
+// progressKey returns the key (and pub/sub channel) for a task's progress.
+func (c *Client) progressKey(taskID string) string {
+	return fmt.Sprintf("%s:progress:%s", c.config.Prefix, taskID)
+}
+
+// ReportProgress records the progress of the task running in ctx and pushes
+// it to subscribers. percent is clamped to [0, 100].
+//
+// Updates are throttled per task to one every Config.ProgressInterval, except
+// for 100% which is always recorded. Only the latest of the updates arriving
+// sooner is kept, and it is written once the interval has passed or the
+// handler returns. It returns ErrNoTask when called outside a handler.
+func ReportProgress(ctx context.Context, percent float64, note string) error {
+	info, ok := TaskInfoFromContext(ctx)
+	if !ok || info.client == nil {
+		return ErrNoTask
+	}
+	c := info.client
+
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+
+	interval := c.config.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	now := time.Now()
+	p := Progress{
+		TaskID:    info.TaskID,
+		Percent:   percent,
+		Note:      note,
+		UpdatedAt: now.UnixMilli(),
+	}
+
+	state := info.progress
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if wait := interval - now.Sub(state.last); percent < 100 && wait > 0 {
+		state.pending = &p
+		if state.timer == nil {
+			state.timer = time.AfterFunc(wait, func() { c.flushProgress(info) })
+		}
+		return nil
+	}
+	state.clearPending()
+	state.last = now
+	return c.writeProgress(ctx, p)
+}
+
+// flushProgress writes the update held back by the throttle of a task, if
+// any. It runs when the throttle window ends and after the handler returns.
+func (c *Client) flushProgress(info *TaskInfo) {
+	state := info.progress
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	p := state.pending
+	state.clearPending()
+	if p == nil {
+		return
+	}
+	state.last = time.Now()
+	if err := c.writeProgress(context.Background(), *p); err != nil {
+		c.logger.Warn("Failed to flush task progress", "task", info.TaskID, "error", err)
+	}
+}
+
+// clearPending drops the held-back update and its timer. The caller holds mu.
+func (s *progressState) clearPending() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.pending = nil
+}
+
+// writeProgress stores p and publishes it to subscribers.
+func (c *Client) writeProgress(ctx context.Context, p Progress) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	key := c.progressKey(p.TaskID)
+	_, err = c.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, progressTTL)
+		pipe.Publish(ctx, key, data)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("report progress: %w", err)
+	}
+	return nil
+}
+
+// GetProgress returns the latest progress reported by a task, identified by
+// the ID returned from Enqueue. Returns ErrTaskNotFound if the task never
+// reported progress or the record expired.
+func (c *Client) GetProgress(ctx context.Context, taskID string) (*Progress, error) {
+	data, err := c.redis.Get(ctx, c.progressKey(taskID)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Progress
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("decode progress: %w", err)
+	}
+	return &p, nil
+}
+
+// SubscribeProgress streams live progress updates of a task. The returned
+// channel is closed when ctx is cancelled. Updates published before the
+// subscription is established are not replayed; use GetProgress for the
+// current state.
+func (c *Client) SubscribeProgress(ctx context.Context, taskID string) (<-chan Progress, error) {
+	sub := c.redis.Subscribe(ctx, c.progressKey(taskID))
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("subscribe progress: %w", err)
+	}
+
+	updates := make(chan Progress, 16)
+	go func() {
+		defer close(updates)
+		defer sub.Close()
+
+		msgs := sub.Channel()
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				var p Progress
+				if err := json.Unmarshal([]byte(msg.Payload), &p); err != nil {
+					continue
+				}
+				select {
+				case updates <- p:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates, nil
+}
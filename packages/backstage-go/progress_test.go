@@ -0,0 +1,106 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReportProgress(t *testing.T) {
+	client := newIsolatedClient(t, "test-progress")
+	client.config.ProgressInterval = time.Hour
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	id, _ := client.Enqueue(ctx, "report.generate", nil)
+
+	subCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	updates, err := client.SubscribeProgress(subCtx, id)
+	if err != nil {
+		t.Fatalf("SubscribeProgress failed: %v", err)
+	}
+
+	client.On("report.generate", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		ReportProgress(ctx, 10, "loading")
+		ReportProgress(ctx, 50, "throttled away")
+		ReportProgress(ctx, 100, "done")
+		return nil, nil
+	})
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	var notes []string
+	for len(notes) < 2 {
+		select {
+		case p := <-updates:
+			if p.TaskID != id {
+				t.Errorf("unexpected task ID %q", p.TaskID)
+			}
+			notes = append(notes, p.Note)
+		case <-subCtx.Done():
+			t.Fatalf("timed out waiting for updates, got %v", notes)
+		}
+	}
+	if notes[0] != "loading" || notes[1] != "done" {
+		t.Errorf("expected throttled updates [loading done], got %v", notes)
+	}
+
+	p, err := client.GetProgress(ctx, id)
+	if err != nil {
+		t.Fatalf("GetProgress failed: %v", err)
+	}
+	if p.Percent != 100 || p.Note != "done" {
+		t.Errorf("unexpected stored progress: %+v", p)
+	}
+}
+
+func TestReportProgressTrailingUpdate(t *testing.T) {
+	client := newIsolatedClient(t, "test-progress-trailing")
+	client.config.ProgressInterval = 20 * time.Millisecond
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	id, _ := client.Enqueue(ctx, "report.trailing", nil)
+
+	var windowEnd *Progress
+	client.On("report.trailing", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		ReportProgress(ctx, 10, "loading")
+		ReportProgress(ctx, 20, "dropped")
+		ReportProgress(ctx, 30, "window end")
+		time.Sleep(50 * time.Millisecond)
+		windowEnd, _ = client.GetProgress(ctx, id)
+
+		ReportProgress(ctx, 60, "writing")
+		ReportProgress(ctx, 90, "returned")
+		return nil, nil
+	})
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if windowEnd == nil || windowEnd.Note != "window end" {
+		t.Errorf("expected the latest update written when the interval ended, got %+v", windowEnd)
+	}
+	p, err := client.GetProgress(ctx, id)
+	if err != nil {
+		t.Fatalf("GetProgress failed: %v", err)
+	}
+	if p.Percent != 90 || p.Note != "returned" {
+		t.Errorf("expected the latest update written when the handler returned, got %+v", p)
+	}
+}
+
+func TestReportProgressOutsideHandler(t *testing.T) {
+	if err := ReportProgress(context.Background(), 50, ""); err != ErrNoTask {
+		t.Errorf("expected ErrNoTask, got %v", err)
+	}
+}
+
+func TestGetProgressUnknownTask(t *testing.T) {
+	client := newIsolatedClient(t, "test-progress-missing")
+
+	if _, err := client.GetProgress(context.Background(), "0-1"); err != ErrTaskNotFound {
+		t.Errorf("expected ErrTaskNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Package backstage quarantine for unknown task names.
+// Messages no handler on this worker knows about are parked in a per-queue
+// quarantine stream instead of being dropped, and can be replayed later.
+package backstage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// UnknownTaskPolicy controls what a consumer does with a message whose task
+// name has no registered handler.
+type UnknownTaskPolicy string
+
+const (
+	// UnknownTaskQuarantine moves the message to the queue's quarantine stream
+	// (<prefix>:<queue>:quarantine) and acknowledges it. This is the default.
+	UnknownTaskQuarantine UnknownTaskPolicy = "quarantine"
+	// UnknownTaskLeavePending leaves the message unacknowledged so a worker
+	// that knows the task can pick it up once the reclaimer releases it. If no
+	// such worker appears it is dead-lettered after MaxDeliveries
+	// redeliveries.
+	UnknownTaskLeavePending UnknownTaskPolicy = "pending"
+)
+
+// Lua script that quarantines a message and acknowledges it atomically.
+// KEYS[1]: source stream, KEYS[2]: quarantine stream
+// ARGV[1]: consumer group, ARGV[2]: message ID, ARGV[3]: "1" to XDEL after ACK,
+// ARGV[4...]: field/value pairs for the quarantine entry
+const quarantineLua = `
+local fields = {}
+for i = 4, #ARGV do
+    fields[#fields + 1] = ARGV[i]
+end
+redis.call('XADD', KEYS[2], '*', unpack(fields))
+redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+if ARGV[3] == '1' then
+    redis.call('XDEL', KEYS[1], ARGV[2])
+end
+return 1
+`
+
+// Lua script that moves one quarantined message back to its stream.
+// KEYS[1]: quarantine stream, KEYS[2]: target stream
+// ARGV[1]: quarantined entry ID, ARGV[2...]: field/value pairs to re-enqueue
+const replayQuarantinedLua = `
+if redis.call('XDEL', KEYS[1], ARGV[1]) == 0 then
+    return false
+end
+local fields = {}
+for i = 2, #ARGV do
+    fields[#fields + 1] = ARGV[i]
+end
+return redis.call('XADD', KEYS[2], '*', unpack(fields))
+`
+
+// quarantineMeta lists the fields added when a message is quarantined; they
+// are stripped again on replay.
+var quarantineMeta = map[string]bool{
+	"originalId":     true,
+	"originalStream": true,
+	"rejectedBy":     true,
+	"quarantinedAt":  true,
+}
+
+// quarantineKey returns the quarantine stream key for a work stream.
+func quarantineKey(streamKey string) string {
+	return streamKey + ":quarantine"
+}
+
+// handleUnknownTask applies the configured UnknownTaskPolicy to a message
+// with no registered handler.
+func (c *Client) handleUnknownTask(ctx context.Context, streamKey string, msg redis.XMessage, taskName string) {
+	if c.config.UnknownTasks == UnknownTaskLeavePending {
+		log.Printf("[Backstage] Unknown task left pending: %s (%s)", taskName, msg.ID)
+		return
+	}
+
+	args := []interface{}{c.config.ConsumerGroup, msg.ID, "0"}
+	if c.config.DeleteOnAck {
+		args[2] = "1"
+	}
+	for k, v := range msg.Values {
+		if !quarantineMeta[k] {
+			args = append(args, k, v)
+		}
+	}
+	args = append(args,
+		"originalId", msg.ID,
+		"originalStream", streamKey,
+		"rejectedBy", c.config.WorkerID,
+		"quarantinedAt", time.Now().UnixMilli(),
+	)
+
+	err := c.redis.Eval(ctx, quarantineLua, []string{streamKey, quarantineKey(streamKey)}, args...).Err()
+	if err != nil {
+		// Leave it pending rather than lose it; the reclaimer will retry.
+		log.Printf("[Backstage] Failed to quarantine unknown task %s: %v", taskName, err)
+		return
+	}
+	log.Printf("[Backstage] Unknown task quarantined: %s (%s)", taskName, msg.ID)
+}
+
+// ReplayQuarantined moves quarantined messages of a queue back onto their
+// original stream, typically after a handler for them has been deployed.
+// If taskNames is given, only messages for those tasks are replayed.
+// Returns the number of messages replayed.
+func (c *Client) ReplayQuarantined(ctx context.Context, queue string, taskNames ...string) (int64, error) {
+	qKey := quarantineKey(fmt.Sprintf("%s:%s", c.config.Prefix, queue))
+
+	wanted := make(map[string]bool, len(taskNames))
+	for _, name := range taskNames {
+		wanted[name] = true
+	}
+
+	var replayed int64
+	start := "-"
+	for {
+		msgs, err := c.redis.XRangeN(ctx, qKey, start, "+", 100).Result()
+		if err != nil {
+			return replayed, fmt.Errorf("xrange quarantine: %w", err)
+		}
+		if len(msgs) == 0 {
+			return replayed, nil
+		}
+
+		for _, msg := range msgs {
+			taskName, _ := msg.Values["taskName"].(string)
+			if len(wanted) > 0 && !wanted[taskName] {
+				continue
+			}
+
+			target, _ := msg.Values["originalStream"].(string)
+			if target == "" {
+				target = fmt.Sprintf("%s:%s", c.config.Prefix, queue)
+			}
+
+			args := []interface{}{msg.ID}
+			for k, v := range msg.Values {
+				if !quarantineMeta[k] {
+					args = append(args, k, v)
+				}
+			}
+
+			err := c.redis.Eval(ctx, replayQuarantinedLua, []string{qKey, target}, args...).Err()
+			if err == redis.Nil {
+				continue // Replayed concurrently by someone else
+			}
+			if err != nil {
+				return replayed, fmt.Errorf("replay %s: %w", msg.ID, err)
+			}
+			replayed++
+		}
+
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
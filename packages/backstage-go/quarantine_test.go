@@ -0,0 +1,96 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestUnknownTaskIsQuarantined(t *testing.T) {
+	client := newIsolatedClient(t, "test-quarantine")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.Enqueue(ctx, "not.deployed.yet", map[string]int{"n": 1}, EnqueueOptions{Attempts: 2})
+	msg := readOne(t, client, stream)
+	client.handleMessage(ctx, stream, msg)
+
+	q := NewQueue("default", WithPrefix(client.config.Prefix))
+	quarantined, err := client.redis.XRange(ctx, q.QuarantineKey(), "-", "+").Result()
+	if err != nil || len(quarantined) != 1 {
+		t.Fatalf("expected 1 quarantined message, got %d (%v)", len(quarantined), err)
+	}
+	values := quarantined[0].Values
+	if values["originalId"] != msg.ID || values["rejectedBy"] != "test-worker" || values["attempts"] != "2" {
+		t.Errorf("unexpected quarantine entry: %v", values)
+	}
+
+	pending, _ := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Result()
+	if pending.Count != 0 {
+		t.Errorf("expected quarantined message to be acked, %d pending", pending.Count)
+	}
+
+	info, _ := Inspect(ctx, client.redis, []*Queue{q})
+	if info.TotalQuarantined != 1 {
+		t.Errorf("expected Inspect to count 1 quarantined, got %d", info.TotalQuarantined)
+	}
+}
+
+func TestUnknownTaskLeavePending(t *testing.T) {
+	client := newIsolatedClient(t, "test-quarantine-pending")
+	client.config.UnknownTasks = UnknownTaskLeavePending
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.Enqueue(ctx, "not.mine", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	pending, _ := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Result()
+	if pending.Count != 1 {
+		t.Errorf("expected message to stay pending, %d pending", pending.Count)
+	}
+	if n := client.redis.XLen(ctx, quarantineKey(stream)).Val(); n != 0 {
+		t.Errorf("expected nothing quarantined, got %d", n)
+	}
+}
+
+func TestReplayQuarantined(t *testing.T) {
+	client := newIsolatedClient(t, "test-quarantine-replay")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.Enqueue(ctx, "report.build", map[string]string{"id": "r1"})
+	client.Enqueue(ctx, "other.task", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	// The handler ships; replay only its messages.
+	var got json.RawMessage
+	client.On("report.build", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		got = payload
+		return nil, nil
+	})
+
+	n, err := client.ReplayQuarantined(ctx, "default", "report.build")
+	if err != nil {
+		t.Fatalf("ReplayQuarantined failed: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 replayed, got %d", n)
+	}
+	if left := client.redis.XLen(ctx, quarantineKey(stream)).Val(); left != 1 {
+		t.Errorf("expected other.task to stay quarantined, %d left", left)
+	}
+
+	replayed := readOne(t, client, stream)
+	if _, ok := replayed.Values["originalId"]; ok {
+		t.Error("expected quarantine metadata to be stripped on replay")
+	}
+	client.handleMessage(ctx, stream, replayed)
+	if string(got) != `{"id":"r1"}` {
+		t.Errorf("expected replayed payload, got %s", got)
+	}
+}
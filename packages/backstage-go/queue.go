@@ -66,6 +66,21 @@ func (q *Queue) DeadLetterKey() string {
 	return fmt.Sprintf("%s:%s:dead-letter", q.Prefix, q.Name)
 }
 
+// QuarantineKey returns the stream holding the queue's unknown tasks.
+func (q *Queue) QuarantineKey() string {
+	return fmt.Sprintf("%s:%s:quarantine", q.Prefix, q.Name)
+}
+
+// ExpiredKey returns the stream holding the queue's expired tasks.
+func (q *Queue) ExpiredKey() string {
+	return expiredKey(q.StreamKey())
+}
+
+// ExpiredCountKey returns the counter of the queue's expired tasks.
+func (q *Queue) ExpiredCountKey() string {
+	return expiredCountKey(q.StreamKey())
+}
+
 // Default queues
 var (
 	QueueUrgent  = NewQueue("urgent", WithPriority(1))
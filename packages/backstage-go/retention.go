@@ -0,0 +1,178 @@
+// Package backstage stream retention.
+// Trims streams by length or age without ever removing entries that a
+// consumer group has not read or acknowledged yet.
+package backstage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRetentionInterval is how often the consumer applies retention
+// policies when Config.RetentionInterval is not set.
+const DefaultRetentionInterval = time.Minute
+
+// RetentionPolicy bounds how much history a stream keeps. Entries that are
+// still pending in, or not yet delivered to, any consumer group are never
+// trimmed, whatever the policy says.
+type RetentionPolicy struct {
+	// MaxLen caps the stream length. It is applied on every XADD by this
+	// client to a stream, dead-letter stream or broadcast stream, and again
+	// by the periodic trimmer.
+	MaxLen int64
+	// MaxAge removes entries older than this. It is applied by the periodic
+	// trimmer only.
+	MaxAge time.Duration
+	// Exact trims precisely instead of approximately. Approximate trimming
+	// ("~") only removes whole internal nodes, which is much cheaper but may
+	// leave a few more entries than the policy allows.
+	Exact bool
+}
+
+// Lua script that trims a stream without removing unprocessed entries.
+// KEYS[1]: stream
+// ARGV[1]: max length (0 for none), ARGV[2]: oldest ID to keep by age ("" for
+// none), ARGV[3]: "=" or "~"
+//
+// The oldest entry any consumer group still needs is found first: its lowest
+// pending ID, or its last delivered ID when nothing is pending. Only entries
+// before it are candidates, so the length limit reads at most the entries
+// over it, and the stream is never walked to MaxLen. The trim point is the
+// most aggressive of the two limits, then moved back to that floor. Returns
+// the number of entries removed.
+const retentionTrimLua = `
+local key = KEYS[1]
+local maxLen = tonumber(ARGV[1])
+local minAgeId = ARGV[2]
+
+local function parse(id)
+    local ms, seq = string.match(id, '^(%d+)-(%d+)$')
+    return tonumber(ms), tonumber(seq)
+end
+local function less(a, b)
+    local ams, aseq = parse(a)
+    local bms, bseq = parse(b)
+    return ams < bms or (ams == bms and aseq < bseq)
+end
+
+local excess = 0
+if maxLen > 0 then
+    excess = redis.call('XLEN', key) - maxLen
+end
+if excess <= 0 and minAgeId == '' then
+    return 0
+end
+
+local ok, groups = pcall(redis.call, 'XINFO', 'GROUPS', key)
+if not ok then
+    return 0
+end
+local floor
+for _, g in ipairs(groups) do
+    local info = {}
+    for i = 1, #g, 2 do
+        info[g[i]] = g[i + 1]
+    end
+    local f = info['last-delivered-id']
+    if tonumber(info['pending']) > 0 then
+        f = redis.call('XPENDING', key, info['name'])[2]
+    end
+    if not floor or less(f, floor) then
+        floor = f
+    end
+end
+
+local target
+if excess > 0 then
+    local old = redis.call('XRANGE', key, '-', floor or '+', 'COUNT', excess + 1)
+    if #old > excess then
+        target = old[#old][1]
+    else
+        target = floor
+    end
+end
+if minAgeId ~= '' and (not target or less(target, minAgeId)) then
+    target = minAgeId
+end
+if not target then
+    return 0
+end
+if floor and less(floor, target) then
+    target = floor
+end
+return redis.call('XTRIM', key, 'MINID', ARGV[3], target)
+`
+
+// retentionFor returns the policy configured for a stream key.
+func (c *Client) retentionFor(streamKey string) (RetentionPolicy, bool) {
+	policy, ok := c.config.Retention[c.queueName(streamKey)]
+	return policy, ok
+}
+
+// trimArgs returns the retentionTrimLua arguments for policy. Age limits are
+// skipped unless withAge is set.
+func trimArgs(policy RetentionPolicy, withAge bool) []interface{} {
+	minID := ""
+	if withAge && policy.MaxAge > 0 {
+		minID = fmt.Sprintf("%d-0", time.Now().Add(-policy.MaxAge).UnixMilli())
+	}
+	mode := "~"
+	if policy.Exact {
+		mode = "="
+	}
+	return []interface{}{policy.MaxLen, minID, mode}
+}
+
+// capLength queues the length cap of streamKey's policy on pipe, if it has
+// one. Called after every XADD to a stream; its cost is bounded by the
+// entries over the cap, not by the cap.
+func (c *Client) capLength(ctx context.Context, pipe redis.Cmdable, streamKey string) {
+	policy, ok := c.retentionFor(streamKey)
+	if !ok || policy.MaxLen <= 0 {
+		return
+	}
+	pipe.Eval(ctx, retentionTrimLua, []string{streamKey}, trimArgs(policy, false)...)
+}
+
+// ApplyRetention trims every stream that has a retention policy, by length and
+// age. Consumers run it every RetentionInterval; producer-only processes can
+// call it themselves. Returns the number of entries removed.
+func (c *Client) ApplyRetention(ctx context.Context) (int64, error) {
+	var removed int64
+	for name, policy := range c.config.Retention {
+		if policy.MaxLen <= 0 && policy.MaxAge <= 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s:%s", c.config.Prefix, name)
+		n, err := c.redis.Eval(ctx, retentionTrimLua, []string{key}, trimArgs(policy, true)...).Int64()
+		if err != nil {
+			return removed, fmt.Errorf("trim %s: %w", key, err)
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// runRetention applies retention policies periodically until ctx ends.
+func (c *Client) runRetention(ctx context.Context) {
+	interval := c.config.RetentionInterval
+	if interval <= 0 {
+		interval = DefaultRetentionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for c.running {
+		select {
+		case <-ticker.C:
+			if _, err := c.ApplyRetention(ctx); err != nil {
+				c.logger.Error("Failed to apply retention", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package backstage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRetentionNeverTrimsPending(t *testing.T) {
+	client := newIsolatedClient(t, "test-retention")
+	client.config.Retention = map[string]RetentionPolicy{
+		"default": {MaxLen: 1, Exact: true},
+	}
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, _ := client.Enqueue(ctx, "log.write", i)
+		ids = append(ids, id)
+		readOne(t, client, stream)
+	}
+	// The first two are done, the third is still being processed
+	client.redis.XAck(ctx, stream, client.config.ConsumerGroup, ids[0], ids[1])
+
+	// Not yet delivered to the group
+	client.Enqueue(ctx, "log.write", 3)
+	client.Enqueue(ctx, "log.write", 4)
+	client.ApplyRetention(ctx)
+
+	msgs, _ := client.redis.XRange(ctx, stream, "-", "+").Result()
+	if len(msgs) != 3 || msgs[0].ID != ids[2] {
+		t.Fatalf("expected trimming to stop at the pending entry %s, got %d entries", ids[2], len(msgs))
+	}
+
+	// Once everything is acknowledged the cap applies fully
+	readOne(t, client, stream)
+	readOne(t, client, stream)
+	client.redis.XAck(ctx, stream, client.config.ConsumerGroup, msgs[0].ID, msgs[1].ID, msgs[2].ID)
+	client.ApplyRetention(ctx)
+	if n := client.redis.XLen(ctx, stream).Val(); n != 1 {
+		t.Errorf("expected stream capped to 1 entry, got %d", n)
+	}
+}
+
+func TestRetentionCapsOnWrite(t *testing.T) {
+	client := newIsolatedClient(t, "test-retention-write")
+	client.config.Retention = map[string]RetentionPolicy{
+		"default": {MaxLen: 2, Exact: true},
+	}
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	// Unread entries are kept however long the stream gets
+	for i := 0; i < 4; i++ {
+		client.Enqueue(ctx, "log.write", i)
+	}
+	if n := client.redis.XLen(ctx, stream).Val(); n != 4 {
+		t.Fatalf("expected unread entries kept, got %d", n)
+	}
+
+	for i := 0; i < 4; i++ {
+		msg := readOne(t, client, stream)
+		client.redis.XAck(ctx, stream, client.config.ConsumerGroup, msg.ID)
+	}
+	client.Enqueue(ctx, "log.write", 4)
+	if n := client.redis.XLen(ctx, stream).Val(); n != 2 {
+		t.Errorf("expected the stream capped to 2 entries on write, got %d", n)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	client := newIsolatedClient(t, "test-retention-age")
+	client.config.Retention = map[string]RetentionPolicy{
+		"default:dead-letter": {MaxAge: time.Hour, Exact: true},
+	}
+	ctx := context.Background()
+	dlKey := client.deadLetterKey(PriorityDefault)
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	client.redis.XAdd(ctx, &redis.XAddArgs{Stream: dlKey, ID: fmt.Sprintf("%d-0", old), Values: []string{"taskName", "old"}})
+	client.redis.XAdd(ctx, &redis.XAddArgs{Stream: dlKey, Values: []string{"taskName", "new"}})
+
+	removed, err := client.ApplyRetention(ctx)
+	if err != nil {
+		t.Fatalf("ApplyRetention failed: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 entry removed, got %d", removed)
+	}
+	msgs, _ := client.redis.XRange(ctx, dlKey, "-", "+").Result()
+	if len(msgs) != 1 || msgs[0].Values["taskName"] != "new" {
+		t.Errorf("expected only the recent entry to remain, got %v", msgs)
+	}
+}
@@ -0,0 +1,411 @@
+// Package backstage saga compensation.
+// Tracks the steps of a chained workflow and, when a step fails for good,
+// undoes the completed ones by running their compensating tasks in reverse
+// order.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sagaTTL is how long saga state is kept after the saga starts.
+const sagaTTL = 7 * 24 * time.Hour
+
+// SagaStatus is the outcome of a saga.
+type SagaStatus string
+
+const (
+	SagaRunning      SagaStatus = "running"
+	SagaCompleted    SagaStatus = "completed"    // Every step succeeded
+	SagaCompensating SagaStatus = "compensating" // A step failed; undoing the others
+	SagaCompensated  SagaStatus = "compensated"  // Every completed step was undone
+	SagaFailed       SagaStatus = "failed"       // A compensation failed too
+)
+
+// Compensation is the task that undoes a saga step, registered by the step
+// through its WorkflowInstruction.
+type Compensation struct {
+	TaskName string      `json:"taskName"`
+	Payload  interface{} `json:"payload,omitempty"`
+	// Options are the compensating task's options. It cannot be delayed,
+	// deduplicated, debounced, throttled or have dependencies.
+	Options EnqueueOptions `json:"options,omitempty"`
+}
+
+// SagaState is the state of a saga, as returned by GetSaga.
+type SagaState struct {
+	ID     string
+	Status SagaStatus
+	// FailedStep is the task name of the step that failed, if any.
+	FailedStep string
+	// FailedCompensation is the task name of the compensation that failed
+	// (SagaFailed only).
+	FailedCompensation string
+	// Compensated counts the compensations that succeeded; Remaining those
+	// still to run.
+	Compensated int
+	Remaining   int
+	StartedAt   time.Time
+	FinishedAt  time.Time // Zero until the saga completes or is compensated
+}
+
+// Lua script that records a saga event.
+// KEYS[1]: saga hash, KEYS[2]: compensation order (ZSET of step IDs),
+// KEYS[3]: compensations (step ID -> JSON {stream, fields}), KEYS[4...]:
+// the streams compensations may be enqueued to
+// ARGV[1]: event, ARGV[2]: now in ms, then per event:
+//   - "step": a step succeeded. ARGV[3]: step ID, ARGV[4]: number of steps it
+//     chained, ARGV[5]: its compensation JSON ("" for none)
+//   - "fail": a step failed for good. ARGV[3]: its task name
+//   - "compensated": a compensation succeeded. ARGV[3]: its step ID
+//   - "compensation-failed": a compensation failed. ARGV[3]: its step ID,
+//     ARGV[4]: its task name
+//
+// Compensations run one at a time, latest step first; the step being undone
+// is kept in the "current" field so that a redelivered compensation does not
+// start the next one twice. Returns the saga's new status, or "" if unchanged;
+// "retry", without writing anything, if the compensation to start goes to a
+// stream not in KEYS.
+const sagaLua = `
+local key = KEYS[1]
+local event = ARGV[1]
+local now = ARGV[2]
+local status = redis.call('HGET', key, 'status')
+if not status then
+    return ''
+end
+
+local declared = {}
+for i = 4, #KEYS do
+    declared[KEYS[i]] = true
+end
+
+local ttl = redis.call('PTTL', key)
+local function keep(k)
+    if ttl > 0 then
+        redis.call('PEXPIRE', k, ttl)
+    end
+end
+
+local function enqueue(raw)
+    local c = cjson.decode(raw)
+    redis.call('XADD', c.stream, '*', unpack(c.fields))
+end
+
+-- Whether the compensation nextCompensation would start can be enqueued
+local function canCompensate()
+    local top = redis.call('ZREVRANGE', KEYS[2], 0, 0)
+    if #top == 0 then
+        return true
+    end
+    return declared[cjson.decode(redis.call('HGET', KEYS[3], top[1])).stream] ~= nil
+end
+
+-- Start the compensation of the latest remaining step, if any
+local function nextCompensation()
+    local top = redis.call('ZREVRANGE', KEYS[2], 0, 0)
+    if #top == 0 then
+        redis.call('HSET', key, 'status', 'compensated', 'finishedAt', now)
+        redis.call('HDEL', key, 'current')
+        return 'compensated'
+    end
+    redis.call('ZREM', KEYS[2], top[1])
+    enqueue(redis.call('HGET', KEYS[3], top[1]))
+    redis.call('HSET', key, 'current', top[1])
+    return 'compensating'
+end
+
+if event == 'step' then
+    if redis.call('HSETNX', key, 'done:' .. ARGV[3], 1) == 0 then
+        return ''
+    end
+    if ARGV[5] ~= '' then
+        if status == 'running' then
+            local seq = redis.call('HINCRBY', key, 'seq', 1)
+            redis.call('ZADD', KEYS[2], seq, ARGV[3])
+            redis.call('HSET', KEYS[3], ARGV[3], ARGV[5])
+            keep(KEYS[2])
+            keep(KEYS[3])
+        else
+            -- The saga failed while this step ran: undo it right away
+            enqueue(ARGV[5])
+        end
+    end
+    if status ~= 'running' then
+        return ''
+    end
+    if redis.call('HINCRBY', key, 'active', tonumber(ARGV[4]) - 1) <= 0 then
+        redis.call('HSET', key, 'status', 'completed', 'finishedAt', now)
+        return 'completed'
+    end
+    return ''
+end
+
+if event == 'fail' then
+    if status ~= 'running' then
+        return ''
+    end
+    if not canCompensate() then
+        return 'retry'
+    end
+    redis.call('HSET', key, 'status', 'compensating', 'failedStep', ARGV[3])
+    return nextCompensation()
+end
+
+if status ~= 'compensating' or redis.call('HGET', key, 'current') ~= ARGV[3] then
+    return ''
+end
+if event == 'compensated' then
+    if not canCompensate() then
+        return 'retry'
+    end
+    redis.call('HINCRBY', key, 'compensated', 1)
+    return nextCompensation()
+end
+redis.call('HSET', key, 'status', 'failed', 'failedCompensation', ARGV[4], 'finishedAt', now)
+redis.call('HDEL', key, 'current')
+return 'failed'
+`
+
+// sagaKey returns the hash holding a saga's state.
+func (c *Client) sagaKey(id string) string {
+	return fmt.Sprintf("%s:saga:%s", c.config.Prefix, id)
+}
+
+// sagaKeys returns the sagaLua keys of a saga.
+func (c *Client) sagaKeys(id string) []string {
+	key := c.sagaKey(id)
+	return []string{key, key + ":order", key + ":compensations"}
+}
+
+// StartSaga enqueues the first step of a saga: a chained workflow whose
+// steps register a Compensation through their WorkflowInstruction. Every
+// task chained from a saga step belongs to the saga. When a step is
+// dead-lettered or expires, the compensations of the completed steps run one
+// after the other, latest first, and the outcome is recorded; see GetSaga.
+//
+// Saga steps cannot be deduplicated, debounced, throttled or have
+// dependencies. Saga state is
+// kept for 7 days. Returns the saga ID, or ErrQueueFull, writing nothing,
+// if the queue of the first step is full (see QueueLimit).
+func (c *Client) StartSaga(ctx context.Context, taskName string, payload interface{}, opts ...EnqueueOptions) (string, error) {
+	var opt EnqueueOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if err := checkOptions("saga steps", opt, ruleWrittenByScript&^ruleDelay); err != nil {
+		return "", err
+	}
+
+	id, err := newTaskID()
+	if err != nil {
+		return "", err
+	}
+	task, err := c.prepareTask(taskName, payload, opt)
+	if err != nil {
+		return "", err
+	}
+	task.setField("sagaId", id)
+
+	key := c.sagaKey(id)
+	plan := newAtomicPlan()
+	plan.add(c, task)
+	plan.hset(key, "status", string(SagaRunning), false, sagaTTL)
+	plan.hset(key, "active", "1", false, sagaTTL)
+	plan.hset(key, "startedAt", strconv.FormatInt(time.Now().UnixMilli(), 10), false, sagaTTL)
+	if _, _, err := plan.run(ctx, c.redis).result(); err == ErrQueueFull {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("start saga: %w", err)
+	}
+	return id, nil
+}
+
+// GetSaga returns the state of a saga, or ErrSagaNotFound if it does not
+// exist or its state expired.
+func (c *Client) GetSaga(ctx context.Context, id string) (*SagaState, error) {
+	keys := c.sagaKeys(id)
+	pipe := c.redis.Pipeline()
+	stateCmd := pipe.HGetAll(ctx, keys[0])
+	remainingCmd := pipe.ZCard(ctx, keys[1])
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("get saga: %w", err)
+	}
+
+	state := stateCmd.Val()
+	if len(state) == 0 {
+		return nil, ErrSagaNotFound
+	}
+	saga := &SagaState{
+		ID:                 id,
+		Status:             SagaStatus(state["status"]),
+		FailedStep:         state["failedStep"],
+		FailedCompensation: state["failedCompensation"],
+	}
+	saga.Compensated, _ = strconv.Atoi(state["compensated"])
+	if saga.Status == SagaCompensating || saga.Status == SagaFailed {
+		// Remaining compensations, plus the one running
+		saga.Remaining = int(remainingCmd.Val())
+		if state["current"] != "" {
+			saga.Remaining++
+		}
+	}
+	if ms, err := strconv.ParseInt(state["startedAt"], 10, 64); err == nil {
+		saga.StartedAt = time.UnixMilli(ms)
+	}
+	if ms, err := strconv.ParseInt(state["finishedAt"], 10, 64); err == nil {
+		saga.FinishedAt = time.UnixMilli(ms)
+	}
+	return saga, nil
+}
+
+// sagaRunning reports whether the saga msg belongs to, if any, still runs
+// its steps. Compensations always run.
+func (c *Client) sagaRunning(ctx context.Context, msg redis.XMessage) (bool, error) {
+	id, _ := msg.Values["sagaId"].(string)
+	if id == "" || msg.Values["sagaStep"] != nil {
+		return true, nil
+	}
+	status, err := c.redis.HGet(ctx, c.sagaKey(id), "status").Result()
+	if err == redis.Nil {
+		return true, nil // Unknown saga; its steps still run
+	}
+	if err != nil {
+		return false, err
+	}
+	return status == string(SagaRunning), nil
+}
+
+// finishSagaTask records that msg, a saga step or compensation, finished.
+// next are the tasks a succeeded step chains.
+func (c *Client) finishSagaTask(ctx context.Context, msg redis.XMessage, result *WorkflowInstruction, next []NextTask, failed bool) error {
+	id, _ := msg.Values["sagaId"].(string)
+	if id == "" {
+		return nil
+	}
+	taskName, _ := msg.Values["taskName"].(string)
+	now := time.Now().UnixMilli()
+
+	// The streams the event may enqueue a compensation to are declared:
+	// those of the stored compensations when one may start, or that of the
+	// step's own compensation
+	var args []interface{}
+	var streams []string
+	var err error
+	switch step, _ := msg.Values["sagaStep"].(string); {
+	case step != "" && failed:
+		args = []interface{}{"compensation-failed", now, step, taskName}
+	case step != "":
+		args = []interface{}{"compensated", now, step}
+		streams, err = c.compensationStreams(ctx, id)
+	case failed:
+		args = []interface{}{"fail", now, taskName}
+		streams, err = c.compensationStreams(ctx, id)
+	default:
+		compensation := ""
+		if result != nil && result.Compensate != nil {
+			raw, err := c.prepareCompensation(id, messageTaskID(msg), messageHeaders(msg), result.Compensate)
+			if err != nil {
+				return err
+			}
+			var entry compensationEntry
+			json.Unmarshal([]byte(raw), &entry)
+			compensation = raw
+			streams = []string{entry.Stream}
+		}
+		steps := len(next)
+		if result != nil && result.Wait != nil {
+			steps++ // The resumed task or the timeout task
+		}
+		args = []interface{}{"step", now, messageTaskID(msg), steps, compensation}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var status string
+	for {
+		status, err = c.redis.Eval(ctx, sagaLua, append(c.sagaKeys(id), streams...), args...).Text()
+		if err != nil {
+			return err
+		}
+		if status != "retry" {
+			break
+		}
+		// A step registered a compensation for another stream meanwhile
+		if streams, err = c.compensationStreams(ctx, id); err != nil {
+			return err
+		}
+	}
+	switch SagaStatus(status) {
+	case SagaCompleted:
+		c.logger.Info("Saga completed", "saga", id)
+	case SagaCompensated:
+		c.logger.Info("Saga compensated", "saga", id)
+	case SagaFailed:
+		c.logger.Error("Saga compensation failed", "saga", id, "task", taskName)
+	}
+	if args[0] == "fail" && status != "" {
+		c.logger.Warn("Saga step failed, compensating", "saga", id, "task", taskName)
+	}
+	return nil
+}
+
+// compensationEntry is a compensation as stored for sagaLua.
+type compensationEntry struct {
+	Stream string   `json:"stream"`
+	Fields []string `json:"fields"`
+}
+
+// compensationStreams returns the distinct streams of the compensations
+// stored for a saga.
+func (c *Client) compensationStreams(ctx context.Context, id string) ([]string, error) {
+	raws, err := c.redis.HVals(ctx, c.sagaKeys(id)[2]).Result()
+	if err != nil {
+		return nil, err
+	}
+	var streams []string
+	seen := make(map[string]bool)
+	for _, raw := range raws {
+		var entry compensationEntry
+		if json.Unmarshal([]byte(raw), &entry) == nil && !seen[entry.Stream] {
+			seen[entry.Stream] = true
+			streams = append(streams, entry.Stream)
+		}
+	}
+	return streams, nil
+}
+
+// prepareCompensation encodes the compensation of a saga step for sagaLua.
+// It inherits the step's headers.
+func (c *Client) prepareCompensation(sagaID, stepID string, headers map[string]string, comp *Compensation) (string, error) {
+	opt := comp.Options
+	if err := checkOptions("compensation", opt, ruleWrittenByScript); err != nil {
+		return "", err
+	}
+	opt.Headers = mergeHeaders(headers, opt.Headers)
+
+	task, err := c.prepareTask(comp.TaskName, comp.Payload, opt)
+	if err != nil {
+		return "", fmt.Errorf("compensation %s: %w", comp.TaskName, err)
+	}
+	task.setField("sagaId", sagaID)
+	task.setField("sagaStep", stepID)
+
+	fields := make([]string, 0, 2*len(task.values))
+	for k, v := range task.values {
+		fields = append(fields, k, fmt.Sprint(v))
+	}
+	raw, err := json.Marshal(compensationEntry{Stream: task.streamKey, Fields: fields})
+	if err != nil {
+		return "", fmt.Errorf("marshal compensation: %w", err)
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,128 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// newBookingClient registers a booking saga: seat -> charge -> hotel -> done,
+// where every step but the last registers a compensation.
+func newBookingClient(t *testing.T, prefix string) *Client {
+	client := newIsolatedClient(t, prefix)
+	client.initConsumerGroups(context.Background())
+
+	step := func(next, undo string) Handler {
+		return func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+			return &WorkflowInstruction{
+				Next:       next,
+				Compensate: &Compensation{TaskName: undo, Payload: undo},
+			}, nil
+		}
+	}
+	client.On("seat.reserve", step("card.charge", "seat.release"))
+	client.On("card.charge", step("hotel.hold", "card.refund"))
+	client.On("hotel.hold", step("booking.done", "hotel.release"))
+	client.On("booking.done", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return nil, nil
+	})
+	for _, undo := range []string{"seat.release", "card.refund", "hotel.release"} {
+		client.On(undo, func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+			return nil, nil
+		})
+	}
+	return client
+}
+
+func TestSagaCompleted(t *testing.T) {
+	client := newBookingClient(t, "test-saga")
+	ctx := context.Background()
+
+	id, err := client.StartSaga(ctx, "seat.reserve", nil)
+	if err != nil {
+		t.Fatalf("StartSaga failed: %v", err)
+	}
+	runMembers(t, client, 4)
+
+	saga, err := client.GetSaga(ctx, id)
+	if err != nil {
+		t.Fatalf("GetSaga failed: %v", err)
+	}
+	if saga.Status != SagaCompleted || saga.FinishedAt.IsZero() {
+		t.Errorf("expected a completed saga, got %+v", saga)
+	}
+}
+
+func TestSagaCompensatesInReverseOrder(t *testing.T) {
+	client := newBookingClient(t, "test-saga-compensate")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, _ := client.StartSaga(ctx, "seat.reserve", nil)
+	runMembers(t, client, 3) // seat, charge, hotel
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+
+	var undone []string
+	for i := 0; i < 3; i++ {
+		msg := readOne(t, client, stream)
+		undone = append(undone, msg.Values["taskName"].(string))
+		client.handleMessage(ctx, stream, msg)
+		client.handleDelivery(ctx, stream, msg, 2) // Redelivered after a lost ACK
+	}
+	want := []string{"hotel.release", "card.refund", "seat.release"}
+	for i := range want {
+		if undone[i] != want[i] {
+			t.Fatalf("expected compensations %v, got %v", want, undone)
+		}
+	}
+
+	saga, _ := client.GetSaga(ctx, id)
+	if saga.Status != SagaCompensated || saga.FailedStep != "booking.done" || saga.Compensated != 3 {
+		t.Errorf("expected a compensated saga, got %+v", saga)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 7 {
+		t.Errorf("expected each compensation enqueued once, stream has %d entries", n)
+	}
+}
+
+func TestSagaCompensationFailure(t *testing.T) {
+	client := newBookingClient(t, "test-saga-failed")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, _ := client.StartSaga(ctx, "seat.reserve", nil)
+	runMembers(t, client, 2) // seat, charge
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream)) // card.refund
+
+	saga, _ := client.GetSaga(ctx, id)
+	if saga.Status != SagaFailed || saga.FailedStep != "hotel.hold" || saga.FailedCompensation != "card.refund" {
+		t.Errorf("expected a failed compensation recorded, got %+v", saga)
+	}
+	if saga.Remaining != 1 {
+		t.Errorf("expected one compensation left, got %d", saga.Remaining)
+	}
+}
+
+func TestSagaDropsStepsAfterFailure(t *testing.T) {
+	client := newBookingClient(t, "test-saga-drop")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	client.On("fanout", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return &WorkflowInstruction{Fanout: []NextTask{{TaskName: "seat.reserve"}, {TaskName: "booking.done"}}}, nil
+	})
+	id, _ := client.StartSaga(ctx, "fanout", nil)
+	runMembers(t, client, 1)
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream)) // seat.reserve
+	runMembers(t, client, 1)                                                  // booking.done, dropped
+
+	saga, _ := client.GetSaga(ctx, id)
+	if saga.Status != SagaCompensated {
+		t.Errorf("expected a compensated saga, got %+v", saga)
+	}
+	if _, err := client.GetSaga(ctx, "missing"); !errors.Is(err, ErrSagaNotFound) {
+		t.Errorf("expected ErrSagaNotFound, got %v", err)
+	}
+}
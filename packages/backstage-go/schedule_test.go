@@ -0,0 +1,90 @@
+package backstage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// moveDue runs the scheduled task mover once, as the consumer would.
+func moveDue(t *testing.T, client *Client) {
+	t.Helper()
+	err := client.redis.Eval(context.Background(), processScheduledLua,
+		[]string{client.scheduledKey(), client.scheduledIndexKey()},
+		time.Now().UnixMilli(), client.config.Prefix, string(PriorityDefault),
+	).Err()
+	if err != nil {
+		t.Fatalf("move scheduled tasks: %v", err)
+	}
+}
+
+func TestScheduledTasksGetUniqueIDs(t *testing.T) {
+	client := newIsolatedClient(t, "test-schedule-ids")
+	ctx := context.Background()
+
+	at := time.Now().Add(time.Hour)
+	first, err := client.Enqueue(ctx, "report.build", nil, EnqueueOptions{ProcessAt: at})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	second, _ := client.Enqueue(ctx, "report.build", nil, EnqueueOptions{ProcessAt: at})
+
+	if first == "" || first == second {
+		t.Errorf("expected distinct IDs for identical tasks, got %q and %q", first, second)
+	}
+	if n := client.redis.ZCard(ctx, client.scheduledKey()).Val(); n != 2 {
+		t.Errorf("expected 2 scheduled tasks, got %d", n)
+	}
+	score := client.redis.ZScore(ctx, client.scheduledKey(),
+		client.redis.HGet(ctx, client.scheduledIndexKey(), first).Val()).Val()
+	if int64(score) != at.UnixMilli() {
+		t.Errorf("expected task due at %d, got %d", at.UnixMilli(), int64(score))
+	}
+}
+
+func TestProcessAtInThePastEnqueuesImmediately(t *testing.T) {
+	client := newIsolatedClient(t, "test-schedule-past")
+	ctx := context.Background()
+
+	client.Enqueue(ctx, "report.build", nil, EnqueueOptions{
+		ProcessAt: time.Now().Add(-time.Minute),
+		Delay:     time.Hour, // ProcessAt wins
+	})
+
+	if n := client.redis.XLen(ctx, client.streamKey(PriorityDefault)).Val(); n != 1 {
+		t.Errorf("expected task in the stream, got %d entries", n)
+	}
+}
+
+func TestRescheduleKeepsTaskID(t *testing.T) {
+	client := newIsolatedClient(t, "test-reschedule")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	id, _ := client.Schedule(ctx, "report.build", nil, time.Hour)
+
+	// Not due yet
+	moveDue(t, client)
+	if client.redis.XLen(ctx, stream).Val() != 0 {
+		t.Fatal("expected task to still be scheduled")
+	}
+
+	if err := client.Reschedule(ctx, id, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Reschedule failed: %v", err)
+	}
+	moveDue(t, client)
+
+	msg := readOne(t, client, stream)
+	info := client.newTaskInfo(stream, msg, 1)
+	if info.TaskID != id {
+		t.Errorf("expected task ID %q after the move, got %q", id, info.TaskID)
+	}
+	if client.redis.HExists(ctx, client.scheduledIndexKey(), id).Val() {
+		t.Error("expected index entry removed once the task moved")
+	}
+
+	if err := client.Reschedule(ctx, id, time.Now()); err != ErrTaskNotFound {
+		t.Errorf("expected ErrTaskNotFound for a moved task, got %v", err)
+	}
+}
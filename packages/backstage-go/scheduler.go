@@ -25,6 +25,7 @@ type Scheduler struct {
 	logger    *Logger
 	running   bool
 	prefix    string
+	expired   ExpiredTaskPolicy
 }
 
 // SchedulerConfig configuration for the Scheduler.
@@ -41,15 +42,28 @@ type SchedulerConfig struct {
 	Silent          bool
 	Prefix          string // Stream key prefix (default: "backstage")
 	DefaultPriority string // Default priority name (default: "default")
+	// ExpiredTasks controls what happens to scheduled tasks found past their
+	// expiry when they are moved. Defaults to ExpiredKeep.
+	ExpiredTasks    ExpiredTaskPolicy
 }
 
 // Lua script for atomic scheduled task processing
-// Prevents race conditions when multiple schedulers run
+// Prevents race conditions when multiple schedulers run.
+// Every field stored with the task is copied onto the stream entry, so job
+// metadata (attempts, backoff, timeout, idempotency, ...) survives the move.
+// KEYS[2], if given, is the index of scheduled task IDs to drop moved tasks
+// from. Tasks past their expiresAt are counted as expired and, unless ARGV[4]
+// is "drop", moved to the stream's expired stream instead, and release their
+// DedupeUntilCompleted lock. Expired group members, saga tasks and tasks
+// enqueued with Config.TaskDependencies (marked recordOutcome) still go to
+// their stream, where the consumer expires them and reports the failure.
 const processScheduledLua = `
 local zsetKey = KEYS[1]
+local indexKey = KEYS[2]
 local cutoff = tonumber(ARGV[1])
 local prefix = ARGV[2]
 local defaultPriority = ARGV[3]
+local dropExpired = ARGV[4] == 'drop'
 
 local tasks = redis.call('ZRANGEBYSCORE', zsetKey, '-inf', cutoff)
 local processed = 0
@@ -57,16 +71,42 @@ local processed = 0
 for _, taskData in ipairs(tasks) do
     local ok, task = pcall(cjson.decode, taskData)
     if ok and task then
-        local priority = task.priority or defaultPriority
-        local streamKey = prefix .. ':' .. priority
-        
-        redis.call('XADD', streamKey, '*',
+        local streamKey = task.streamKey or (prefix .. ':' .. (task.priority or defaultPriority))
+
+        local args = {streamKey, '*',
             'taskName', task.taskName or '',
             'payload', task.payload or '{}',
             'enqueuedAt', tostring(task.enqueuedAt or 0)
-        )
-        
+        }
+        for k, v in pairs(task) do
+            if k ~= 'taskName' and k ~= 'payload' and k ~= 'enqueuedAt'
+                and k ~= 'streamKey' and k ~= 'priority' and type(v) ~= 'table' then
+                table.insert(args, k)
+                table.insert(args, tostring(v))
+            end
+        end
+
+        local expiresAt = tonumber(task.expiresAt)
+        if expiresAt and expiresAt <= cutoff and not task.groupId and not task.sagaId
+            and not task.recordOutcome then
+            redis.call('INCR', streamKey .. ':expired:count')
+            if task.dedupeMode == 'completed' and task.dedupeKey
+                and redis.call('GET', task.dedupeKey) == task.dedupeToken then
+                redis.call('DEL', task.dedupeKey)
+            end
+            if not dropExpired then
+                args[1] = streamKey .. ':expired'
+                table.insert(args, 'expiredAt')
+                table.insert(args, tostring(cutoff))
+                redis.call('XADD', unpack(args))
+            end
+        else
+            redis.call('XADD', unpack(args))
+        end
         redis.call('ZREM', zsetKey, taskData)
+        if indexKey and task.taskId then
+            redis.call('HDEL', indexKey, task.taskId)
+        end
         processed = processed + 1
     end
 end
@@ -98,6 +138,7 @@ func NewScheduler(cfg SchedulerConfig) *Scheduler {
 		queues:    queues,
 		logger:    NewLogger("Scheduler", LoggerConfig{Level: cfg.LogLevel, Silent: cfg.Silent}),
 		prefix:    prefix,
+		expired:   cfg.ExpiredTasks,
 	}
 }
 
@@ -190,16 +231,18 @@ func (s *Scheduler) enqueueTask(ctx context.Context, task *CronTask) {
 // target stream, and removes them from the ZSET in one atomic operation.
 func (s *Scheduler) ProcessScheduledTasks(ctx context.Context, defaultPriority string) (int64, error) {
 	scheduledKey := s.prefix + ":scheduled"
+	indexKey := s.prefix + ":scheduled-index"
 	now := time.Now().UnixMilli()
 
 	if defaultPriority == "" {
 		defaultPriority = "default"
 	}
 
-	result, err := s.redis.Eval(ctx, processScheduledLua, []string{scheduledKey},
+	result, err := s.redis.Eval(ctx, processScheduledLua, []string{scheduledKey, indexKey},
 		now,
 		s.prefix,
 		defaultPriority,
+		string(s.expired),
 	).Result()
 
 	if err != nil {
@@ -0,0 +1,280 @@
+// Package backstage durable signals.
+// Lets a workflow step suspend until an external event arrives, without
+// holding a worker: the wait is stored in Redis and resumed by Signal.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DefaultSignalBuffer is how long a signal nobody waits for is kept when
+// Config.SignalBuffer is not set.
+const DefaultSignalBuffer = time.Hour
+
+// SignalWait suspends a workflow until a signal arrives (see WaitForSignal).
+type SignalWait struct {
+	// Name is the signal to wait for.
+	Name string `json:"name"`
+	// Key correlates the wait with the signal (default: the task's root ID,
+	// see TaskInfo.RootID).
+	Key string `json:"key,omitempty"`
+	// Timeout bounds the wait. Zero waits forever.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// OnTimeout is the task to run if the timeout expires first. Empty ends
+	// the workflow on timeout.
+	OnTimeout string `json:"onTimeout,omitempty"`
+	// TimeoutOptions are the options of the OnTimeout task.
+	TimeoutOptions EnqueueOptions `json:"timeoutOptions,omitempty"`
+}
+
+// SignalResult is the payload of a task resumed by a signal or its timeout.
+type SignalResult struct {
+	Signal string `json:"signal"`
+	Key    string `json:"key"`
+	// Payload is the Payload of the WorkflowInstruction that waited.
+	Payload json.RawMessage `json:"payload"`
+	// Data is the payload passed to Signal; null on timeout.
+	Data json.RawMessage `json:"data"`
+	// TimedOut is set when the task runs because the wait timed out.
+	TimedOut bool `json:"timedOut"`
+}
+
+// WaitForSignal returns an instruction that suspends the workflow until the
+// signal name is sent with Client.Signal, for up to timeout (zero waits
+// forever). Set Next (and Options) on it to the task to resume with and
+// Wait.OnTimeout to the task to run on timeout:
+//
+//	wait := backstage.WaitForSignal("email.confirmed", 72*time.Hour)
+//	wait.Next = "account.activate"
+//	wait.Wait.OnTimeout = "account.remind"
+//	return wait, nil
+//
+// Both tasks receive a SignalResult. The wait is correlated by the task's
+// root ID unless Wait.Key is set.
+func WaitForSignal(name string, timeout time.Duration) *WorkflowInstruction {
+	return &WorkflowInstruction{Wait: &SignalWait{Name: name, Timeout: timeout}}
+}
+
+// waiter is a suspended workflow, stored under its signal.
+type waiter struct {
+	Stream  string   `json:"stream"`
+	Fields  []string `json:"fields"`            // Stream entry of the resumed task, without payload and enqueuedAt
+	Payload string   `json:"payload"`           // Payload of the instruction that waited
+	Timeout string   `json:"timeout,omitempty"` // Task ID of the scheduled timeout task
+	Until   int64    `json:"until,omitempty"`   // Deadline in ms when there is no timeout task
+}
+
+// Lua script that resumes the workflows waiting for a signal.
+// KEYS[1]: waiters hash, KEYS[2]: scheduled set, KEYS[3]: scheduled index,
+// KEYS[4]: signal buffer list, KEYS[5...]: the streams of the waiters
+// ARGV[1]: signal name, ARGV[2]: correlation key, ARGV[3]: signal data JSON,
+// ARGV[4]: now in ms, ARGV[5]: buffer time to live in ms
+//
+// A waiter whose timeout task is still scheduled is resumed and its timeout
+// task removed; one whose timeout already fired is dropped. When no waiter
+// was resumed, the signal is buffered for the next wait to consume. Returns the
+// number of workflows resumed, or -1 without writing anything if a waiter
+// resumes to a stream not in KEYS.
+const signalLua = `
+local waiters = redis.call('HGETALL', KEYS[1])
+local declared = {}
+for i = 5, #KEYS do
+    declared[KEYS[i]] = true
+end
+for i = 2, #waiters, 2 do
+    if not declared[cjson.decode(waiters[i]).stream] then
+        return -1
+    end
+end
+local now = tonumber(ARGV[4])
+local resumed = 0
+for i = 1, #waiters, 2 do
+    local w = cjson.decode(waiters[i + 1])
+    local live = true
+    if w.timeout then
+        local member = redis.call('HGET', KEYS[3], w.timeout)
+        live = member and redis.call('ZREM', KEYS[2], member) == 1
+        redis.call('HDEL', KEYS[3], w.timeout)
+    elseif w['until'] then
+        live = now < w['until']
+    end
+    if live then
+        local fields = w.fields
+        fields[#fields + 1] = 'enqueuedAt'
+        fields[#fields + 1] = ARGV[4]
+        fields[#fields + 1] = 'payload'
+        fields[#fields + 1] = '{"signal":' .. cjson.encode(ARGV[1]) ..
+            ',"key":' .. cjson.encode(ARGV[2]) ..
+            ',"payload":' .. w.payload ..
+            ',"data":' .. ARGV[3] .. ',"timedOut":false}'
+        redis.call('XADD', w.stream, '*', unpack(fields))
+        resumed = resumed + 1
+    end
+end
+redis.call('DEL', KEYS[1])
+if resumed == 0 then
+    redis.call('RPUSH', KEYS[4], ARGV[3])
+    redis.call('PEXPIRE', KEYS[4], ARGV[5])
+end
+return resumed
+`
+
+// waitersKey returns the hash of the workflows waiting for a signal.
+func (c *Client) waitersKey(name, key string) string {
+	return fmt.Sprintf("%s:signal:%s:%s", c.config.Prefix, name, key)
+}
+
+// signalBufferKey returns the list of signals sent while nobody waited.
+func (c *Client) signalBufferKey(name, key string) string {
+	return c.waitersKey(name, key) + ":buffered"
+}
+
+// planWait adds the wait of result, returned by the task info describes, to
+// plan: its waiter entry and timeout task, if any, or the resumed task if a
+// signal was buffered.
+func (c *Client) planWait(plan *atomicPlan, info *TaskInfo, sagaID string, result *WorkflowInstruction) error {
+	wait := result.Wait
+	if wait.Name == "" || result.Next == "" {
+		return errors.New("a signal wait needs a signal name and a Next task")
+	}
+	if wait.Timeout < 0 {
+		return errors.New("signal wait timeout cannot be negative")
+	}
+	if sagaID != "" && wait.Timeout > 0 && wait.OnTimeout == "" {
+		return errors.New("a signal wait of a saga needs an OnTimeout task")
+	}
+	key := wait.Key
+	if key == "" {
+		key = info.RootID
+	}
+
+	payload, err := json.Marshal(result.Payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+
+	// The resumed task, with its payload left out for Signal to fill in
+	opt := result.Options
+	opt.Delay, opt.ProcessAt = 0, time.Time{}
+	resumed, err := c.prepareChild(info, sagaID, NextTask{TaskName: result.Next, Options: opt})
+	if err != nil {
+		return fmt.Errorf("next task (%s): %w", result.Next, err)
+	}
+	if resumed.dedupeKey != "" {
+		return errors.New("a task resumed by a signal cannot be deduplicated")
+	}
+	w := waiter{
+		Stream:  resumed.streamKey,
+		Fields:  resumed.fields("payload", "enqueuedAt"),
+		Payload: string(payload),
+	}
+	plan.record(c, resumed)
+
+	var ttl time.Duration
+	var timeout *preparedTask
+	if wait.Timeout > 0 {
+		ttl = wait.Timeout + time.Hour // Outlive the timeout task
+		if wait.OnTimeout == "" {
+			w.Until = time.Now().Add(wait.Timeout).UnixMilli()
+		} else {
+			timeoutOpt := wait.TimeoutOptions
+			timeoutOpt.Delay, timeoutOpt.ProcessAt = wait.Timeout, time.Time{}
+			timeout, err = c.prepareChild(info, sagaID, NextTask{
+				TaskName: wait.OnTimeout,
+				Payload: SignalResult{
+					Signal:   wait.Name,
+					Key:      key,
+					Payload:  payload,
+					Data:     json.RawMessage("null"),
+					TimedOut: true,
+				},
+				Options: timeoutOpt,
+			})
+			if err != nil {
+				return fmt.Errorf("timeout task (%s): %w", wait.OnTimeout, err)
+			}
+			if timeout.dedupeKey != "" {
+				return errors.New("a signal timeout task cannot be deduplicated")
+			}
+			w.Timeout = timeout.id
+		}
+	}
+
+	raw, err := json.Marshal(w)
+	if err != nil {
+		return fmt.Errorf("marshal wait: %w", err)
+	}
+	waitID, err := newTaskID()
+	if err != nil {
+		return err
+	}
+
+	// A signal buffered before the wait resumes the workflow at once, and
+	// the timeout task is never scheduled
+	name, _ := json.Marshal(wait.Name)
+	keyJSON, _ := json.Marshal(key)
+	head := fmt.Sprintf(`{"signal":%s,"key":%s,"payload":%s,"data":`, name, keyJSON, payload)
+	fields := append(w.Fields, "enqueuedAt", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	cancels := -1
+	if timeout != nil {
+		cancels = len(plan.steps) + 1
+	}
+	plan.hsetUnlessBuffered(c.waitersKey(wait.Name, key), waitID, string(raw), ttl,
+		c.signalBufferKey(wait.Name, key), w.Stream, fields, head, `,"timedOut":false}`, cancels)
+	if timeout != nil {
+		plan.add(c, timeout)
+	}
+	return nil
+}
+
+// Signal sends the signal name to the workflows waiting for it under key
+// (see WaitForSignal). Each resumes with its Next task, whose SignalResult
+// carries payload. Waits that already timed out are not resumed. Returns the
+// number of workflows resumed.
+//
+// A signal that resumes no workflow, because none waits for it yet or every
+// wait already timed out, is buffered for Config.SignalBuffer
+// (default DefaultSignalBuffer): the next wait for it under key consumes it
+// and resumes at once. Buffered signals are consumed one per wait, in order.
+func (c *Client) Signal(ctx context.Context, key, name string, payload interface{}) (int, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("marshal payload: %w", err)
+	}
+	buffer := c.config.SignalBuffer
+	if buffer <= 0 {
+		buffer = DefaultSignalBuffer
+	}
+	keys := []string{c.waitersKey(name, key), c.scheduledKey(), c.scheduledIndexKey(), c.signalBufferKey(name, key)}
+	for {
+		// Declare the streams of the current waiters; a wait added meanwhile
+		// makes the script ask again
+		raws, err := c.redis.HVals(ctx, keys[0]).Result()
+		if err != nil {
+			return 0, fmt.Errorf("signal: %w", err)
+		}
+		streams := append([]string{}, keys...)
+		seen := make(map[string]bool, len(raws))
+		for _, raw := range raws {
+			var w waiter
+			if json.Unmarshal([]byte(raw), &w) == nil && !seen[w.Stream] {
+				seen[w.Stream] = true
+				streams = append(streams, w.Stream)
+			}
+		}
+		n, err := c.redis.Eval(ctx, signalLua, streams,
+			name, key, string(data), time.Now().UnixMilli(), buffer.Milliseconds(),
+		).Int()
+		if err != nil {
+			return 0, fmt.Errorf("signal: %w", err)
+		}
+		if n >= 0 {
+			return n, nil
+		}
+	}
+}
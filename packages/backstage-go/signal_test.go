@@ -0,0 +1,151 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newApprovalClient registers a workflow that waits up to timeout for an
+// "approved" signal, then runs "expense.pay" or, on timeout, "expense.expire".
+func newApprovalClient(t *testing.T, prefix string, timeout time.Duration) (*Client, map[string]SignalResult) {
+	client := newIsolatedClient(t, prefix)
+	client.initConsumerGroups(context.Background())
+
+	got := make(map[string]SignalResult)
+	client.On("expense.submit", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		wait := WaitForSignal("approved", timeout)
+		wait.Next = "expense.pay"
+		wait.Payload = map[string]int{"amount": 42}
+		wait.Wait.OnTimeout = "expense.expire"
+		return wait, nil
+	})
+	for _, name := range []string{"expense.pay", "expense.expire"} {
+		name := name
+		client.On(name, func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+			var res SignalResult
+			if err := json.Unmarshal(payload, &res); err != nil {
+				return nil, err
+			}
+			got[name] = res
+			return nil, nil
+		})
+	}
+	return client, got
+}
+
+func TestSignalResumesWorkflow(t *testing.T) {
+	client, got := newApprovalClient(t, "test-signal", time.Hour)
+	ctx := context.Background()
+
+	rootID, _ := client.Enqueue(ctx, "expense.submit", nil)
+	runMembers(t, client, 1)
+	if len(client.ackChan) != 0 {
+		t.Error("expected the waiting task acknowledged with its wait, not queued")
+	}
+	if n, _ := client.redis.ZCard(ctx, client.scheduledKey()).Result(); n != 1 {
+		t.Fatalf("expected the timeout task scheduled, got %d", n)
+	}
+
+	n, err := client.Signal(ctx, rootID, "approved", map[string]string{"by": "alice"})
+	if err != nil || n != 1 {
+		t.Fatalf("expected one workflow resumed, got %d, %v", n, err)
+	}
+	runMembers(t, client, 1)
+
+	res, ok := got["expense.pay"]
+	if !ok || res.TimedOut || res.Signal != "approved" || res.Key != rootID {
+		t.Fatalf("expected expense.pay resumed by the signal, got %+v", res)
+	}
+	if string(res.Payload) != `{"amount":42}` || string(res.Data) != `{"by":"alice"}` {
+		t.Errorf("expected the wait's payload and the signal data, got %s and %s", res.Payload, res.Data)
+	}
+	if n, _ := client.redis.ZCard(ctx, client.scheduledKey()).Result(); n != 0 {
+		t.Errorf("expected the timeout task cancelled, %d scheduled", n)
+	}
+	if n, _ := client.Signal(ctx, rootID, "approved", nil); n != 0 {
+		t.Errorf("expected a repeated signal to resume nothing, got %d", n)
+	}
+
+	tree, _ := client.GetLineage(ctx, rootID)
+	var names []string
+	for _, child := range tree.Children {
+		names = append(names, child.TaskName)
+	}
+	if len(names) != 2 {
+		t.Errorf("expected the resumed and timeout tasks in the lineage, got %v", names)
+	}
+}
+
+func TestSignalBufferedBeforeWait(t *testing.T) {
+	client, got := newApprovalClient(t, "test-signal-buffered", time.Hour)
+	ctx := context.Background()
+
+	rootID, _ := client.Enqueue(ctx, "expense.submit", nil)
+	if n, err := client.Signal(ctx, rootID, "approved", map[string]string{"by": "bob"}); err != nil || n != 0 {
+		t.Fatalf("expected the early signal buffered, got %d, %v", n, err)
+	}
+	runMembers(t, client, 1) // Waits and consumes the buffered signal
+
+	if n, _ := client.redis.ZCard(ctx, client.scheduledKey()).Result(); n != 0 {
+		t.Errorf("expected no timeout task scheduled, got %d", n)
+	}
+	if n, _ := client.redis.Exists(ctx, client.waitersKey("approved", rootID), client.signalBufferKey("approved", rootID)).Result(); n != 0 {
+		t.Errorf("expected no waiter registered and the buffer consumed, %d keys left", n)
+	}
+	runMembers(t, client, 1)
+
+	res, ok := got["expense.pay"]
+	if !ok || res.TimedOut || string(res.Data) != `{"by":"bob"}` || string(res.Payload) != `{"amount":42}` {
+		t.Fatalf("expected expense.pay resumed by the buffered signal, got %+v", res)
+	}
+}
+
+func TestSignalTimeout(t *testing.T) {
+	client, got := newApprovalClient(t, "test-signal-timeout", time.Hour)
+	ctx := context.Background()
+
+	rootID, _ := client.Enqueue(ctx, "expense.submit", nil)
+	runMembers(t, client, 1)
+
+	// Make the timeout due
+	members, _ := client.redis.ZRange(ctx, client.scheduledKey(), 0, -1).Result()
+	client.redis.ZAdd(ctx, client.scheduledKey(), redis.Z{Score: 1, Member: members[0]})
+	moveDue(t, client)
+	runMembers(t, client, 1)
+
+	res, ok := got["expense.expire"]
+	if !ok || !res.TimedOut || string(res.Payload) != `{"amount":42}` || string(res.Data) != "null" {
+		t.Fatalf("expected expense.expire run on timeout, got %+v", res)
+	}
+	if n, _ := client.Signal(ctx, rootID, "approved", nil); n != 0 {
+		t.Errorf("expected a late signal to resume nothing, got %d", n)
+	}
+	if n, _ := client.redis.LLen(ctx, client.signalBufferKey("approved", rootID)).Result(); n != 1 {
+		t.Errorf("expected the late signal buffered for the next wait, got %d", n)
+	}
+	if _, ok := got["expense.pay"]; ok {
+		t.Error("expected expense.pay not to run after the timeout")
+	}
+}
+
+func TestSignalWaitNeedsNext(t *testing.T) {
+	client := newIsolatedClient(t, "test-signal-invalid")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	client.On("expense.submit", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		return WaitForSignal("approved", 0), nil
+	})
+	client.Enqueue(ctx, "expense.submit", nil)
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	pending, _ := client.redis.XPending(ctx, stream, client.config.ConsumerGroup).Result()
+	if pending.Count != 1 || len(client.ackChan) != 0 {
+		t.Errorf("expected the task left pending, %d pending", pending.Count)
+	}
+}
@@ -0,0 +1,77 @@
+// Package backstage durable step memoization.
+// Persists the result of each named step of a handler so that a retry skips
+// the steps that already completed.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// stepsTTL bounds how long memoized steps outlive a task that is never
+// acknowledged nor dead-lettered (e.g. its stream was purged).
+const stepsTTL = 7 * 24 * time.Hour
+
+// stepsKey returns the hash holding the memoized steps of a task.
+func (c *Client) stepsKey(taskID string) string {
+	return fmt.Sprintf("%s:steps:%s", c.config.Prefix, taskID)
+}
+
+// Step runs fn as a named, durable step of the task running in ctx.
+// The first time the step succeeds its result is persisted under the task ID;
+// when the task is retried after a later failure, Step returns the saved
+// result instead of running fn again:
+//
+//	charge, err := backstage.Step(ctx, "charge", func(ctx context.Context) (ChargeResult, error) {
+//	    return payments.Charge(ctx, order)
+//	})
+//
+// Step names must be unique within a handler and results must round-trip
+// through JSON. Saved steps are deleted once the task is acknowledged or
+// dead-lettered. A failed fn is not saved and runs again on the next attempt.
+// Step returns ErrNoTask when called outside a handler.
+func Step[T any](ctx context.Context, name string, fn func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+
+	info, ok := TaskInfoFromContext(ctx)
+	if !ok || info.client == nil {
+		return result, ErrNoTask
+	}
+	c := info.client
+	key := c.stepsKey(info.TaskID)
+	info.usedSteps.Store(true)
+
+	saved, err := c.redis.HGet(ctx, key, name).Bytes()
+	if err == nil {
+		if err := json.Unmarshal(saved, &result); err != nil {
+			return result, fmt.Errorf("decode step %q: %w", name, err)
+		}
+		return result, nil
+	}
+	if err != redis.Nil {
+		return result, fmt.Errorf("load step %q: %w", name, err)
+	}
+
+	result, err = fn(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return result, fmt.Errorf("encode step %q: %w", name, err)
+	}
+	_, err = c.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, name, data)
+		pipe.Expire(ctx, key, stepsTTL)
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("save step %q: %w", name, err)
+	}
+	return result, nil
+}
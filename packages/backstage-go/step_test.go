@@ -0,0 +1,80 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStepMemoizesAcrossRetries(t *testing.T) {
+	client := newIsolatedClient(t, "test-steps")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	flushCtx, stopFlusher := context.WithCancel(ctx)
+	defer stopFlusher()
+	go client.runAckFlusher(flushCtx)
+
+	charges, emails := 0, 0
+	failEmail := true
+	client.On("order.checkout", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		chargeID, err := Step(ctx, "charge", func(ctx context.Context) (string, error) {
+			charges++
+			return "ch_123", nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = Step(ctx, "email", func(ctx context.Context) (bool, error) {
+			emails++
+			if failEmail {
+				return false, errors.New("smtp down")
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if chargeID != "ch_123" {
+			return nil, errors.New("unexpected charge ID " + chargeID)
+		}
+		return nil, nil
+	})
+
+	id, _ := client.Enqueue(ctx, "order.checkout", nil)
+	msg := readOne(t, client, stream)
+
+	client.handleMessage(ctx, stream, msg) // charge runs, email fails
+	failEmail = false
+	client.handleMessage(ctx, stream, msg) // charge replayed, email runs
+
+	if charges != 1 {
+		t.Errorf("expected charge to run once, ran %d times", charges)
+	}
+	if emails != 2 {
+		t.Errorf("expected email to run twice, ran %d times", emails)
+	}
+
+	// Saved steps are removed once the task is acknowledged
+	deadline := time.Now().Add(time.Second)
+	for client.redis.Exists(ctx, client.stepsKey(id)).Val() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected saved steps to be cleaned up after ACK")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStepOutsideHandler(t *testing.T) {
+	_, err := Step(context.Background(), "noop", func(ctx context.Context) (int, error) {
+		return 1, nil
+	})
+	if err != ErrNoTask {
+		t.Errorf("expected ErrNoTask, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// Package backstage task metadata.
+// Exposes details about the running task (message ID, attempt, deadline, ...)
+// to handlers through their context.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TaskInfo describes the task a handler is currently running.
+// The consumer attaches it to the handler's context; read it with
+// TaskInfoFromContext.
+type TaskInfo struct {
+	Message // ID, TaskName, Payload, EnqueuedAt and DeliveryCount of the task
+
+	// TaskID is the ID Enqueue returned for the task. It equals the message
+	// ID, except for delayed tasks and tasks enqueued by another task, whose
+	// ID was assigned before they reached the stream.
+	TaskID string
+	// ParentID is the task ID of the task that enqueued this one, from its
+	// handler or through a WorkflowInstruction; empty for a root task.
+	ParentID string
+	// RootID is the task ID of the root of this task's lineage (see
+	// GetLineage); the task's own ID for a root task.
+	RootID string
+	// Stream is the stream key the message was read from.
+	Stream string
+	// MaxAttempts is the number of deliveries allowed before the task is
+	// dead-lettered: EnqueueOptions.Attempts if set, otherwise derived from
+	// ConsumerConfig.MaxDeliveries. Zero if unknown.
+	MaxAttempts int
+	// Deadline is when the task's timeout or its workflow's deadline
+	// expires, whichever comes first; zero if it has neither.
+	Deadline time.Time
+	// WorkflowDeadline is when the task's workflow is cancelled (see
+	// EnqueueOptions.WorkflowTimeout); zero if it has no deadline.
+	WorkflowDeadline time.Time
+	// ExpiresAt is when the task stops being worth running
+	// (EnqueueOptions.ExpiresAt); zero if it never expires.
+	ExpiresAt time.Time
+	// StartedAt is when this delivery was handed to the handler.
+	StartedAt time.Time
+	// WorkerID identifies the worker running the task.
+	WorkerID string
+	// Headers are the task's EnqueueOptions.Headers; nil if it has none.
+	Headers map[string]string
+
+	client    *Client
+	progress  *progressState
+	usedSteps atomic.Bool
+	result    json.RawMessage // Set by SetResult
+}
+
+type taskInfoKey struct{}
+
+// TaskInfoFromContext returns the TaskInfo of the task running in ctx.
+// The second result is false outside of a handler.
+func TaskInfoFromContext(ctx context.Context) (*TaskInfo, bool) {
+	info, ok := ctx.Value(taskInfoKey{}).(*TaskInfo)
+	return info, ok
+}
+
+// withTaskInfo returns a copy of ctx carrying info.
+func withTaskInfo(ctx context.Context, info *TaskInfo) context.Context {
+	return context.WithValue(ctx, taskInfoKey{}, info)
+}
+
+// HeadersFromContext returns the headers of the task running in ctx, or nil
+// outside of a handler or if the task has none.
+func HeadersFromContext(ctx context.Context) map[string]string {
+	if info, ok := TaskInfoFromContext(ctx); ok {
+		return info.Headers
+	}
+	return nil
+}
+
+// messageHeaders decodes the headers field of msg.
+func messageHeaders(msg redis.XMessage) map[string]string {
+	raw, _ := msg.Values["headers"].(string)
+	if raw == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		return nil
+	}
+	return headers
+}
+
+// Attempt returns the delivery number of this run, starting at 1.
+func (t *TaskInfo) Attempt() int {
+	return t.DeliveryCount
+}
+
+// IsLastAttempt reports whether a failure of this run will dead-letter the
+// task instead of retrying it.
+func (t *TaskInfo) IsLastAttempt() bool {
+	return t.MaxAttempts > 0 && t.DeliveryCount >= t.MaxAttempts
+}
+
+// QueueLatency returns how long the task waited between being enqueued and
+// this delivery starting.
+func (t *TaskInfo) QueueLatency() time.Duration {
+	if t.EnqueuedAt == 0 {
+		return 0
+	}
+	return t.StartedAt.Sub(time.UnixMilli(t.EnqueuedAt))
+}
+
+// messageTaskID returns the task ID of msg: the ID assigned at scheduling
+// time if any, otherwise the message ID.
+func messageTaskID(msg redis.XMessage) string {
+	if id, ok := msg.Values["taskId"].(string); ok && id != "" {
+		return id
+	}
+	return msg.ID
+}
+
+// newTaskInfo builds the TaskInfo for a delivery of msg.
+func (c *Client) newTaskInfo(streamKey string, msg redis.XMessage, deliveries int) *TaskInfo {
+	taskName, _ := msg.Values["taskName"].(string)
+	payloadStr, _ := msg.Values["payload"].(string)
+	enqueuedAt, _ := asInt64(msg.Values["enqueuedAt"])
+
+	info := &TaskInfo{
+		Message: Message{
+			ID:            msg.ID,
+			TaskName:      taskName,
+			Payload:       json.RawMessage(payloadStr),
+			EnqueuedAt:    enqueuedAt,
+			DeliveryCount: deliveries,
+		},
+		TaskID:    messageTaskID(msg),
+		Stream:    streamKey,
+		StartedAt: time.Now(),
+		WorkerID:  c.config.WorkerID,
+		Headers:   messageHeaders(msg),
+		client:    c,
+		progress:  &progressState{},
+	}
+
+	info.ParentID, _ = msg.Values["parentId"].(string)
+	info.RootID, _ = msg.Values["rootId"].(string)
+	if info.RootID == "" {
+		info.RootID = info.TaskID
+	}
+
+	if deadline, _ := asInt64(msg.Values["workflowDeadline"]); deadline > 0 {
+		info.WorkflowDeadline = time.UnixMilli(deadline)
+	}
+
+	if expiresAt := messageExpiresAt(msg); expiresAt > 0 {
+		info.ExpiresAt = time.UnixMilli(expiresAt)
+	}
+
+	if attempts, ok := asInt64(msg.Values["attempts"]); ok && attempts > 0 {
+		info.MaxAttempts = int(attempts)
+	} else if c.maxDeliveries > 0 {
+		// The reclaimer dead-letters once a message was delivered more than
+		// MaxDeliveries times, so the last run is delivery MaxDeliveries+1.
+		info.MaxAttempts = c.maxDeliveries + 1
+	}
+
+	return info
+}
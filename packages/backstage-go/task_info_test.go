@@ -0,0 +1,140 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTaskInfoFromContext(t *testing.T) {
+	client := newIsolatedClient(t, "test-task-info")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	var got *TaskInfo
+	client.On("info.task", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		info, ok := TaskInfoFromContext(ctx)
+		if !ok {
+			return nil, errors.New("no task info")
+		}
+		got = info
+		return nil, nil
+	})
+
+	id, _ := client.Enqueue(ctx, "info.task", map[string]int{"n": 1}, EnqueueOptions{
+		Attempts: 3,
+		Timeout:  time.Minute,
+	})
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	if got == nil {
+		t.Fatal("handler did not receive TaskInfo")
+	}
+	if got.ID != id || got.TaskName != "info.task" || got.Stream != stream {
+		t.Errorf("unexpected identity: %+v", got)
+	}
+	if got.Attempt() != 1 || got.MaxAttempts != 3 || got.IsLastAttempt() {
+		t.Errorf("unexpected attempt info: attempt=%d max=%d", got.Attempt(), got.MaxAttempts)
+	}
+	if got.WorkerID != "test-worker" {
+		t.Errorf("expected worker ID, got %q", got.WorkerID)
+	}
+	if got.Deadline.IsZero() || time.Until(got.Deadline) > time.Minute {
+		t.Errorf("unexpected deadline: %v", got.Deadline)
+	}
+	if got.EnqueuedAt == 0 || got.QueueLatency() < 0 {
+		t.Errorf("unexpected enqueue time: %d", got.EnqueuedAt)
+	}
+	if string(got.Payload) != `{"n":1}` {
+		t.Errorf("unexpected payload: %s", got.Payload)
+	}
+}
+
+func TestTaskInfoOutsideHandler(t *testing.T) {
+	if _, ok := TaskInfoFromContext(context.Background()); ok {
+		t.Error("expected no TaskInfo outside a handler")
+	}
+}
+
+func TestTaskInfoLastAttempt(t *testing.T) {
+	client := newIsolatedClient(t, "test-task-info-retry")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	var attempts []int
+	var last []bool
+	client.On("info.flaky", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		info, _ := TaskInfoFromContext(ctx)
+		attempts = append(attempts, info.Attempt())
+		last = append(last, info.IsLastAttempt())
+		return nil, errors.New("still failing")
+	})
+
+	client.Enqueue(ctx, "info.flaky", nil, EnqueueOptions{Attempts: 2})
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	cfg := DefaultConsumerConfig()
+	cfg.IdleTimeout = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	client.reclaimIdleMessages(ctx, cfg) // second delivery
+	time.Sleep(5 * time.Millisecond)
+	client.reclaimIdleMessages(ctx, cfg) // attempts exhausted: dead-letter
+
+	if len(attempts) != 2 || attempts[1] != 2 {
+		t.Fatalf("expected two runs, got attempts %v", attempts)
+	}
+	if last[0] || !last[1] {
+		t.Errorf("expected only the second run to be the last attempt, got %v", last)
+	}
+	if n := client.redis.XLen(ctx, client.deadLetterKey(PriorityDefault)).Val(); n != 1 {
+		t.Errorf("expected task to be dead-lettered after 2 attempts, got %d", n)
+	}
+}
+
+func TestAttemptsOverrideMaxDeliveries(t *testing.T) {
+	client := newIsolatedClient(t, "test-attempts-override")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+	client.initConsumerGroups(ctx)
+
+	runs := map[string]int{}
+	client.On("attempts.fail", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		var p struct{ Name string }
+		json.Unmarshal(payload, &p)
+		runs[p.Name]++
+		return nil, errors.New("still failing")
+	})
+
+	client.Enqueue(ctx, "attempts.fail", map[string]string{"name": "limited"}, EnqueueOptions{Attempts: 3})
+	client.Enqueue(ctx, "attempts.fail", map[string]string{"name": "default"}, EnqueueOptions{})
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+	client.handleMessage(ctx, stream, readOne(t, client, stream))
+
+	// MaxDeliveries of 1 would dead-letter both tasks on the first reclaim;
+	// the task with Attempts gets its three deliveries regardless
+	cfg := DefaultConsumerConfig()
+	cfg.IdleTimeout = time.Millisecond
+	cfg.MaxDeliveries = 1
+	for i := 0; i < 4; i++ {
+		time.Sleep(5 * time.Millisecond)
+		client.reclaimIdleMessages(ctx, cfg)
+		for len(client.ackChan) > 0 {
+			req := <-client.ackChan
+			client.ackAndMaybeDelete(ctx, req.stream, []string{req.id}, req.cleanup)
+		}
+	}
+
+	if runs["limited"] != 3 {
+		t.Errorf("expected the task with Attempts to run 3 times, got %d", runs["limited"])
+	}
+	if runs["default"] != 2 {
+		t.Errorf("expected the task without Attempts to run MaxDeliveries+1 times, got %d", runs["default"])
+	}
+	if n := client.redis.XLen(ctx, client.deadLetterKey(PriorityDefault)).Val(); n != 2 {
+		t.Errorf("expected both tasks dead-lettered, got %d", n)
+	}
+}
@@ -0,0 +1,123 @@
+// Package backstage task state tracking.
+// Records the latest state of every task a consumer handles when
+// Config.TrackTasks is set.
+package backstage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// taskStateTTL is how long a task's state is kept after its last change.
+const taskStateTTL = 7 * 24 * time.Hour
+
+// TaskStatus is the state of a tracked task.
+type TaskStatus string
+
+const (
+	TaskRunning      TaskStatus = "running"       // Handed to a handler
+	TaskSucceeded    TaskStatus = "succeeded"     // Handler succeeded
+	TaskRetrying     TaskStatus = "retrying"      // Handler failed; will be retried
+	TaskDeadLettered TaskStatus = "dead-lettered" // Out of attempts
+	TaskExpired      TaskStatus = "expired"       // Discarded past its expiry
+	TaskSkipped      TaskStatus = "skipped"       // Dropped: its workflow stopped
+)
+
+// TaskState is the latest recorded state of a task.
+type TaskState struct {
+	TaskID   string
+	TaskName string
+	Status   TaskStatus
+	// Attempt is the delivery the state was recorded for (0 if unknown).
+	Attempt  int
+	WorkerID string
+	// Error is the handler's error when Status is TaskRetrying.
+	Error     string
+	UpdatedAt time.Time
+}
+
+// taskStateKey returns the hash holding the state of a task.
+func (c *Client) taskStateKey(taskID string) string {
+	return fmt.Sprintf("%s:task:%s", c.config.Prefix, taskID)
+}
+
+// trackTask records the state of the task of msg, if Config.TrackTasks is
+// set. Tracking is best-effort: failures are logged, not returned.
+func (c *Client) trackTask(ctx context.Context, msg redis.XMessage, status TaskStatus, attempt int, taskErr error) {
+	if !c.config.TrackTasks {
+		return
+	}
+	key := c.taskStateKey(messageTaskID(msg))
+	errMsg := ""
+	if taskErr != nil {
+		errMsg = taskErr.Error()
+	}
+
+	pipe := c.redis.Pipeline()
+	pipe.HSet(ctx, key,
+		"taskName", msg.Values["taskName"],
+		"status", string(status),
+		"attempt", attempt,
+		"workerId", c.config.WorkerID,
+		"error", errMsg,
+		"updatedAt", time.Now().UnixMilli(),
+	)
+	pipe.PExpire(ctx, key, taskStateTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.logger.Warn("Failed to track task", "task", msg.ID, "error", err)
+	}
+}
+
+// GetTaskState returns the latest recorded state of a task, identified by
+// its task ID (see TaskInfo.TaskID). Returns ErrTaskNotFound if none was
+// recorded: the task has not been delivered yet, its state expired, or
+// Config.TrackTasks is off on the consumers.
+func (c *Client) GetTaskState(ctx context.Context, taskID string) (*TaskState, error) {
+	states, err := c.getTaskStates(ctx, []string{taskID})
+	if err != nil {
+		return nil, err
+	}
+	state, ok := states[taskID]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	return state, nil
+}
+
+// getTaskStates returns the recorded states of tasks, by task ID. Tasks
+// without one are left out.
+func (c *Client) getTaskStates(ctx context.Context, ids []string) (map[string]*TaskState, error) {
+	pipe := c.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, c.taskStateKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("get task states: %w", err)
+	}
+
+	states := make(map[string]*TaskState, len(ids))
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		state := &TaskState{
+			TaskID:   ids[i],
+			TaskName: fields["taskName"],
+			Status:   TaskStatus(fields["status"]),
+			WorkerID: fields["workerId"],
+			Error:    fields["error"],
+		}
+		state.Attempt, _ = strconv.Atoi(fields["attempt"])
+		if ms, err := strconv.ParseInt(fields["updatedAt"], 10, 64); err == nil {
+			state.UpdatedAt = time.UnixMilli(ms)
+		}
+		states[ids[i]] = state
+	}
+	return states, nil
+}
@@ -31,18 +31,22 @@ func asInt64(val interface{}) (int64, bool) {
 
 // QueueInfo contains statistics about a specific queue.
 type QueueInfo struct {
-	Name       string
-	Pending    int64 // Number of messages waiting in the stream
-	Scheduled  int64 // Number of tasks scheduled for future execution (in ZSET)
-	DeadLetter int64 // Number of messages in the dead letter queue
+	Name        string
+	Pending     int64 // Number of messages waiting in the stream
+	Scheduled   int64 // Number of tasks scheduled for future execution (in ZSET)
+	DeadLetter  int64 // Number of messages in the dead letter queue
+	Quarantined int64 // Number of messages quarantined for unknown task names
+	Expired     int64 // Number of tasks discarded past their expiry
 }
 
 // QueuesInfo aggregates statistics for multiple queues.
 type QueuesInfo struct {
-	Queues         []QueueInfo
-	TotalPending   int64
-	TotalScheduled int64
-	TotalDL        int64
+	Queues           []QueueInfo
+	TotalPending     int64
+	TotalScheduled   int64
+	TotalDL          int64
+	TotalQuarantined int64
+	TotalExpired     int64
 }
 
 // Inspect retrieves current statistics for the provided list of queues.
@@ -53,17 +57,23 @@ func Inspect(ctx context.Context, rdb *redis.Client, queues []*Queue) (*QueuesIn
 		pending, _ := rdb.XLen(ctx, q.StreamKey()).Result()
 		scheduled, _ := rdb.ZCard(ctx, q.ScheduledKey()).Result()
 		dl, _ := rdb.XLen(ctx, q.DeadLetterKey()).Result()
+		quarantined, _ := rdb.XLen(ctx, q.QuarantineKey()).Result()
+		expired, _ := rdb.Get(ctx, q.ExpiredCountKey()).Int64()
 
 		info.Queues = append(info.Queues, QueueInfo{
-			Name:       q.Name,
-			Pending:    pending,
-			Scheduled:  scheduled,
-			DeadLetter: dl,
+			Name:        q.Name,
+			Pending:     pending,
+			Scheduled:   scheduled,
+			DeadLetter:  dl,
+			Quarantined: quarantined,
+			Expired:     expired,
 		})
 
 		info.TotalPending += pending
 		info.TotalScheduled += scheduled
 		info.TotalDL += dl
+		info.TotalQuarantined += quarantined
+		info.TotalExpired += expired
 	}
 
 	return info, nil
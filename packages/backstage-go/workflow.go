@@ -0,0 +1,513 @@
+// Package backstage DAG workflows.
+// Runs a graph of tasks whose edges are dependencies. The state of each run
+// is persisted in Redis and advanced by the workers as nodes finish, so a run
+// survives worker crashes.
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultWorkflowTTL is how long workflow state is kept when Workflow.TTL is
+// not set.
+const DefaultWorkflowTTL = 7 * 24 * time.Hour
+
+// WorkflowStatus is the state of a workflow run.
+type WorkflowStatus string
+
+const (
+	WorkflowRunning   WorkflowStatus = "running"
+	WorkflowCompleted WorkflowStatus = "completed"
+	WorkflowFailed    WorkflowStatus = "failed"
+	WorkflowCancelled WorkflowStatus = "cancelled"
+)
+
+// NodeStatus is the state of one node of a workflow run.
+type NodeStatus string
+
+const (
+	NodePending   NodeStatus = "pending"   // Waiting for its dependencies
+	NodeQueued    NodeStatus = "queued"    // Enqueued, not started yet
+	NodeRunning   NodeStatus = "running"   // Handed to a handler
+	NodeSucceeded NodeStatus = "succeeded" // Handler succeeded
+	NodeFailed    NodeStatus = "failed"    // Dead-lettered or expired
+	NodeSkipped   NodeStatus = "skipped"   // Not run because another node failed
+	NodeCancelled NodeStatus = "cancelled" // Not run because the run was cancelled
+)
+
+// WorkflowNode is one task of a workflow.
+type WorkflowNode struct {
+	// Name identifies the node within its workflow.
+	Name string
+	// TaskName is the task to run (default: Name).
+	TaskName string
+	Payload  interface{}
+	// DependsOn lists the nodes that must succeed before this one runs.
+	DependsOn []string
+	// Options are the node task's options. Nodes cannot be delayed,
+	// deduplicated, debounced, throttled or have dependencies; TTL counts
+	// from the start of the run.
+	Options EnqueueOptions
+}
+
+// Workflow is a directed acyclic graph of tasks.
+type Workflow struct {
+	Name  string
+	Nodes []WorkflowNode
+	// TTL is how long the run's state is kept after it starts (default:
+	// DefaultWorkflowTTL). Nodes finishing after that do not advance it.
+	TTL time.Duration
+}
+
+// WorkflowState is the state of a workflow run, as returned by GetWorkflow.
+type WorkflowState struct {
+	ID     string
+	Name   string
+	Status WorkflowStatus
+	// Nodes are in definition order.
+	Nodes      []NodeState
+	StartedAt  time.Time
+	FinishedAt time.Time // Zero while running
+}
+
+// NodeState is the state of one node of a workflow run.
+type NodeState struct {
+	Name      string
+	TaskName  string
+	DependsOn []string
+	Status    NodeStatus
+	// Result is the node's SetResult value; nil if it has none.
+	Result json.RawMessage
+}
+
+// workflowNodeDef is a node as stored with its run, ready for the scripts.
+type workflowNodeDef struct {
+	Name     string   `json:"name"`
+	TaskName string   `json:"taskName"`
+	Deps     []string `json:"deps"`
+	Stream   string   `json:"stream"`
+	Fields   []string `json:"fields"` // Stream entry field/value pairs
+}
+
+// Lua script that records a finished workflow node and advances its run.
+// KEYS[1]: workflow hash, KEYS[2]: results hash, KEYS[3...]: the streams
+// of the run's nodes
+// ARGV[1]: node name, ARGV[2]: "1" if the node failed, ARGV[3]: result JSON
+// ("" for none), ARGV[4]: now in ms
+//
+// A node is only recorded once. On success, every pending node whose
+// dependencies have all succeeded is enqueued, stamped with ARGV[4] as its
+// enqueue time. A failure fails the run and
+// skips the nodes that have not started. Returns 1 when the run completed,
+// 2 when it failed, 0 otherwise.
+const workflowAdvanceLua = `
+local key = KEYS[1]
+local status = redis.call('HGET', key, 'status')
+local node = 'node:' .. ARGV[1]
+local current = redis.call('HGET', key, node)
+if not status or (current ~= 'queued' and current ~= 'running') then
+    return 0
+end
+
+local nodes = cjson.decode(redis.call('HGET', key, 'nodes'))
+
+if ARGV[2] == '1' then
+    redis.call('HSET', key, node, 'failed')
+    if status ~= 'running' then
+        return 0
+    end
+    redis.call('HSET', key, 'status', 'failed', 'finishedAt', ARGV[4])
+    for _, n in ipairs(nodes) do
+        local s = redis.call('HGET', key, 'node:' .. n.name)
+        if s == 'pending' or s == 'queued' then
+            redis.call('HSET', key, 'node:' .. n.name, 'skipped')
+        end
+    end
+    return 2
+end
+
+redis.call('HSET', key, node, 'succeeded')
+if ARGV[3] ~= '' then
+    redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+    local ttl = redis.call('PTTL', key)
+    if ttl > 0 then
+        redis.call('PEXPIRE', KEYS[2], ttl)
+    end
+end
+if status ~= 'running' then
+    return 0
+end
+
+local done = true
+for _, n in ipairs(nodes) do
+    local s = redis.call('HGET', key, 'node:' .. n.name)
+    if s == 'pending' then
+        local ready = true
+        for _, dep in ipairs(n.deps) do
+            if redis.call('HGET', key, 'node:' .. dep) ~= 'succeeded' then
+                ready = false
+                break
+            end
+        end
+        if ready then
+            redis.call('XADD', n.stream, '*', 'enqueuedAt', ARGV[4], unpack(n.fields))
+            redis.call('HSET', key, 'node:' .. n.name, 'queued')
+            s = 'queued'
+        end
+    end
+    if s ~= 'succeeded' then
+        done = false
+    end
+end
+if done then
+    redis.call('HSET', key, 'status', 'completed', 'finishedAt', ARGV[4])
+    return 1
+end
+return 0
+`
+
+// Lua script that marks a workflow node as running if its run still is.
+// KEYS[1]: workflow hash
+// ARGV[1]: node name
+// Returns the run's status and the node's status before the call, or
+// {"", ""} if the run is unknown. Only a queued node is marked running; a
+// running one is being redelivered.
+const workflowStartNodeLua = `
+local status = redis.call('HGET', KEYS[1], 'status')
+if not status then
+    return {'', ''}
+end
+local node = redis.call('HGET', KEYS[1], 'node:' .. ARGV[1]) or ''
+if status == 'running' and node == 'queued' then
+    redis.call('HSET', KEYS[1], 'node:' .. ARGV[1], 'running')
+end
+return {status, node}
+`
+
+// Lua script that cancels a workflow run.
+// KEYS[1]: workflow hash
+// ARGV[1]: now in ms
+// Nodes that have not started are cancelled; running ones finish but do not
+// advance the run. Returns the run's previous status, or "" if it is unknown.
+const workflowCancelLua = `
+local status = redis.call('HGET', KEYS[1], 'status')
+if not status then
+    return ''
+end
+if status ~= 'running' then
+    return status
+end
+redis.call('HSET', KEYS[1], 'status', 'cancelled', 'finishedAt', ARGV[1])
+for _, n in ipairs(cjson.decode(redis.call('HGET', KEYS[1], 'nodes'))) do
+    local s = redis.call('HGET', KEYS[1], 'node:' .. n.name)
+    if s == 'pending' or s == 'queued' then
+        redis.call('HSET', KEYS[1], 'node:' .. n.name, 'cancelled')
+    end
+end
+return status
+`
+
+// errNodeFinished reports a workflow node delivered again after it finished.
+var errNodeFinished = errors.New("workflow node already finished")
+
+// workflowKey returns the hash holding a workflow run's state.
+func (c *Client) workflowKey(id string) string {
+	return fmt.Sprintf("%s:workflow:%s", c.config.Prefix, id)
+}
+
+// workflowResultsKey returns the hash holding a workflow run's node results.
+func (c *Client) workflowResultsKey(id string) string {
+	return c.workflowKey(id) + ":results"
+}
+
+// validateWorkflow checks that wf is a well-formed DAG.
+func validateWorkflow(wf Workflow) error {
+	if len(wf.Nodes) == 0 {
+		return errors.New("workflow has no nodes")
+	}
+	deps := make(map[string][]string, len(wf.Nodes))
+	for _, n := range wf.Nodes {
+		if n.Name == "" {
+			return errors.New("workflow node has no name")
+		}
+		if _, ok := deps[n.Name]; ok {
+			return fmt.Errorf("duplicate workflow node %q", n.Name)
+		}
+		deps[n.Name] = n.DependsOn
+	}
+	for name, ds := range deps {
+		for _, d := range ds {
+			if _, ok := deps[d]; !ok {
+				return fmt.Errorf("workflow node %q depends on unknown node %q", name, d)
+			}
+		}
+	}
+
+	// Depth-first search for a cycle
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(deps))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("workflow has a cycle through node %q", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, d := range deps[name] {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, n := range wf.Nodes {
+		if err := visit(n.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartWorkflow starts a run of wf: its state is persisted and the nodes
+// without dependencies are enqueued, atomically. Workers enqueue every other
+// node once all its dependencies have succeeded. Returns the run ID.
+//
+// If the queue of a node without dependencies is full (see QueueLimit),
+// nothing is written and the error wraps ErrQueueFull; StartWorkflow does
+// not wait with OverflowBlock.
+func (c *Client) StartWorkflow(ctx context.Context, wf Workflow) (string, error) {
+	if err := validateWorkflow(wf); err != nil {
+		return "", err
+	}
+	ttl := wf.TTL
+	if ttl <= 0 {
+		ttl = DefaultWorkflowTTL
+	}
+
+	id, err := newTaskID()
+	if err != nil {
+		return "", err
+	}
+
+	defs := make([]workflowNodeDef, 0, len(wf.Nodes))
+	var roots []*preparedTask
+	state := map[string]interface{}{
+		"name":      wf.Name,
+		"status":    string(WorkflowRunning),
+		"startedAt": time.Now().UnixMilli(),
+	}
+	for _, n := range wf.Nodes {
+		o := n.Options
+		if err := checkOptions(fmt.Sprintf("workflow node %q", n.Name), o, ruleWrittenByScript); err != nil {
+			return "", err
+		}
+		taskName := n.TaskName
+		if taskName == "" {
+			taskName = n.Name
+		}
+		task, err := c.prepareTask(taskName, n.Payload, o)
+		if err != nil {
+			return "", fmt.Errorf("workflow node %q: %w", n.Name, err)
+		}
+		task.setField("workflowId", id)
+		task.setField("workflowNode", n.Name)
+
+		def := workflowNodeDef{
+			Name:     n.Name,
+			TaskName: taskName,
+			Deps:     append([]string{}, n.DependsOn...),
+			Stream:   task.streamKey,
+		}
+		// Nodes are stamped with the time they are actually enqueued
+		def.Fields = task.fields("enqueuedAt")
+		defs = append(defs, def)
+
+		if len(n.DependsOn) == 0 {
+			roots = append(roots, task)
+			state["node:"+n.Name] = string(NodeQueued)
+		} else {
+			state["node:"+n.Name] = string(NodePending)
+		}
+	}
+	nodesJSON, err := json.Marshal(defs)
+	if err != nil {
+		return "", fmt.Errorf("marshal workflow: %w", err)
+	}
+	state["nodes"] = string(nodesJSON)
+
+	plan := newAtomicPlan()
+	for _, task := range roots {
+		plan.add(c, task)
+	}
+	for field, value := range state {
+		plan.hset(c.workflowKey(id), field, fmt.Sprint(value), false, ttl)
+	}
+	if _, conflict, err := plan.run(ctx, c.redis).result(); err == ErrQueueFull {
+		return "", fmt.Errorf("workflow node %q: %w", roots[conflict].values["workflowNode"], err)
+	} else if err != nil {
+		return "", fmt.Errorf("start workflow: %w", err)
+	}
+	return id, nil
+}
+
+// GetWorkflow returns the state of a workflow run, or ErrWorkflowNotFound if
+// it does not exist or its state expired.
+func (c *Client) GetWorkflow(ctx context.Context, id string) (*WorkflowState, error) {
+	pipe := c.redis.Pipeline()
+	stateCmd := pipe.HGetAll(ctx, c.workflowKey(id))
+	resultsCmd := pipe.HGetAll(ctx, c.workflowResultsKey(id))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("get workflow: %w", err)
+	}
+
+	state := stateCmd.Val()
+	if len(state) == 0 {
+		return nil, ErrWorkflowNotFound
+	}
+	var defs []workflowNodeDef
+	if err := json.Unmarshal([]byte(state["nodes"]), &defs); err != nil {
+		return nil, fmt.Errorf("decode workflow: %w", err)
+	}
+
+	wf := &WorkflowState{
+		ID:     id,
+		Name:   state["name"],
+		Status: WorkflowStatus(state["status"]),
+		Nodes:  make([]NodeState, 0, len(defs)),
+	}
+	if ms, err := strconv.ParseInt(state["startedAt"], 10, 64); err == nil {
+		wf.StartedAt = time.UnixMilli(ms)
+	}
+	if ms, err := strconv.ParseInt(state["finishedAt"], 10, 64); err == nil {
+		wf.FinishedAt = time.UnixMilli(ms)
+	}
+	results := resultsCmd.Val()
+	for _, def := range defs {
+		node := NodeState{
+			Name:      def.Name,
+			TaskName:  def.TaskName,
+			DependsOn: def.Deps,
+			Status:    NodeStatus(state["node:"+def.Name]),
+		}
+		if r, ok := results[def.Name]; ok {
+			node.Result = json.RawMessage(r)
+		}
+		wf.Nodes = append(wf.Nodes, node)
+	}
+	return wf, nil
+}
+
+// CancelWorkflow cancels a workflow run, or every task descending from a
+// root task.
+//
+// For a run, nodes that have not started never run; running nodes finish,
+// but no further node is enqueued. Cancelling a finished run does nothing.
+//
+// For a root task, identified by its task ID (see TaskInfo.RootID),
+// scheduled and parked descendants are removed, as are queued ones not yet
+// delivered; the others, and the root task itself if still queued, are
+// dropped when delivered. Running ones have their context cancelled with
+// ErrWorkflowCancelled as its cause (see context.Cause); if their handler
+// then fails, they are dropped instead of retried. Tasks enqueued in the
+// tree afterwards are refused with ErrWorkflowCancelled.
+//
+// Any ID may be that of a queued root task, so the first cancellation of a
+// task ID succeeds. Returns ErrWorkflowNotFound if id is not a run and its
+// tree was already cancelled, with no descendant or scheduled task left.
+func (c *Client) CancelWorkflow(ctx context.Context, id string) error {
+	status, err := c.redis.Eval(ctx, workflowCancelLua, []string{c.workflowKey(id)},
+		time.Now().UnixMilli(),
+	).Text()
+	if err != nil {
+		return fmt.Errorf("cancel workflow: %w", err)
+	}
+	found, err := c.cancelTree(ctx, id, "cancelled")
+	if err != nil {
+		return fmt.Errorf("cancel workflow: %w", err)
+	}
+	if status == "" && !found {
+		return ErrWorkflowNotFound
+	}
+	return nil
+}
+
+// startWorkflowNode marks the workflow node msg runs as running. It reports
+// false if the node must not run because its run was cancelled or failed,
+// and errNodeFinished if the node already finished on an earlier delivery.
+func (c *Client) startWorkflowNode(ctx context.Context, msg redis.XMessage) (bool, error) {
+	id, _ := msg.Values["workflowId"].(string)
+	if id == "" {
+		return true, nil
+	}
+	node, _ := msg.Values["workflowNode"].(string)
+
+	res, err := c.redis.Eval(ctx, workflowStartNodeLua, []string{c.workflowKey(id)}, node).StringSlice()
+	if err != nil {
+		return false, err
+	}
+	status, nodeStatus := res[0], NodeStatus(res[1])
+	// A run whose state expired is unknown; its nodes still run
+	if status == "" {
+		return true, nil
+	}
+	if nodeStatus == NodeSucceeded || nodeStatus == NodeFailed {
+		return false, errNodeFinished
+	}
+	return status == string(WorkflowRunning) && (nodeStatus == NodeQueued || nodeStatus == NodeRunning), nil
+}
+
+// finishWorkflowNode records that the workflow node msg runs finished, if it
+// is one, and advances its run. result is its SetResult value, if any.
+func (c *Client) finishWorkflowNode(ctx context.Context, msg redis.XMessage, result json.RawMessage, failed bool) error {
+	id, _ := msg.Values["workflowId"].(string)
+	if id == "" {
+		return nil
+	}
+	node, _ := msg.Values["workflowNode"].(string)
+
+	failedArg := "0"
+	if failed {
+		failedArg = "1"
+	}
+	// The nodes are fixed when the run starts
+	keys := []string{c.workflowKey(id), c.workflowResultsKey(id)}
+	raw, err := c.redis.HGet(ctx, keys[0], "nodes").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	var nodes []workflowNodeDef
+	json.Unmarshal([]byte(raw), &nodes)
+	seen := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if !seen[n.Stream] {
+			seen[n.Stream] = true
+			keys = append(keys, n.Stream)
+		}
+	}
+	status, err := c.redis.Eval(ctx, workflowAdvanceLua, keys,
+		node, failedArg, string(result), time.Now().UnixMilli(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case 1:
+		c.logger.Info("Workflow completed", "workflow", id)
+	case 2:
+		c.logger.Warn("Workflow failed", "workflow", id, "node", node)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package backstage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// diamond is a workflow where b and c depend on a, and d joins them.
+var diamond = Workflow{
+	Name: "diamond",
+	Nodes: []WorkflowNode{
+		{Name: "a"},
+		{Name: "b", DependsOn: []string{"a"}},
+		{Name: "c", DependsOn: []string{"a"}},
+		{Name: "d", DependsOn: []string{"b", "c"}},
+	},
+}
+
+// nodeStatuses returns the status of every node of a run by name.
+func nodeStatuses(t *testing.T, client *Client, id string) map[string]NodeStatus {
+	t.Helper()
+	wf, err := client.GetWorkflow(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetWorkflow failed: %v", err)
+	}
+	statuses := make(map[string]NodeStatus, len(wf.Nodes))
+	for _, n := range wf.Nodes {
+		statuses[n.Name] = n.Status
+	}
+	return statuses
+}
+
+func newWorkflowClient(t *testing.T, prefix string) *Client {
+	client := newIsolatedClient(t, prefix)
+	client.initConsumerGroups(context.Background())
+	for _, name := range []string{"a", "b", "c", "d"} {
+		name := name
+		client.On(name, func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+			return nil, SetResult(ctx, name)
+		})
+	}
+	return client
+}
+
+func TestWorkflowDiamond(t *testing.T) {
+	client := newWorkflowClient(t, "test-workflow")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, err := client.StartWorkflow(ctx, diamond)
+	if err != nil {
+		t.Fatalf("StartWorkflow failed: %v", err)
+	}
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 1 {
+		t.Fatalf("expected only the root enqueued, got %d", n)
+	}
+
+	runMembers(t, client, 1) // a
+	b, c := readOne(t, client, stream), readOne(t, client, stream)
+	client.handleMessage(ctx, stream, b)
+	if s := nodeStatuses(t, client, id); s["b"] != NodeSucceeded || s["c"] != NodeQueued || s["d"] != NodePending {
+		t.Errorf("expected d to wait for c, got %v", s)
+	}
+
+	client.handleMessage(ctx, stream, c)
+	client.handleDelivery(ctx, stream, c, 2) // Redelivered after a lost ACK
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 4 {
+		t.Errorf("expected the join enqueued once, stream has %d entries", n)
+	}
+	runMembers(t, client, 1) // d
+
+	wf, _ := client.GetWorkflow(ctx, id)
+	if wf.Status != WorkflowCompleted || wf.Name != "diamond" || wf.FinishedAt.IsZero() {
+		t.Errorf("expected a completed run, got %+v", wf)
+	}
+	if string(wf.Nodes[3].Result) != `"d"` {
+		t.Errorf("expected node results, got %s", wf.Nodes[3].Result)
+	}
+}
+
+func TestWorkflowNodeFailure(t *testing.T) {
+	client := newWorkflowClient(t, "test-workflow-fail")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, _ := client.StartWorkflow(ctx, diamond)
+	runMembers(t, client, 1) // a
+	client.moveToDeadLetter(ctx, PriorityDefault, readOne(t, client, stream))
+	runMembers(t, client, 1) // c, skipped
+
+	wf, _ := client.GetWorkflow(ctx, id)
+	if wf.Status != WorkflowFailed {
+		t.Errorf("expected a failed run, got %s", wf.Status)
+	}
+	s := nodeStatuses(t, client, id)
+	if s["b"] != NodeFailed || s["c"] != NodeSkipped || s["d"] != NodeSkipped {
+		t.Errorf("expected the other nodes skipped, got %v", s)
+	}
+}
+
+func TestWorkflowNodeRedeliveredAfterSuccess(t *testing.T) {
+	client := newWorkflowClient(t, "test-workflow-redeliver")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	runs := 0
+	client.On("a", func(ctx context.Context, payload json.RawMessage) (*WorkflowInstruction, error) {
+		runs++
+		return nil, nil
+	})
+
+	id, _ := client.StartWorkflow(ctx, diamond)
+	started := client.redis.HGet(ctx, client.workflowKey(id), "startedAt").Val()
+	time.Sleep(5 * time.Millisecond)
+
+	a := readOne(t, client, stream)
+	client.handleMessage(ctx, stream, a)
+	client.handleDelivery(ctx, stream, a, 2) // ACK lost after the node succeeded
+
+	if runs != 1 {
+		t.Errorf("expected the finished node not to run again, ran %d times", runs)
+	}
+	if s := nodeStatuses(t, client, id); s["a"] != NodeSucceeded || s["b"] != NodeQueued {
+		t.Errorf("expected the run to advance once, got %v", s)
+	}
+
+	b := readOne(t, client, stream)
+	if b.Values["enqueuedAt"] == started {
+		t.Errorf("expected b stamped when it was enqueued, got the run's start time %s", started)
+	}
+}
+
+func TestCancelWorkflow(t *testing.T) {
+	client := newWorkflowClient(t, "test-workflow-cancel")
+	ctx := context.Background()
+	stream := client.streamKey(PriorityDefault)
+
+	id, _ := client.StartWorkflow(ctx, diamond)
+	if err := client.CancelWorkflow(ctx, id); err != nil {
+		t.Fatalf("CancelWorkflow failed: %v", err)
+	}
+	root := readOne(t, client, stream)
+	client.handleMessage(ctx, stream, root) // Dropped
+
+	if n, _ := client.redis.XLen(ctx, stream).Result(); n != 1 {
+		t.Errorf("expected nothing enqueued after cancellation, got %d entries", n)
+	}
+	select {
+	case req := <-client.ackChan:
+		if req.id != root.ID {
+			t.Errorf("expected the dropped node acknowledged, got %s", req.id)
+		}
+	default:
+		t.Error("expected the dropped node acknowledged")
+	}
+	wf, _ := client.GetWorkflow(ctx, id)
+	if wf.Status != WorkflowCancelled || wf.Nodes[0].Status != NodeCancelled {
+		t.Errorf("expected a cancelled run, got %+v", wf)
+	}
+
+	client.CancelWorkflow(ctx, "missing")
+	if err := client.CancelWorkflow(ctx, "missing"); !errors.Is(err, ErrWorkflowNotFound) {
+		t.Errorf("expected ErrWorkflowNotFound, got %v", err)
+	}
+}
+
+func TestValidateWorkflow(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []WorkflowNode
+	}{
+		{"empty", nil},
+		{"duplicate", []WorkflowNode{{Name: "a"}, {Name: "a"}}},
+		{"unknown dependency", []WorkflowNode{{Name: "a", DependsOn: []string{"z"}}}},
+		{"cycle", []WorkflowNode{
+			{Name: "a", DependsOn: []string{"c"}},
+			{Name: "b", DependsOn: []string{"a"}},
+			{Name: "c", DependsOn: []string{"b"}},
+		}},
+	}
+	for _, tt := range tests {
+		if err := validateWorkflow(Workflow{Nodes: tt.nodes}); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if err := validateWorkflow(diamond); err != nil {
+		t.Errorf("expected the diamond to be valid, got %v", err)
+	}
+}
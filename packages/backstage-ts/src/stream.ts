@@ -16,12 +16,14 @@ import { Queue } from './queue';
  * Prevents race conditions when multiple schedulers are running.
  *
  * KEYS[1]: Scheduled ZSET key
+ * KEYS[2]: Scheduled task ID index, shared with the Go SDK
  * ARGV[1]: Current timestamp (cutoff)
  * ARGV[2]: Stream key prefix
  * ARGV[3]: Default priority name
  */
 const PROCESS_SCHEDULED_LUA = `
 local zsetKey = KEYS[1]
+local indexKey = KEYS[2]
 local cutoff = tonumber(ARGV[1])
 local prefix = ARGV[2]
 local defaultPriority = ARGV[3]
@@ -33,24 +35,23 @@ for _, taskData in ipairs(tasks) do
     local ok, task = pcall(cjson.decode, taskData)
     if ok and task then
         local streamKey = task.streamKey or (prefix .. ':' .. (task.priority or defaultPriority))
-        
+
         local args = {streamKey, '*', 'taskName', task.taskName or '', 'payload', task.payload or '{}', 'enqueuedAt', tostring(task.enqueuedAt or 0)}
-        
-        if task.attempts then
-            table.insert(args, 'attempts')
-            table.insert(args, tostring(task.attempts))
-        end
-        if task.backoff then
-            table.insert(args, 'backoff')
-            table.insert(args, task.backoff)
-        end
-        if task.timeout then
-            table.insert(args, 'timeout')
-            table.insert(args, tostring(task.timeout))
+
+        -- Copy every other field, so metadata written by either SDK survives the move
+        for k, v in pairs(task) do
+            if k ~= 'taskName' and k ~= 'payload' and k ~= 'enqueuedAt'
+                and k ~= 'streamKey' and k ~= 'priority' and type(v) ~= 'table' then
+                table.insert(args, k)
+                table.insert(args, tostring(v))
+            end
         end
-        
+
         redis.call('XADD', unpack(args))
         redis.call('ZREM', zsetKey, taskData)
+        if task.taskId then
+            redis.call('HDEL', indexKey, task.taskId)
+        end
         processed = processed + 1
     end
 end
@@ -240,12 +241,15 @@ export class Stream {
    */
   async processScheduledTasks(): Promise<number> {
     const scheduledKey = `${this.prefix}:scheduled`;
+    // Index of scheduled task IDs kept by the Go SDK; moved tasks leave it
+    const indexKey = `${this.prefix}:scheduled-index`;
     const now = Date.now();
 
     const result = await this.redis.send('EVAL', [
       PROCESS_SCHEDULED_LUA,
-      '1',
+      '2',
       scheduledKey,
+      indexKey,
       String(now),
       this.prefix,
       this.defaultPriority,
@@ -134,6 +134,48 @@ describe('Cross-Language Interoperability', () => {
     }
   });
 
+  test('TS moves Go-scheduled tasks with all their fields', async () => {
+    // A delayed task as the Go SDK schedules it
+    const taskData = JSON.stringify({
+      taskName: 'interop.go-scheduled',
+      payload: '{}',
+      enqueuedAt: Date.now(),
+      streamKey: 'backstage:interop:scheduled',
+      taskId: 'interop-scheduled-1',
+      idempotencyKey: 'interop-key',
+      rootId: 'interop-root',
+    });
+    await redis.send('ZADD', [
+      'backstage:scheduled',
+      String(Date.now() - 1000),
+      taskData,
+    ]);
+    await redis.send('HSET', [
+      'backstage:scheduled-index',
+      'interop-scheduled-1',
+      taskData,
+    ]);
+
+    await stream.processScheduledTasks();
+
+    const entries = (await redis.send('XRANGE', [
+      'backstage:interop:scheduled',
+      '-',
+      '+',
+    ])) as [string, unknown[]][];
+    expect(entries).toHaveLength(1);
+    const fields = parseFields(entries[0]![1]);
+    expect(fields.taskId).toBe('interop-scheduled-1');
+    expect(fields.idempotencyKey).toBe('interop-key');
+    expect(fields.rootId).toBe('interop-root');
+
+    const indexed = await redis.send('HEXISTS', [
+      'backstage:scheduled-index',
+      'interop-scheduled-1',
+    ]);
+    expect(indexed).toBeFalsy();
+  });
+
   test('priority streams match between TS and Go', async () => {
     // Verify stream key format matches
     const streamKeys = stream.getStreamKeys();